@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// activityBinding binds an activity name to the command that processes its tasks.
+type activityBinding struct {
+	name    string
+	cmd     string
+	cmdArgs []string
+	// inputMode is how task input is passed to cmd. Empty means the -input-mode flag.
+	inputMode string
+}
+
+// activityBindings is a flag.Value that collects repeated `-activity name=cmd [args...]` flags.
+type activityBindings []activityBinding
+
+func (a *activityBindings) String() string {
+	if a == nil {
+		return ""
+	}
+	bindings := []string{}
+	for _, binding := range *a {
+		bindings = append(bindings, binding.String())
+	}
+	return strings.Join(bindings, ", ")
+}
+
+// Set parses a binding of the form `name=cmd [args...]`.
+// Environment variables are expanded in both the name and the command.
+func (a *activityBindings) Set(value string) error {
+	binding, err := parseActivityBinding(value)
+	if err != nil {
+		return err
+	}
+	return a.add(binding)
+}
+
+func (a *activityBindings) add(binding activityBinding) error {
+	for _, existing := range *a {
+		if existing.name == binding.name {
+			return fmt.Errorf("activity %s is bound more than once", binding.name)
+		}
+	}
+	*a = append(*a, binding)
+	return nil
+}
+
+func (b activityBinding) String() string {
+	return fmt.Sprintf("%s=%s", b.name, strings.Join(append([]string{b.cmd}, b.cmdArgs...), " "))
+}
+
+func parseActivityBinding(value string) (activityBinding, error) {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 {
+		return activityBinding{}, fmt.Errorf("activity binding '%s' must be of the form name=cmd", value)
+	}
+	name := strings.TrimSpace(os.ExpandEnv(parts[0]))
+	cmdFields := strings.Fields(os.ExpandEnv(parts[1]))
+	if name == "" {
+		return activityBinding{}, fmt.Errorf("activity binding '%s' is missing an activity name", value)
+	}
+	if len(cmdFields) == 0 {
+		return activityBinding{}, fmt.Errorf("activity binding '%s' is missing a cmd", value)
+	}
+	return activityBinding{name: name, cmd: cmdFields[0], cmdArgs: cmdFields[1:]}, nil
+}
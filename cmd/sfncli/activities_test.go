@@ -0,0 +1,38 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestActivityBindings(t *testing.T) {
+	t.Run("parses name and command with args", func(t *testing.T) {
+		os.Setenv("SFNCLI_TEST_ENV", "dev")
+		defer os.Unsetenv("SFNCLI_TEST_ENV")
+
+		var bindings activityBindings
+		require.NoError(t, bindings.Set("$SFNCLI_TEST_ENV--resize=./bin/resize --fast"))
+		require.NoError(t, bindings.Set("dev--echo=echo"))
+		assert.Equal(t, activityBindings{
+			{name: "dev--resize", cmd: "./bin/resize", cmdArgs: []string{"--fast"}},
+			{name: "dev--echo", cmd: "echo", cmdArgs: []string{}},
+		}, bindings)
+	})
+
+	t.Run("fails on malformed bindings", func(t *testing.T) {
+		var bindings activityBindings
+		assert.Error(t, bindings.Set("no-command"))
+		assert.Error(t, bindings.Set("=echo"))
+		assert.Error(t, bindings.Set("no-command= "))
+		assert.Empty(t, bindings)
+	})
+
+	t.Run("fails when an activity is bound twice", func(t *testing.T) {
+		var bindings activityBindings
+		require.NoError(t, bindings.Set("echo=echo"))
+		assert.Error(t, bindings.Set("echo=cat"))
+	})
+}
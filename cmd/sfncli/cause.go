@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
+)
+
+// cause formats
+const (
+	// causeFormatText reports the cause of a failure as is, e.g. the end of the stderr of the command.
+	causeFormatText = "text"
+	// causeFormatJSON reports the cause of a failure as a structuredCause, which a Catch state can
+	// parse with States.StringToJson.
+	causeFormatJSON = "json"
+)
+
+// structuredCause is the cause of a failure in the json cause format.
+type structuredCause struct {
+	Error           string `json:"error"`
+	Cause           string `json:"cause"`
+	ExitCode        *int   `json:"exit_code,omitempty"`
+	Signal          string `json:"signal,omitempty"`
+	DurationMs      *int64 `json:"duration_ms,omitempty"`
+	WorkerName      string `json:"worker_name,omitempty"`
+	SfncliVersion   string `json:"sfncli_version,omitempty"`
+	ExecutionName   string `json:"execution_name,omitempty"`
+	Stderr          string `json:"stderr,omitempty"`
+	StderrTruncated bool   `json:"stderr_truncated,omitempty"`
+}
+
+// taskFailureStructured is a failure reported with a structuredCause instead of its own cause.
+type taskFailureStructured struct {
+	TaskFailureError
+	cause string
+}
+
+func (t taskFailureStructured) ErrorCause() string { return t.cause }
+func (t taskFailureStructured) Error() string {
+	return fmt.Sprintf("%s: %s", t.ErrorName(), t.ErrorCause())
+}
+func (t taskFailureStructured) Unwrap() error { return t.TaskFailureError }
+
+// structuredFailure adds what is known about the task and the command to a failure. The original cause
+// is left out when it is the end of stderr, which the JSON has already. The cause is kept under
+// maxTaskFailureCauseLength by dropping the beginning of stderr, and then shortening the original
+// cause, so that it stays valid JSON when Step Functions receives it.
+func (t *TaskRunner) structuredFailure(err TaskFailureError) taskFailureStructured {
+	cause := structuredCause{
+		Error:         err.ErrorName(),
+		Cause:         err.ErrorCause(),
+		WorkerName:    t.workerName,
+		SfncliVersion: Version,
+		ExecutionName: t.executionName,
+	}
+	if state := t.processState(); state != nil {
+		status := state.Sys().(syscall.WaitStatus)
+		if status.Exited() {
+			exitCode := status.ExitStatus()
+			cause.ExitCode = &exitCode
+		} else if status.Signaled() {
+			cause.Signal = signalName(status.Signal())
+		}
+	}
+	if !t.started.IsZero() {
+		durationMs := time.Since(t.started).Milliseconds()
+		cause.DurationMs = &durationMs
+	}
+	if t.stderrbuf != nil {
+		cause.Stderr = strings.TrimSpace(t.stderrbuf.String())
+		if cause.Cause == cause.Stderr {
+			cause.Cause = ""
+		}
+	}
+
+	for {
+		b, _ := json.Marshal(cause)
+		over := len(b) - maxTaskFailureCauseLength
+		switch {
+		case over <= 0:
+			return taskFailureStructured{TaskFailureError: err, cause: string(b)}
+		case cause.Stderr != "":
+			cause.Stderr = escapedTail(cause.Stderr, escapedLength(cause.Stderr)-over)
+			cause.StderrTruncated = true
+		case cause.Cause != "":
+			if shortened, ok := shortenEnvelopeCause(cause.Cause, over); ok {
+				cause.Cause = shortened
+			} else {
+				cause.Cause = dropSuffix(cause.Cause, over)
+			}
+		default:
+			// the other fields are never this long
+			return taskFailureStructured{TaskFailureError: err, cause: string(b)}
+		}
+	}
+}
+
+// processState is the state of the command once it exited, if it did.
+func (t *TaskRunner) processState() *os.ProcessState {
+	if t.persistentWorker != nil {
+		if t.persistentWorker.execCmd == nil || t.persistentWorker.running() {
+			return nil
+		}
+		return t.persistentWorker.execCmd.ProcessState
+	}
+	if t.execCmd == nil {
+		return nil
+	}
+	return t.execCmd.ProcessState
+}
+
+// signalName is the name of a signal like SIGKILL.
+func signalName(sig syscall.Signal) string {
+	for name, s := range signalNames {
+		if s == sig {
+			return "SIG" + name
+		}
+	}
+	return sig.String()
+}
+
+// escapedTail is the longest end of s that is at most n bytes once escaped in JSON.
+func escapedTail(s string, n int) string {
+	i := len(s)
+	for i > 0 {
+		r, size := utf8.DecodeLastRuneInString(s[:i])
+		if n -= escapedRuneLength(r, size); n < 0 {
+			break
+		}
+		i -= size
+	}
+	return s[i:]
+}
+
+// escapedLength is the length of s once escaped in JSON, without the quotes.
+func escapedLength(s string) int {
+	n := 0
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		n += escapedRuneLength(r, size)
+		i += size
+	}
+	return n
+}
+
+// escapedRuneLength is the length of a rune once escaped by encoding/json.
+func escapedRuneLength(r rune, size int) int {
+	switch {
+	case r == '"' || r == '\\' || r == '\n' || r == '\r' || r == '\t':
+		return 2
+	case r < 0x20 || r == '<' || r == '>' || r == '&' || r == '\u2028' || r == '\u2029':
+		return 6
+	case r == utf8.RuneError && size == 1:
+		return 6
+	}
+	return size
+}
+
+// dropSuffix drops at least n bytes from the end of s, without splitting a character.
+func dropSuffix(s string, n int) string {
+	if n >= len(s) {
+		return ""
+	}
+	return strings.ToValidUTF8(s[:len(s)-n], "")
+}
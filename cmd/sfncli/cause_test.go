@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"path"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/Clever/sfncli/mocks"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStructuredCause(t *testing.T) {
+	t.Run("has the exit code, duration, worker and execution of the task", func(t *testing.T) {
+		controller := gomock.NewController(t)
+		defer controller.Finish()
+		mockSFN := mocks.NewMockSFNAPI(controller)
+		mockSFN.EXPECT().SendTaskFailure(gomock.Any(), gomock.Any())
+		taskRunner := NewTaskRunner(path.Join(testScriptsDir, "stderr_stdout_exitcode.sh"), mockSFN, mockTaskToken, "")
+		taskRunner.causeFormat = causeFormatJSON
+		taskRunner.workerName = "worker-1"
+		err := taskRunner.Process(context.Background(), []string{"oh no", `{"stdout":"mustbejson"}`, "3"}, emptyTaskInput)
+
+		structured, ok := err.(taskFailureStructured)
+		require.True(t, ok, "got %v", err)
+		assert.Equal(t, TaskFailureCommandExitedNonzero{stderr: "oh no"}, structured.TaskFailureError)
+		assert.Equal(t, "sfncli.CommandExitedNonzero", structured.ErrorName())
+		var cause structuredCause
+		require.NoError(t, json.Unmarshal([]byte(structured.ErrorCause()), &cause))
+		require.NotNil(t, cause.ExitCode)
+		require.NotNil(t, cause.DurationMs)
+		// the cause is the end of stderr, so only stderr has it
+		assert.Equal(t, structuredCause{
+			Error:         "sfncli.CommandExitedNonzero",
+			ExitCode:      cause.ExitCode,
+			DurationMs:    cause.DurationMs,
+			WorkerName:    "worker-1",
+			SfncliVersion: Version,
+			ExecutionName: "fake-WFM-uuid",
+			Stderr:        "oh no",
+		}, cause)
+		assert.Equal(t, 3, *cause.ExitCode)
+		assert.Equal(t, exitCodeCommandFailed, exitCodeForTask(err))
+	})
+
+	t.Run("has the signal of a killed command", func(t *testing.T) {
+		controller := gomock.NewController(t)
+		defer controller.Finish()
+		mockSFN := mocks.NewMockSFNAPI(controller)
+		mockSFN.EXPECT().SendTaskFailure(gomock.Any(), gomock.Any())
+		taskRunner := NewTaskRunner(path.Join(testScriptsDir, "oom_kill.sh"), mockSFN, mockTaskToken, "")
+		taskRunner.causeFormat = causeFormatJSON
+		err := taskRunner.Process(context.Background(), []string{path.Join(t.TempDir(), "memory.events")}, emptyTaskInput)
+
+		var cause structuredCause
+		require.NoError(t, json.Unmarshal([]byte(err.(TaskFailureError).ErrorCause()), &cause))
+		assert.Nil(t, cause.ExitCode)
+		assert.Equal(t, "SIGKILL", cause.Signal)
+	})
+
+	t.Run("is truncated to valid JSON", func(t *testing.T) {
+		taskRunner := NewTaskRunner("", nil, mockTaskToken, "")
+		stderr := strings.Repeat("é\"\n", maxTaskFailureCauseLength) + "the end"
+		taskRunner.stderrbuf = stringer(stderr)
+		failure := taskRunner.structuredFailure(TaskFailureCommandExitedNonzero{stderr: stderr})
+
+		assert.LessOrEqual(t, len(failure.ErrorCause()), maxTaskFailureCauseLength)
+		var cause structuredCause
+		require.NoError(t, json.Unmarshal([]byte(failure.ErrorCause()), &cause))
+		assert.Empty(t, cause.Cause)
+		assert.True(t, cause.StderrTruncated)
+		assert.True(t, utf8.ValidString(cause.Stderr))
+		assert.True(t, strings.HasSuffix(cause.Stderr, "the end"))
+		assert.Greater(t, len(failure.ErrorCause()), maxTaskFailureCauseLength-10)
+
+		// a long cause is shortened once stderr is gone
+		taskRunner.stderrbuf = stringer("oh no")
+		failure = taskRunner.structuredFailure(TaskFailureCustom{Err: "custom.error_name", Cause: stderr})
+		assert.LessOrEqual(t, len(failure.ErrorCause()), maxTaskFailureCauseLength)
+		cause = structuredCause{}
+		require.NoError(t, json.Unmarshal([]byte(failure.ErrorCause()), &cause))
+		assert.Empty(t, cause.Stderr)
+		assert.True(t, cause.StderrTruncated)
+		assert.True(t, utf8.ValidString(cause.Cause))
+		assert.True(t, strings.HasPrefix(stderr, cause.Cause))
+
+		// the end of stderr is kept when the cause is short
+		stderr = strings.Repeat("é\"\n", maxTaskFailureCauseLength/4) + "the end"
+		taskRunner.stderrbuf = stringer(stderr)
+		failure = taskRunner.structuredFailure(TaskFailureCustom{Err: "custom.error_name", Cause: "bar"})
+		assert.LessOrEqual(t, len(failure.ErrorCause()), maxTaskFailureCauseLength)
+		cause = structuredCause{}
+		require.NoError(t, json.Unmarshal([]byte(failure.ErrorCause()), &cause))
+		assert.Equal(t, "bar", cause.Cause)
+		assert.True(t, cause.StderrTruncated)
+		assert.True(t, utf8.ValidString(cause.Stderr))
+		assert.True(t, strings.HasSuffix(stderr, cause.Stderr))
+		assert.True(t, strings.HasSuffix(cause.Stderr, "the end"))
+	})
+
+	t.Run("drops the partial result of an error envelope instead of truncating it", func(t *testing.T) {
+		taskRunner := NewTaskRunner("", nil, mockTaskToken, "")
+		taskRunner.stderrbuf = stringer("oh no")
+		envelopeFailure, ok := parseErrorEnvelope(map[string]interface{}{
+			errorEnvelopeField: map[string]interface{}{"error": "custom.error_name", "cause": "bar"},
+			"uploaded":         strings.Repeat("\"", maxTaskFailureCauseLength/3),
+		})
+		require.True(t, ok)
+		failure := taskRunner.structuredFailure(envelopeFailure)
+
+		assert.LessOrEqual(t, len(failure.ErrorCause()), maxTaskFailureCauseLength)
+		var cause structuredCause
+		require.NoError(t, json.Unmarshal([]byte(failure.ErrorCause()), &cause))
+		var envelope envelopeCause
+		require.NoError(t, json.Unmarshal([]byte(cause.Cause), &envelope))
+		assert.Equal(t, envelopeCause{Cause: "bar", PartialResultTooLarge: true}, envelope)
+	})
+}
+
+type stringer string
+
+func (s stringer) String() string { return string(s) }
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// exit codes of `sfncli classify`
+const (
+	classifyExitSuccess = 0
+	classifyExitUsage   = 2
+)
+
+// classifyExit names the failure of a command that exited nonzero without reporting a custom error:
+// the first matching exit code rule, then the first matching stderr rule, then sfncli.CommandExitedNonzero.
+func classifyExit(exitCodes exitCodeErrors, stderrRules stderrErrors, exitCode int, stderr string) TaskFailureError {
+	if failure, ok := exitCodes.failure(exitCode, stderr); ok {
+		return failure
+	}
+	if failure, ok := stderrRules.failure(stderr); ok {
+		return failure
+	}
+	return TaskFailureCommandExitedNonzero{stderr: stderr}
+}
+
+// classify implements `sfncli classify`: it prints the error name sfncli would report for a command
+// that exited nonzero with a sample of stderr, read from a file or stdin, so that the -exit-code-error
+// and -stderr-error rules can be tested without running the command.
+func classify(args []string, stdin io.Reader, out io.Writer) int {
+	fs := flag.NewFlagSet("classify", flag.ContinueOnError)
+	configFile := fs.String("config", "", "A config file to read the exit-code-errors and stderr-errors rules from. Rules passed on the command line override the file.")
+	exitCode := fs.Int("exit-code", 1, "The exit code of the command.")
+	var exitCodeRules exitCodeErrors
+	fs.Var(&exitCodeRules, "exit-code-error", "An exit code rule, as codes=name[:cause]. May be repeated.")
+	var stderrRules stderrErrors
+	fs.Var(&stderrRules, "stderr-error", "A stderr rule, as name=regexp. May be repeated.")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: sfncli classify [-config <file>] [-exit-code-error <rule>...] [-stderr-error <rule>...] [-exit-code <code>] [stderr-file]")
+		fmt.Fprintln(fs.Output(), "Prints the error name sfncli reports for a command that exits nonzero with this stderr. Reads stderr from stdin if no file is given.")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return classifyExitUsage
+	}
+	if *exitCode < 1 || *exitCode > 255 {
+		fmt.Fprintln(fs.Output(), "exit-code must be between 1 and 255")
+		return classifyExitUsage
+	}
+	if fs.NArg() > 1 {
+		fmt.Fprintln(fs.Output(), "at most one stderr file can be given")
+		return classifyExitUsage
+	}
+
+	if *configFile != "" {
+		setOnCommandLine := map[string]bool{}
+		fs.Visit(func(f *flag.Flag) { setOnCommandLine[f.Name] = true })
+		fileCfg, err := loadConfigFile(*configFile)
+		if err != nil {
+			fmt.Fprintln(fs.Output(), err)
+			return classifyExitUsage
+		}
+		if !setOnCommandLine["exit-code-error"] {
+			for _, rule := range fileCfg.ExitCodeErrors {
+				if err := exitCodeRules.Set(rule.String()); err != nil {
+					fmt.Fprintf(fs.Output(), "invalid config value for exit-code-errors: %s\n", err)
+					return classifyExitUsage
+				}
+			}
+		}
+		if !setOnCommandLine["stderr-error"] {
+			for _, rule := range fileCfg.StderrErrors {
+				if err := stderrRules.Set(rule.String()); err != nil {
+					fmt.Fprintf(fs.Output(), "invalid config value for stderr-errors: %s\n", err)
+					return classifyExitUsage
+				}
+			}
+		}
+	}
+
+	var stderr []byte
+	var err error
+	if fs.NArg() == 0 || fs.Arg(0) == "-" {
+		stderr, err = io.ReadAll(stdin)
+	} else {
+		stderr, err = os.ReadFile(fs.Arg(0))
+	}
+	if err != nil {
+		fmt.Fprintf(fs.Output(), "error reading stderr: %s\n", err)
+		return classifyExitUsage
+	}
+
+	// the same as the stderr of a command, which has its trailing newline removed
+	failure := classifyExit(exitCodeRules, stderrRules, *exitCode, strings.TrimSpace(string(stderr)))
+	fmt.Fprintln(out, failure.ErrorName())
+	return classifyExitSuccess
+}
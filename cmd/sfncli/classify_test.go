@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClassify(t *testing.T) {
+	t.Run("classifies stderr from stdin", func(t *testing.T) {
+		var out bytes.Buffer
+		code := classify([]string{"-stderr-error", "Transient.Network=connection reset by peer"}, strings.NewReader("read: connection reset by peer\n"), &out)
+		assert.Equal(t, classifyExitSuccess, code)
+		assert.Equal(t, "Transient.Network\n", out.String())
+	})
+
+	t.Run("falls back to sfncli.CommandExitedNonzero", func(t *testing.T) {
+		var out bytes.Buffer
+		code := classify([]string{"-stderr-error", "Transient.Network=connection reset by peer"}, strings.NewReader("oops"), &out)
+		assert.Equal(t, classifyExitSuccess, code)
+		assert.Equal(t, "sfncli.CommandExitedNonzero\n", out.String())
+	})
+
+	t.Run("uses the rules of a config file and the exit code", func(t *testing.T) {
+		configFile := writeConfigFile(t, "config.yml", `
+exit-code-errors:
+  - codes: 75
+    error: MyTool.TempFailure
+stderr-errors:
+  - pattern: (?i)no space left
+    error: Resource.Disk
+`)
+		stderrFile := path.Join(t.TempDir(), "stderr.txt")
+		require.NoError(t, os.WriteFile(stderrFile, []byte("write: No space left on device"), 0600))
+
+		var out bytes.Buffer
+		assert.Equal(t, classifyExitSuccess, classify([]string{"-config", configFile, stderrFile}, strings.NewReader(""), &out))
+		assert.Equal(t, classifyExitSuccess, classify([]string{"-config", configFile, "-exit-code", "75", stderrFile}, strings.NewReader(""), &out))
+		assert.Equal(t, classifyExitSuccess, classify([]string{"-config", configFile, "-stderr-error", "Other.Error=device", stderrFile}, strings.NewReader(""), &out))
+		assert.Equal(t, "Resource.Disk\nMyTool.TempFailure\nOther.Error\n", out.String())
+	})
+
+	t.Run("rejects invalid usage", func(t *testing.T) {
+		var out bytes.Buffer
+		assert.Equal(t, classifyExitUsage, classify([]string{"-stderr-error", "missing-regexp"}, strings.NewReader(""), &out))
+		assert.Equal(t, classifyExitUsage, classify([]string{"-exit-code", "0"}, strings.NewReader(""), &out))
+		assert.Equal(t, classifyExitUsage, classify([]string{path.Join(t.TempDir(), "missing.txt")}, strings.NewReader(""), &out))
+		assert.Equal(t, classifyExitUsage, classify([]string{"a.txt", "b.txt"}, strings.NewReader(""), &out))
+		assert.Empty(t, out.String())
+	})
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	_ "embed"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sfn/types"
+	"github.com/xeipuuv/gojsonschema"
+	"gopkg.in/yaml.v3"
+)
+
+// configSchema is the JSON schema every config file is validated against before it is used.
+//
+//go:embed config_schema.json
+var configSchema string
+
+// fileConfig is the contents of a config file passed with -config.
+// Options share the names of the flags they stand in for.
+type fileConfig struct {
+	ActivityName            string               `yaml:"activityname"`
+	WorkerName              string               `yaml:"workername"`
+	Cmd                     string               `yaml:"cmd"`
+	HTTPEndpoint            string               `yaml:"http-endpoint"`
+	HTTPTimeout             string               `yaml:"http-timeout"`
+	Args                    []string             `yaml:"args"`
+	Region                  string               `yaml:"region"`
+	CloudWatchRegion        string               `yaml:"cloudwatchregion"`
+	WorkDirectory           string               `yaml:"workdirectory"`
+	SFNEndpoint             string               `yaml:"sfn-endpoint"`
+	CloudWatchEndpoint      string               `yaml:"cloudwatch-endpoint"`
+	S3Endpoint              string               `yaml:"s3-endpoint"`
+	PayloadBucket           string               `yaml:"payload-bucket"`
+	PayloadPrefix           string               `yaml:"payload-prefix"`
+	Concurrency             int                  `yaml:"concurrency"`
+	HeartbeatMode           string               `yaml:"heartbeat-mode"`
+	CommandHeartbeatTimeout string               `yaml:"command-heartbeat-timeout"`
+	DrainTimeout            string               `yaml:"drain-timeout"`
+	PollGracePeriod         string               `yaml:"poll-grace-period"`
+	TaskTimeout             string               `yaml:"task-timeout"`
+	ExitCodeErrors          []fileConfigExitCode `yaml:"exit-code-errors"`
+	StderrErrors            []fileConfigStderr   `yaml:"stderr-errors"`
+	ForwardSignals          []string             `yaml:"forward-signals"`
+	TranslateSignals        map[string]string    `yaml:"translate-signals"`
+	SigtermGracePeriod      string               `yaml:"sigterm-grace-period"`
+	MaxTasks                int                  `yaml:"max-tasks"`
+	RunOnce                 bool                 `yaml:"run-once"`
+	IdleTimeout             string               `yaml:"idle-timeout"`
+	WorkerMode              string               `yaml:"worker-mode"`
+	InputMode               string               `yaml:"input-mode"`
+	OutputMode              string               `yaml:"output-mode"`
+	CauseFormat             string               `yaml:"cause-format"`
+	ErrorEnvelope           bool                 `yaml:"error-envelope"`
+	StdoutBufferSize        int                  `yaml:"stdout-buffer-size"`
+	StderrBufferSize        int                  `yaml:"stderr-buffer-size"`
+	Activities              []fileConfigActivity `yaml:"activities"`
+	Tags                    map[string]string    `yaml:"tags"`
+}
+
+// fileConfigActivity is the config file equivalent of an -activity flag.
+type fileConfigActivity struct {
+	Name      string   `yaml:"name"`
+	Cmd       string   `yaml:"cmd"`
+	Args      []string `yaml:"args"`
+	InputMode string   `yaml:"input-mode"`
+}
+
+// fileConfigExitCode is the config file equivalent of an -exit-code-error flag.
+type fileConfigExitCode struct {
+	Codes string `yaml:"codes"`
+	Error string `yaml:"error"`
+	Cause string `yaml:"cause"`
+}
+
+func (e fileConfigExitCode) String() string {
+	if e.Cause == "" {
+		return fmt.Sprintf("%s=%s", e.Codes, e.Error)
+	}
+	return fmt.Sprintf("%s=%s:%s", e.Codes, e.Error, e.Cause)
+}
+
+// fileConfigStderr is the config file equivalent of a -stderr-error flag.
+type fileConfigStderr struct {
+	Pattern string `yaml:"pattern"`
+	Error   string `yaml:"error"`
+}
+
+func (e fileConfigStderr) String() string {
+	return fmt.Sprintf("%s=%s", e.Error, e.Pattern)
+}
+
+// loadConfigFile reads a YAML or JSON config file, validates it against configSchema
+// and expands $VAR and ${VAR} environment variables in every string value.
+func loadConfigFile(path string) (fileConfig, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return fileConfig{}, fmt.Errorf("error reading config file: %s", err)
+	}
+
+	// JSON is a subset of YAML, so the YAML decoder handles both formats
+	var doc interface{}
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return fileConfig{}, fmt.Errorf("error parsing config file %s: %s", path, err)
+	}
+	result, err := gojsonschema.Validate(gojsonschema.NewStringLoader(configSchema), gojsonschema.NewGoLoader(doc))
+	if err != nil {
+		return fileConfig{}, fmt.Errorf("error validating config file %s: %s", path, err)
+	}
+	if !result.Valid() {
+		problems := []string{}
+		for _, resultErr := range result.Errors() {
+			problems = append(problems, resultErr.String())
+		}
+		return fileConfig{}, fmt.Errorf("invalid config file %s:\n  - %s", path, strings.Join(problems, "\n  - "))
+	}
+
+	var c fileConfig
+	if err := yaml.Unmarshal(b, &c); err != nil {
+		return fileConfig{}, fmt.Errorf("error parsing config file %s: %s", path, err)
+	}
+	c.expandEnv()
+	return c, nil
+}
+
+func (c *fileConfig) expandEnv() {
+	c.ActivityName = os.ExpandEnv(c.ActivityName)
+	c.WorkerName = os.ExpandEnv(c.WorkerName)
+	c.Cmd = os.ExpandEnv(c.Cmd)
+	c.HTTPEndpoint = os.ExpandEnv(c.HTTPEndpoint)
+	c.Region = os.ExpandEnv(c.Region)
+	c.CloudWatchRegion = os.ExpandEnv(c.CloudWatchRegion)
+	c.WorkDirectory = os.ExpandEnv(c.WorkDirectory)
+	c.SFNEndpoint = os.ExpandEnv(c.SFNEndpoint)
+	c.CloudWatchEndpoint = os.ExpandEnv(c.CloudWatchEndpoint)
+	c.S3Endpoint = os.ExpandEnv(c.S3Endpoint)
+	c.PayloadBucket = os.ExpandEnv(c.PayloadBucket)
+	c.PayloadPrefix = os.ExpandEnv(c.PayloadPrefix)
+	for i := range c.Args {
+		c.Args[i] = os.ExpandEnv(c.Args[i])
+	}
+	for i := range c.Activities {
+		c.Activities[i].Name = os.ExpandEnv(c.Activities[i].Name)
+		c.Activities[i].Cmd = os.ExpandEnv(c.Activities[i].Cmd)
+		for j := range c.Activities[i].Args {
+			c.Activities[i].Args[j] = os.ExpandEnv(c.Activities[i].Args[j])
+		}
+	}
+	for key, value := range c.Tags {
+		c.Tags[key] = os.ExpandEnv(value)
+	}
+}
+
+// apply sets every flag that was not passed on the command line to its value from the
+// config file, so command line flags override the file. The activities in the file are added
+// to bindings, unless activities were chosen on the command line with -activity or -activityname.
+func (c fileConfig) apply(fs *flag.FlagSet, bindings *activityBindings) error {
+	setOnCommandLine := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { setOnCommandLine[f.Name] = true })
+
+	if !setOnCommandLine["activity"] && !setOnCommandLine["activityname"] && !setOnCommandLine["cmd"] && !setOnCommandLine["http-endpoint"] {
+		for _, activity := range c.Activities {
+			args := activity.Args
+			if args == nil {
+				args = []string{}
+			}
+			if err := bindings.add(activityBinding{name: activity.Name, cmd: activity.Cmd, cmdArgs: args, inputMode: activity.InputMode}); err != nil {
+				return err
+			}
+		}
+	}
+
+	if !setOnCommandLine["exit-code-error"] {
+		for _, exitCode := range c.ExitCodeErrors {
+			if err := fs.Set("exit-code-error", exitCode.String()); err != nil {
+				return fmt.Errorf("invalid config value for exit-code-errors: %s", err)
+			}
+		}
+	}
+
+	if !setOnCommandLine["stderr-error"] {
+		for _, stderrError := range c.StderrErrors {
+			if err := fs.Set("stderr-error", stderrError.String()); err != nil {
+				return fmt.Errorf("invalid config value for stderr-errors: %s", err)
+			}
+		}
+	}
+
+	values := map[string]string{
+		"activityname":              c.ActivityName,
+		"workername":                c.WorkerName,
+		"cmd":                       c.Cmd,
+		"http-endpoint":             c.HTTPEndpoint,
+		"http-timeout":              c.HTTPTimeout,
+		"region":                    c.Region,
+		"cloudwatchregion":          c.CloudWatchRegion,
+		"workdirectory":             c.WorkDirectory,
+		"sfn-endpoint":              c.SFNEndpoint,
+		"cloudwatch-endpoint":       c.CloudWatchEndpoint,
+		"s3-endpoint":               c.S3Endpoint,
+		"payload-bucket":            c.PayloadBucket,
+		"payload-prefix":            c.PayloadPrefix,
+		"heartbeat-mode":            c.HeartbeatMode,
+		"command-heartbeat-timeout": c.CommandHeartbeatTimeout,
+		"drain-timeout":             c.DrainTimeout,
+		"poll-grace-period":         c.PollGracePeriod,
+		"task-timeout":              c.TaskTimeout,
+		"sigterm-grace-period":      c.SigtermGracePeriod,
+		"idle-timeout":              c.IdleTimeout,
+		"worker-mode":               c.WorkerMode,
+		"input-mode":                c.InputMode,
+		"output-mode":               c.OutputMode,
+		"cause-format":              c.CauseFormat,
+	}
+	if c.Concurrency != 0 {
+		values["concurrency"] = strconv.Itoa(c.Concurrency)
+	}
+	if c.ForwardSignals != nil {
+		values["forward-signals"] = strings.Join(c.ForwardSignals, ",")
+	}
+	if len(c.TranslateSignals) > 0 {
+		translations := []string{}
+		for from, to := range c.TranslateSignals {
+			translations = append(translations, from+"="+to)
+		}
+		sort.Strings(translations)
+		values["translate-signals"] = strings.Join(translations, ",")
+	}
+	if c.MaxTasks != 0 {
+		values["max-tasks"] = strconv.Itoa(c.MaxTasks)
+	}
+	if c.RunOnce {
+		values["run-once"] = "true"
+	}
+	if c.ErrorEnvelope {
+		values["error-envelope"] = "true"
+	}
+	if c.StdoutBufferSize != 0 {
+		values["stdout-buffer-size"] = strconv.Itoa(c.StdoutBufferSize)
+	}
+	if c.StderrBufferSize != 0 {
+		values["stderr-buffer-size"] = strconv.Itoa(c.StderrBufferSize)
+	}
+	for name, value := range values {
+		if value == "" || setOnCommandLine[name] {
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("invalid config value for %s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// mergeTags adds the tags from the config file to tags, replacing tags with the same key.
+func (c fileConfig) mergeTags(tags []types.Tag) []types.Tag {
+	keys := []string{}
+	for key := range c.Tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	merged := []types.Tag{}
+	for _, tag := range tags {
+		if _, ok := c.Tags[*tag.Key]; !ok {
+			merged = append(merged, tag)
+		}
+	}
+	for _, key := range keys {
+		merged = append(merged, types.Tag{Key: aws.String(key), Value: aws.String(c.Tags[key])})
+	}
+	return merged
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sfn/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeConfigFile(t *testing.T, name, contents string) string {
+	filename := path.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(filename, []byte(contents), 0600))
+	return filename
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	os.Setenv("SFNCLI_TEST_ENV", "dev")
+	defer os.Unsetenv("SFNCLI_TEST_ENV")
+
+	t.Run("loads YAML and expands env vars", func(t *testing.T) {
+		filename := writeConfigFile(t, "config.yml", `
+activityname: ${SFNCLI_TEST_ENV}--echo
+workername: worker
+cmd: echo
+args: ["--env", "$SFNCLI_TEST_ENV"]
+region: us-west-2
+concurrency: 2
+tags:
+  team: eng-$SFNCLI_TEST_ENV
+`)
+		c, err := loadConfigFile(filename)
+		require.NoError(t, err)
+		assert.Equal(t, fileConfig{
+			ActivityName: "dev--echo",
+			WorkerName:   "worker",
+			Cmd:          "echo",
+			Args:         []string{"--env", "dev"},
+			Region:       "us-west-2",
+			Concurrency:  2,
+			Tags:         map[string]string{"team": "eng-dev"},
+		}, c)
+	})
+
+	t.Run("loads JSON", func(t *testing.T) {
+		filename := writeConfigFile(t, "config.json", `{
+			"workername": "worker",
+			"activities": [
+				{"name": "echo", "cmd": "echo", "args": ["hi"]},
+				{"name": "cat", "cmd": "cat", "input-mode": "stdin"}
+			]
+		}`)
+		c, err := loadConfigFile(filename)
+		require.NoError(t, err)
+		assert.Equal(t, []fileConfigActivity{
+			{Name: "echo", Cmd: "echo", Args: []string{"hi"}},
+			{Name: "cat", Cmd: "cat", InputMode: "stdin"},
+		}, c.Activities)
+	})
+
+	t.Run("loads exit code errors", func(t *testing.T) {
+		filename := writeConfigFile(t, "config.yml", `
+exit-code-errors:
+  - codes: 75
+    error: MyTool.TempFailure
+  - codes: 64-78
+    error: MyTool.Failed
+    cause: "exited {{.ExitCode}}: {{.Stderr}}"
+`)
+		c, err := loadConfigFile(filename)
+		require.NoError(t, err)
+		assert.Equal(t, []fileConfigExitCode{
+			{Codes: "75", Error: "MyTool.TempFailure"},
+			{Codes: "64-78", Error: "MyTool.Failed", Cause: "exited {{.ExitCode}}: {{.Stderr}}"},
+		}, c.ExitCodeErrors)
+
+		filename = writeConfigFile(t, "config.yml", `
+exit-code-errors:
+  - codes: 64to78
+`)
+		_, err = loadConfigFile(filename)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "codes")
+		assert.Contains(t, err.Error(), "error is required")
+	})
+
+	t.Run("loads stderr errors", func(t *testing.T) {
+		filename := writeConfigFile(t, "config.yml", `
+stderr-errors:
+  - pattern: connection reset by peer|Throttling
+    error: Transient.Network
+  - pattern: (?i)no space left on device
+    error: Resource.Disk
+`)
+		c, err := loadConfigFile(filename)
+		require.NoError(t, err)
+		assert.Equal(t, []fileConfigStderr{
+			{Pattern: "connection reset by peer|Throttling", Error: "Transient.Network"},
+			{Pattern: "(?i)no space left on device", Error: "Resource.Disk"},
+		}, c.StderrErrors)
+	})
+
+	t.Run("reports every schema violation", func(t *testing.T) {
+		filename := writeConfigFile(t, "config.yml", `
+activitynam: typo
+concurrency: "2"
+activities:
+  - name: missing-cmd
+    input-mode: env
+`)
+		_, err := loadConfigFile(filename)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "activitynam")
+		assert.Contains(t, err.Error(), "concurrency")
+		assert.Contains(t, err.Error(), "cmd is required")
+		assert.Contains(t, err.Error(), "input-mode")
+	})
+
+	t.Run("rejects signals that cannot be caught", func(t *testing.T) {
+		filename := writeConfigFile(t, "config.yml", `
+forward-signals: [hup, SIGUSR1, KILL]
+translate-signals:
+  STOP: TERM
+  int: KILL
+`)
+		_, err := loadConfigFile(filename)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "forward-signals.2")
+		assert.Contains(t, err.Error(), "STOP")
+		assert.NotContains(t, err.Error(), "forward-signals.0")
+		assert.NotContains(t, err.Error(), "forward-signals.1")
+	})
+
+	t.Run("fails on a missing file", func(t *testing.T) {
+		_, err := loadConfigFile(path.Join(t.TempDir(), "missing.yml"))
+		assert.Error(t, err)
+	})
+}
+
+func TestFileConfigApply(t *testing.T) {
+	newFlagSet := func() (*flag.FlagSet, *string, *string, *int) {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		activityName := fs.String("activityname", "", "")
+		fs.String("workername", "", "")
+		cmd := fs.String("cmd", "", "")
+		fs.String("region", "", "")
+		fs.String("cloudwatchregion", "", "")
+		fs.String("workdirectory", "", "")
+		concurrency := fs.Int("concurrency", 1, "")
+		return fs, activityName, cmd, concurrency
+	}
+
+	t.Run("command line flags override the file", func(t *testing.T) {
+		fs, activityName, cmd, concurrency := newFlagSet()
+		require.NoError(t, fs.Parse([]string{"-cmd", "cat"}))
+		var bindings activityBindings
+		c := fileConfig{ActivityName: "from-file", Cmd: "echo", Concurrency: 3}
+		require.NoError(t, c.apply(fs, &bindings))
+		assert.Equal(t, "from-file", *activityName)
+		assert.Equal(t, "cat", *cmd)
+		assert.Equal(t, 3, *concurrency)
+		assert.Empty(t, bindings)
+	})
+
+	t.Run("activities in the file are used unless chosen on the command line", func(t *testing.T) {
+		c := fileConfig{Activities: []fileConfigActivity{{Name: "echo", Cmd: "echo"}, {Name: "cat", Cmd: "cat", InputMode: "stdin"}}}
+
+		fs, _, _, _ := newFlagSet()
+		require.NoError(t, fs.Parse([]string{}))
+		var bindings activityBindings
+		require.NoError(t, c.apply(fs, &bindings))
+		assert.Equal(t, activityBindings{
+			{name: "echo", cmd: "echo", cmdArgs: []string{}},
+			{name: "cat", cmd: "cat", cmdArgs: []string{}, inputMode: "stdin"},
+		}, bindings)
+
+		fs, _, _, _ = newFlagSet()
+		require.NoError(t, fs.Parse([]string{"-activityname", "cli"}))
+		bindings = activityBindings{}
+		require.NoError(t, c.apply(fs, &bindings))
+		assert.Empty(t, bindings)
+	})
+
+	t.Run("stderr errors in the file are used unless given on the command line", func(t *testing.T) {
+		c := fileConfig{StderrErrors: []fileConfigStderr{{Pattern: "a=b", Error: "Test.Error"}}}
+
+		fs, _, _, _ := newFlagSet()
+		var rules stderrErrors
+		fs.Var(&rules, "stderr-error", "")
+		require.NoError(t, fs.Parse([]string{}))
+		require.NoError(t, c.apply(fs, &activityBindings{}))
+		assert.Equal(t, "Test.Error=a=b", rules.String())
+
+		fs, _, _, _ = newFlagSet()
+		rules = stderrErrors{}
+		fs.Var(&rules, "stderr-error", "")
+		require.NoError(t, fs.Parse([]string{"-stderr-error", "Cli.Error=cli"}))
+		require.NoError(t, c.apply(fs, &activityBindings{}))
+		assert.Equal(t, "Cli.Error=cli", rules.String())
+	})
+
+	t.Run("exit code errors in the file are used unless given on the command line", func(t *testing.T) {
+		c := fileConfig{ExitCodeErrors: []fileConfigExitCode{
+			{Codes: "75", Error: "MyTool.TempFailure"},
+			{Codes: "64-78", Error: "MyTool.Failed", Cause: "exited {{.ExitCode}}"},
+		}}
+
+		fs, _, _, _ := newFlagSet()
+		var rules exitCodeErrors
+		fs.Var(&rules, "exit-code-error", "")
+		require.NoError(t, fs.Parse([]string{}))
+		require.NoError(t, c.apply(fs, &activityBindings{}))
+		assert.Equal(t, "75=MyTool.TempFailure, 64-78=MyTool.Failed:exited {{.ExitCode}}", rules.String())
+
+		fs, _, _, _ = newFlagSet()
+		rules = exitCodeErrors{}
+		fs.Var(&rules, "exit-code-error", "")
+		require.NoError(t, fs.Parse([]string{"-exit-code-error", "2=MyTool.BadInput"}))
+		require.NoError(t, c.apply(fs, &activityBindings{}))
+		assert.Equal(t, "2=MyTool.BadInput", rules.String())
+	})
+}
+
+func TestFileConfigMergeTags(t *testing.T) {
+	c := fileConfig{Tags: map[string]string{"team": "eng", "cost-center": "42"}}
+	tags := c.mergeTags([]types.Tag{
+		{Key: aws.String("environment"), Value: aws.String("production")},
+		{Key: aws.String("team"), Value: aws.String("from-env")},
+	})
+	assert.Equal(t, []types.Tag{
+		{Key: aws.String("environment"), Value: aws.String("production")},
+		{Key: aws.String("cost-center"), Value: aws.String("42")},
+		{Key: aws.String("team"), Value: aws.String("eng")},
+	}, tags)
+}
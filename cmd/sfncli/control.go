@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/Clever/kayvee-go/v7/logger"
+)
+
+// controlSocketEnvVar is the env var that holds the path of the control socket of a task.
+const controlSocketEnvVar = "SFNCLI_CONTROL_SOCKET"
+
+// controlMessage is a message a command sends on its control socket, one JSON object per line:
+//
+//	{"type": "heartbeat"}
+//	{"type": "progress", "message": "processed 100 of 300 files"}
+type controlMessage struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+const (
+	controlMessageHeartbeat = "heartbeat"
+	controlMessageProgress  = "progress"
+)
+
+// checkins records when a command last checked in on its control socket.
+type checkins struct {
+	mu   sync.Mutex
+	last time.Time
+}
+
+func (c *checkins) record() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.last = time.Now()
+}
+
+// lastCheckin returns when the command last checked in. It is the zero time if it never did.
+func (c *checkins) lastCheckin() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.last
+}
+
+// controlSocket is a unix domain socket a command can use to talk to sfncli while processing a task.
+type controlSocket struct {
+	dir      string
+	path     string
+	listener net.Listener
+	checkins *checkins
+	logger   logger.KayveeLogger
+}
+
+// newControlSocket listens on a socket in a new temporary directory.
+// A directory outside of WORK_DIR is used since socket paths are limited to ~100 characters.
+func newControlSocket(checkins *checkins, logger logger.KayveeLogger) (*controlSocket, error) {
+	dir, err := os.MkdirTemp("", "sfncli-control-")
+	if err != nil {
+		return nil, err
+	}
+	socketPath := path.Join(dir, "control.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	c := &controlSocket{
+		dir:      dir,
+		path:     socketPath,
+		listener: listener,
+		checkins: checkins,
+		logger:   logger,
+	}
+	go c.serve()
+	return c, nil
+}
+
+func (c *controlSocket) serve() {
+	for {
+		conn, err := c.listener.Accept()
+		if err != nil {
+			return // the listener was closed
+		}
+		go c.handle(conn)
+	}
+}
+
+func (c *controlSocket) handle(conn net.Conn) {
+	defer conn.Close()
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		var msg controlMessage
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			c.logger.WarnD("control-message-invalid", logger.M{"message": scanner.Text(), "error": err.Error()})
+			continue
+		}
+		switch msg.Type {
+		case controlMessageHeartbeat:
+			c.checkins.record()
+			c.logger.Trace("control-heartbeat")
+		case controlMessageProgress:
+			c.checkins.record()
+			c.logger.InfoD("task-progress", logger.M{"message": msg.Message})
+		default:
+			c.logger.WarnD("control-message-unknown", logger.M{"type": msg.Type})
+		}
+	}
+}
+
+// Close stops listening and removes the socket.
+func (c *controlSocket) Close() {
+	c.listener.Close()
+	os.RemoveAll(c.dir)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Clever/kayvee-go/v7/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestControlSocket(t *testing.T) {
+	c := &checkins{}
+	control, err := newControlSocket(c, logger.New("sfncli"))
+	require.NoError(t, err)
+	assert.True(t, c.lastCheckin().IsZero())
+
+	t.Run("heartbeats and progress count as check ins", func(t *testing.T) {
+		for _, msg := range []string{`{"type": "heartbeat"}`, `{"type": "progress", "message": "halfway"}`} {
+			before := time.Now()
+			conn, err := net.Dial("unix", control.path)
+			require.NoError(t, err)
+			_, err = conn.Write([]byte(msg + "\n"))
+			require.NoError(t, err)
+			conn.Close()
+			require.Eventually(t, func() bool { return c.lastCheckin().After(before) }, time.Second, 10*time.Millisecond)
+		}
+	})
+
+	t.Run("other messages do not count as check ins", func(t *testing.T) {
+		before := time.Now()
+		conn, err := net.Dial("unix", control.path)
+		require.NoError(t, err)
+		_, err = conn.Write([]byte("not json\n{\"type\": \"unknown\"}\n"))
+		require.NoError(t, err)
+		conn.Close()
+		time.Sleep(100 * time.Millisecond)
+		assert.True(t, c.lastCheckin().Before(before))
+	})
+
+	t.Run("close removes the socket", func(t *testing.T) {
+		control.Close()
+		_, err := os.Stat(control.path)
+		assert.True(t, os.IsNotExist(err))
+	})
+}
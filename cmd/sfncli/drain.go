@@ -0,0 +1,70 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Clever/kayvee-go/v7/logger"
+	"github.com/Clever/sfncli/worker"
+)
+
+// drainer drains sfncli when it is asked to stop: on the first signal the workers stop polling for
+// tasks, and the tasks in progress have until the drain timeout to finish. After the timeout, or on a
+// second signal, terminate is closed and the tasks still in progress are terminated like on SIGTERM,
+// and the polls still in flight are canceled.
+type drainer struct {
+	timeout time.Duration
+	// terminate is closed when the tasks in progress should be terminated
+	terminate chan struct{}
+
+	mu            sync.Mutex
+	workers       []*worker.Worker
+	draining      bool
+	terminateOnce sync.Once
+}
+
+func newDrainer(timeout time.Duration) *drainer {
+	return &drainer{timeout: timeout, terminate: make(chan struct{})}
+}
+
+// add drains a worker along with the others, right away if a drain already started.
+func (d *drainer) add(w *worker.Worker) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.workers = append(d.workers, w)
+	if d.draining {
+		w.Drain()
+	}
+}
+
+// signal starts the drain on the first call, and terminates the tasks in progress on the next one.
+func (d *drainer) signal() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.draining {
+		log.Info("drain-forced")
+		d.terminateTasks()
+		return
+	}
+	d.draining = true
+	log.InfoD("drain-start", logger.M{"timeout": d.timeout.String()})
+	for _, w := range d.workers {
+		w.Drain()
+	}
+	time.AfterFunc(d.timeout, func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		log.Info("drain-timeout")
+		d.terminateTasks()
+	})
+}
+
+// terminateTasks must be called with mu held.
+func (d *drainer) terminateTasks() {
+	d.terminateOnce.Do(func() {
+		close(d.terminate)
+		for _, w := range d.workers {
+			w.CancelPolls()
+		}
+	})
+}
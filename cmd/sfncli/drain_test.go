@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/Clever/sfncli/mocks"
+	"github.com/Clever/sfncli/worker"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDrainer(t *testing.T) {
+	newWorker := func(t *testing.T) *worker.Worker {
+		controller := gomock.NewController(t)
+		w, err := worker.New(worker.Config{
+			ActivityName: "activity",
+			WorkerName:   "worker",
+			SFN:          mocks.NewMockWorkerSFNAPI(controller),
+			Handler: worker.HandlerFunc(func(ctx context.Context, input json.RawMessage) (json.RawMessage, error) {
+				return nil, nil
+			}),
+		})
+		require.NoError(t, err)
+		return w
+	}
+	terminated := func(d *drainer) bool {
+		select {
+		case <-d.terminate:
+			return true
+		default:
+			return false
+		}
+	}
+
+	t.Run("second signal terminates tasks right away", func(t *testing.T) {
+		d := newDrainer(time.Hour)
+		d.add(newWorker(t))
+		d.signal()
+		assert.False(t, terminated(d))
+		d.signal()
+		assert.True(t, terminated(d))
+		// more signals are ok
+		d.signal()
+	})
+
+	t.Run("tasks are terminated after the timeout", func(t *testing.T) {
+		d := newDrainer(50 * time.Millisecond)
+		d.add(newWorker(t))
+		d.signal()
+		assert.False(t, terminated(d))
+		assert.Eventually(t, func() bool { return terminated(d) }, time.Second, 10*time.Millisecond)
+	})
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// errorEnvelopeField is the reserved field of the task output that fails the task in the error
+// envelope protocol, whatever the exit code of the command:
+//
+//	{"_sfncli_error": {"error": "custom.error_name", "cause": "..."}, "uploaded": 3}
+//
+// The other fields of the output are a partial result, which is added to the cause of the failure
+// so that a Catch state can pick up where the task left off.
+const errorEnvelopeField = "_sfncli_error"
+
+// errorEnvelope is the value of errorEnvelopeField.
+type errorEnvelope struct {
+	Error string `json:"error"`
+	Cause string `json:"cause"`
+}
+
+// envelopeCause is the cause of a failure reported with a partial result.
+type envelopeCause struct {
+	Cause                 string                 `json:"cause"`
+	PartialResult         map[string]interface{} `json:"partial_result,omitempty"`
+	PartialResultTooLarge bool                   `json:"partial_result_too_large,omitempty"`
+}
+
+// parseErrorEnvelope returns the failure a task output reports with errorEnvelopeField, if it has one.
+func parseErrorEnvelope(output map[string]interface{}) (TaskFailureError, bool) {
+	value, ok := output[errorEnvelopeField]
+	if !ok {
+		return nil, false
+	}
+	b, _ := json.Marshal(value)
+	var envelope errorEnvelope
+	if err := json.Unmarshal(b, &envelope); err != nil || envelope.Error == "" {
+		return TaskFailureUnknown{fmt.Errorf(`%s must be an object like {"error": "custom.error_name", "cause": "..."}, got %s`, errorEnvelopeField, b)}, true
+	}
+
+	partialResult := map[string]interface{}{}
+	for key, value := range output {
+		if key != errorEnvelopeField && key != "_EXECUTION_NAME" {
+			partialResult[key] = value
+		}
+	}
+	if len(partialResult) == 0 {
+		return TaskFailureCustom{Err: envelope.Error, Cause: envelope.Cause}, true
+	}
+
+	cause, _ := json.Marshal(envelopeCause{Cause: envelope.Cause, PartialResult: partialResult})
+	if len(cause) > maxTaskFailureCauseLength {
+		// truncating the partial result would make it invalid JSON
+		cause, _ = json.Marshal(envelopeCause{Cause: envelope.Cause, PartialResultTooLarge: true})
+	}
+	return TaskFailureCustom{Err: envelope.Error, Cause: string(cause)}, true
+}
+
+// shortenEnvelopeCause shortens a cause made by parseErrorEnvelope by at least n bytes, keeping it valid
+// JSON: the partial result is dropped first, then the end of the cause in the envelope. ok is false if
+// cause is not an envelopeCause with a partial result, or cannot be shortened.
+func shortenEnvelopeCause(cause string, n int) (string, bool) {
+	var envelope envelopeCause
+	if err := json.Unmarshal([]byte(cause), &envelope); err != nil || (envelope.PartialResult == nil && !envelope.PartialResultTooLarge) {
+		return "", false
+	}
+	if envelope.PartialResult != nil {
+		envelope.PartialResult = nil
+		envelope.PartialResultTooLarge = true
+	} else if envelope.Cause != "" {
+		envelope.Cause = dropSuffix(envelope.Cause, n)
+	} else {
+		return "", false
+	}
+	b, _ := json.Marshal(envelope)
+	return string(b), true
+}
+
+// parseCustomErrorEnvelope is parseErrorEnvelope for the output of a command that exited nonzero,
+// which may not be JSON. Only a valid envelope is returned, like for parseCustomError.
+func parseCustomErrorEnvelope(taskOutput string) (TaskFailureCustom, bool) {
+	var output map[string]interface{}
+	if err := json.Unmarshal([]byte(taskOutput), &output); err != nil {
+		return TaskFailureCustom{}, false
+	}
+	failure, ok := parseErrorEnvelope(output)
+	customError, isCustom := failure.(TaskFailureCustom)
+	return customError, ok && isCustom
+}
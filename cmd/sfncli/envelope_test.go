@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseErrorEnvelope(t *testing.T) {
+	parse := func(t *testing.T, output string) (TaskFailureError, bool) {
+		var outputMap map[string]interface{}
+		require.NoError(t, json.Unmarshal([]byte(output), &outputMap))
+		return parseErrorEnvelope(outputMap)
+	}
+
+	t.Run("outputs without the envelope field are not failures", func(t *testing.T) {
+		_, ok := parse(t, `{"error": "custom.error_name", "cause": "bar"}`)
+		assert.False(t, ok)
+	})
+
+	t.Run("reports the error and cause", func(t *testing.T) {
+		failure, ok := parse(t, `{"_sfncli_error": {"error": "custom.error_name", "cause": "bar"}, "_EXECUTION_NAME": "en"}`)
+		assert.True(t, ok)
+		assert.Equal(t, TaskFailureCustom{Err: "custom.error_name", Cause: "bar"}, failure)
+	})
+
+	t.Run("adds the other fields to the cause as a partial result", func(t *testing.T) {
+		failure, ok := parse(t, `{"_sfncli_error": {"error": "custom.error_name", "cause": "3 of 10 uploaded"}, "uploaded": ["a", "b", "c"]}`)
+		assert.True(t, ok)
+		assert.Equal(t, TaskFailureCustom{
+			Err:   "custom.error_name",
+			Cause: `{"cause":"3 of 10 uploaded","partial_result":{"uploaded":["a","b","c"]}}`,
+		}, failure)
+	})
+
+	t.Run("leaves out partial results that are too large", func(t *testing.T) {
+		failure, ok := parse(t, `{"_sfncli_error": {"error": "custom.error_name", "cause": "bar"}, "log": "`+strings.Repeat("x", maxTaskFailureCauseLength)+`"}`)
+		assert.True(t, ok)
+		assert.Equal(t, TaskFailureCustom{Err: "custom.error_name", Cause: `{"cause":"bar","partial_result_too_large":true}`}, failure)
+	})
+
+	t.Run("an invalid envelope is an unknown failure", func(t *testing.T) {
+		for _, output := range []string{`{"_sfncli_error": "custom.error_name"}`, `{"_sfncli_error": {"cause": "bar"}}`, `{"_sfncli_error": null}`} {
+			failure, ok := parse(t, output)
+			assert.True(t, ok, output)
+			assert.IsType(t, TaskFailureUnknown{}, failure, output)
+		}
+	})
+}
@@ -2,10 +2,14 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/Clever/kayvee-go/v7/logger"
+	"github.com/Clever/sfncli/worker"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/sfn"
 )
@@ -17,15 +21,13 @@ import (
 // These errors are described in this file.
 
 // TaskFailureError is the error reported when failing an activity task.
-type TaskFailureError interface {
-	ErrorName() string
-	ErrorCause() string
-
-	error
-}
+type TaskFailureError = worker.TaskFailureError
 
 // sendTaskFailure handles sending AWS `SendTaskFailure`.
-func (t TaskRunner) sendTaskFailure(err TaskFailureError) error {
+func (t *TaskRunner) sendTaskFailure(err TaskFailureError) error {
+	if t.causeFormat == causeFormatJSON {
+		err = t.structuredFailure(err)
+	}
 	t.logger.ErrorD("send-task-failure", logger.M{"name": err.ErrorName(), "cause": err.ErrorCause()})
 
 	// Limits from https://docs.aws.amazon.com/step-functions/latest/apireference/API_SendTaskFailure.html
@@ -92,6 +94,26 @@ func (t TaskFailureTaskInputMissingExecutionName) ErrorCause() string {
 }
 func (t TaskFailureTaskInputMissingExecutionName) Error() string { return t.ErrorCause() }
 
+// TaskFailureTaskInputPayloadUnavailable is used when the input to the task is a payload pointer that can't be resolved.
+type TaskFailureTaskInputPayloadUnavailable struct {
+	error
+}
+
+func (t TaskFailureTaskInputPayloadUnavailable) ErrorName() string {
+	return "sfncli.TaskInputPayloadUnavailable"
+}
+func (t TaskFailureTaskInputPayloadUnavailable) ErrorCause() string { return t.Error() }
+
+// TaskFailureTaskInputInvalidTimeout is used when the task input overrides the task timeout with an invalid value.
+type TaskFailureTaskInputInvalidTimeout struct {
+	error
+}
+
+func (t TaskFailureTaskInputInvalidTimeout) ErrorName() string {
+	return "sfncli.TaskInputInvalidTimeout"
+}
+func (t TaskFailureTaskInputInvalidTimeout) ErrorCause() string { return t.Error() }
+
 // TaskFailureCommandNotFound is used when the command passed to sfncli is not found.
 type TaskFailureCommandNotFound struct {
 	path string
@@ -103,6 +125,22 @@ func (t TaskFailureCommandNotFound) ErrorCause() string {
 }
 func (t TaskFailureCommandNotFound) Error() string { return t.ErrorCause() }
 
+// TaskFailureCommandStartFailed is used when the command exists but cannot be started, e.g. because it
+// is not executable or its arguments are too long.
+type TaskFailureCommandStartFailed struct {
+	path string
+	err  error
+}
+
+func (t TaskFailureCommandStartFailed) ErrorName() string { return "sfncli.CommandStartFailed" }
+func (t TaskFailureCommandStartFailed) ErrorCause() string {
+	if errors.Is(t.err, syscall.E2BIG) {
+		return fmt.Sprintf("failed to start command '%s': %s. Use input-mode stdin or file for large inputs", t.path, t.err)
+	}
+	return fmt.Sprintf("failed to start command '%s': %s", t.path, t.err)
+}
+func (t TaskFailureCommandStartFailed) Error() string { return t.ErrorCause() }
+
 // TaskFailureCommandKilled happens when the command is sent a kill signal by the OS.
 type TaskFailureCommandKilled struct {
 	stderr string
@@ -114,6 +152,29 @@ func (t TaskFailureCommandKilled) Error() string {
 	return fmt.Sprintf("%s: %s", t.ErrorName(), t.ErrorCause())
 }
 
+// TaskFailureCommandOOMKilled happens when the kernel kills the command for using more memory than
+// the limit of its cgroup, e.g. its container. limit and peakRSS are in bytes, zero if unknown.
+type TaskFailureCommandOOMKilled struct {
+	limit   int64
+	peakRSS int64
+	stderr  string
+}
+
+func (t TaskFailureCommandOOMKilled) ErrorName() string { return "sfncli.CommandOOMKilled" }
+func (t TaskFailureCommandOOMKilled) ErrorCause() string {
+	return fmt.Sprintf("command was killed for running out of memory (limit %s, peak RSS %s): %s", formatMemory(t.limit), formatMemory(t.peakRSS), t.stderr)
+}
+func (t TaskFailureCommandOOMKilled) Error() string {
+	return fmt.Sprintf("%s: %s", t.ErrorName(), t.ErrorCause())
+}
+
+func formatMemory(bytes int64) string {
+	if bytes <= 0 {
+		return "unknown"
+	}
+	return fmt.Sprintf("%d bytes", bytes)
+}
+
 // TaskFailureCommandKilled happens when the command exits with a nonzero exit code and doesn't specifiy its own error name in the output.
 type TaskFailureCommandExitedNonzero struct {
 	stderr string
@@ -126,24 +187,40 @@ func (t TaskFailureCommandExitedNonzero) Error() string {
 }
 
 // TaskFailureCustom happens when the command exits with a nonzero exit code and outputs a custom error name to stdout.
-type TaskFailureCustom struct {
-	Err   string `json:"error"`
-	Cause string `json:"cause"`
+type TaskFailureCustom = worker.TaskFailureCustom
+
+// TaskFailureTaskOutputTooLarge is used when the output of the task is larger than the stdout buffer
+// or the payload size Step Functions accepts.
+type TaskFailureTaskOutputTooLarge struct {
+	size  int
+	limit int
 }
 
-func (t TaskFailureCustom) ErrorName() string  { return t.Err }
-func (t TaskFailureCustom) ErrorCause() string { return t.Cause }
-func (t TaskFailureCustom) Error() string {
-	return fmt.Sprintf("%s: %s", t.ErrorName(), t.ErrorCause())
+func (t TaskFailureTaskOutputTooLarge) ErrorName() string { return "sfncli.TaskOutputTooLarge" }
+func (t TaskFailureTaskOutputTooLarge) ErrorCause() string {
+	return fmt.Sprintf("task output is %d bytes, larger than the limit of %d bytes", t.size, t.limit)
+}
+func (t TaskFailureTaskOutputTooLarge) Error() string { return t.ErrorCause() }
+
+// TaskFailureTaskOutputUploadFailed is used when an output too large for Step Functions can't be offloaded to S3.
+type TaskFailureTaskOutputUploadFailed struct {
+	error
 }
 
+func (t TaskFailureTaskOutputUploadFailed) ErrorName() string  { return "sfncli.TaskOutputUploadFailed" }
+func (t TaskFailureTaskOutputUploadFailed) ErrorCause() string { return t.Error() }
+
 // TaskFailureTaskOutputNotJSON is used when the output of the task is not a JSON object.
 type TaskFailureTaskOutputNotJSON struct {
-	output string
+	output   string
+	fromFile bool
 }
 
 func (t TaskFailureTaskOutputNotJSON) ErrorName() string { return "sfncli.TaskOutputNotJSON" }
 func (t TaskFailureTaskOutputNotJSON) ErrorCause() string {
+	if t.fromFile {
+		return fmt.Sprintf("output file not valid JSON: '%s'", t.output)
+	}
 	return fmt.Sprintf("stdout not valid JSON: '%s'", t.output)
 }
 func (t TaskFailureTaskOutputNotJSON) Error() string { return t.ErrorCause() }
@@ -158,3 +235,80 @@ func (t TaskFailureCommandTerminated) ErrorCause() string { return t.stderr }
 func (t TaskFailureCommandTerminated) Error() string {
 	return fmt.Sprintf("%s: %s", t.ErrorName(), t.ErrorCause())
 }
+
+// TaskFailureCommandStalled happens when the command stops sending heartbeats on its control socket in command-heartbeat mode.
+type TaskFailureCommandStalled struct {
+	timeout time.Duration
+	stderr  string
+}
+
+func (t TaskFailureCommandStalled) ErrorName() string { return "sfncli.CommandStalled" }
+func (t TaskFailureCommandStalled) ErrorCause() string {
+	return fmt.Sprintf("command sent no heartbeat for %s: %s", t.timeout, t.stderr)
+}
+func (t TaskFailureCommandStalled) Error() string {
+	return fmt.Sprintf("%s: %s", t.ErrorName(), t.ErrorCause())
+}
+
+// TaskFailureCommandTimedOut happens when the command runs longer than the task timeout.
+type TaskFailureCommandTimedOut struct {
+	timeout time.Duration
+	elapsed time.Duration
+	stderr  string
+}
+
+func (t TaskFailureCommandTimedOut) ErrorName() string { return "sfncli.CommandTimedOut" }
+func (t TaskFailureCommandTimedOut) ErrorCause() string {
+	return fmt.Sprintf("command timed out after %s (timeout %s): %s", t.elapsed.Round(time.Millisecond), t.timeout, t.stderr)
+}
+func (t TaskFailureCommandTimedOut) Error() string {
+	return fmt.Sprintf("%s: %s", t.ErrorName(), t.ErrorCause())
+}
+
+// TaskFailureHTTPConnectionFailed is used when the request to the HTTP endpoint fails before a response is read.
+type TaskFailureHTTPConnectionFailed struct {
+	error
+}
+
+func (t TaskFailureHTTPConnectionFailed) ErrorName() string  { return "sfncli.HTTPConnectionFailed" }
+func (t TaskFailureHTTPConnectionFailed) ErrorCause() string { return t.Error() }
+
+// TaskFailureHTTPTimedOut is used when the HTTP endpoint does not respond within the HTTP timeout, or the task timeout if it is shorter.
+type TaskFailureHTTPTimedOut struct {
+	endpoint string
+	timeout  time.Duration
+}
+
+func (t TaskFailureHTTPTimedOut) ErrorName() string { return "sfncli.HTTPTimedOut" }
+func (t TaskFailureHTTPTimedOut) ErrorCause() string {
+	return fmt.Sprintf("no response from %s within %s", t.endpoint, t.timeout)
+}
+func (t TaskFailureHTTPTimedOut) Error() string {
+	return fmt.Sprintf("%s: %s", t.ErrorName(), t.ErrorCause())
+}
+
+// TaskFailureHTTPResponseNotJSON is used when the body of a 2xx response of the HTTP endpoint is not a JSON object.
+type TaskFailureHTTPResponseNotJSON struct {
+	status int
+	body   string
+}
+
+func (t TaskFailureHTTPResponseNotJSON) ErrorName() string { return "sfncli.HTTPResponseNotJSON" }
+func (t TaskFailureHTTPResponseNotJSON) ErrorCause() string {
+	return fmt.Sprintf("%d response not a JSON object: '%s'", t.status, t.body)
+}
+func (t TaskFailureHTTPResponseNotJSON) Error() string { return t.ErrorCause() }
+
+// TaskFailureHTTPResponseNotOK is used when the HTTP endpoint responds with a non-2xx status and doesn't specify its own error name in the body.
+type TaskFailureHTTPResponseNotOK struct {
+	status int
+	body   string
+}
+
+func (t TaskFailureHTTPResponseNotOK) ErrorName() string { return "sfncli.HTTPResponseNotOK" }
+func (t TaskFailureHTTPResponseNotOK) ErrorCause() string {
+	return fmt.Sprintf("%d response: '%s'", t.status, t.body)
+}
+func (t TaskFailureHTTPResponseNotOK) Error() string {
+	return fmt.Sprintf("%s: %s", t.ErrorName(), t.ErrorCause())
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// exitCodeError names the failure of a command that exits with an exit code in [min, max], for
+// commands with documented exit codes that can't report a custom error in their output.
+type exitCodeError struct {
+	min, max int
+	name     string
+	// cause is the template of the cause, executed with exitCodeCause. nil means the end of stderr.
+	cause *template.Template
+	// value is the rule as it was given, `codes=name[:cause]`
+	value string
+}
+
+// exitCodeCause is what the cause template of an exitCodeError can use.
+type exitCodeCause struct {
+	ExitCode int
+	Stderr   string
+}
+
+// exitCodeErrors is a flag.Value that collects repeated `-exit-code-error codes=name[:cause]` flags.
+// The first rule that matches the exit code of a command names its failure.
+type exitCodeErrors []exitCodeError
+
+func (e *exitCodeErrors) String() string {
+	if e == nil {
+		return ""
+	}
+	rules := []string{}
+	for _, rule := range *e {
+		rules = append(rules, rule.value)
+	}
+	return strings.Join(rules, ", ")
+}
+
+// Set parses a rule of the form `codes=name[:cause]`, where codes is an exit code like 75 or a
+// range like 64-78, and cause is a text/template with .ExitCode and .Stderr.
+func (e *exitCodeErrors) Set(value string) error {
+	rule, err := parseExitCodeError(value)
+	if err != nil {
+		return err
+	}
+	*e = append(*e, rule)
+	return nil
+}
+
+// failure returns the failure of a command that exited with exitCode, if a rule matches it.
+func (e exitCodeErrors) failure(exitCode int, stderr string) (TaskFailureCustom, bool) {
+	for _, rule := range e {
+		if exitCode < rule.min || exitCode > rule.max {
+			continue
+		}
+		cause := stderr
+		if rule.cause != nil {
+			var buf bytes.Buffer
+			if err := rule.cause.Execute(&buf, exitCodeCause{ExitCode: exitCode, Stderr: stderr}); err == nil {
+				cause = buf.String()
+			}
+		}
+		return TaskFailureCustom{Err: rule.name, Cause: cause}, true
+	}
+	return TaskFailureCustom{}, false
+}
+
+func parseExitCodeError(value string) (exitCodeError, error) {
+	codes, rest, ok := strings.Cut(value, "=")
+	if !ok {
+		return exitCodeError{}, fmt.Errorf("exit code error '%s' must be of the form codes=name[:cause]", value)
+	}
+	name, cause, hasCause := strings.Cut(rest, ":")
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return exitCodeError{}, fmt.Errorf("exit code error '%s' is missing an error name", value)
+	}
+
+	rule := exitCodeError{name: name, value: value}
+	minCode, maxCode, isRange := strings.Cut(strings.TrimSpace(codes), "-")
+	var err error
+	if rule.min, err = strconv.Atoi(minCode); err != nil {
+		return exitCodeError{}, fmt.Errorf("exit code error '%s' has an invalid exit code: %s", value, err)
+	}
+	rule.max = rule.min
+	if isRange {
+		if rule.max, err = strconv.Atoi(maxCode); err != nil {
+			return exitCodeError{}, fmt.Errorf("exit code error '%s' has an invalid exit code: %s", value, err)
+		}
+	}
+	if rule.min < 1 || rule.max > 255 || rule.min > rule.max {
+		return exitCodeError{}, fmt.Errorf("exit code error '%s' must match exit codes between 1 and 255", value)
+	}
+
+	if hasCause {
+		if rule.cause, err = template.New(name).Option("missingkey=error").Parse(cause); err != nil {
+			return exitCodeError{}, fmt.Errorf("exit code error '%s' has an invalid cause template: %s", value, err)
+		}
+	}
+	return rule, nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExitCodeErrors(t *testing.T) {
+	t.Run("parses exit codes and ranges", func(t *testing.T) {
+		var rules exitCodeErrors
+		require.NoError(t, rules.Set("75=MyTool.TempFailure"))
+		require.NoError(t, rules.Set(" 64-78 = MyTool.Failed:exit {{.ExitCode}}: {{.Stderr}}"))
+		assert.Equal(t, "75=MyTool.TempFailure,  64-78 = MyTool.Failed:exit {{.ExitCode}}: {{.Stderr}}", rules.String())
+
+		failure, ok := rules.failure(75, "try again")
+		assert.True(t, ok)
+		assert.Equal(t, TaskFailureCustom{Err: "MyTool.TempFailure", Cause: "try again"}, failure)
+		failure, ok = rules.failure(64, "usage: mytool")
+		assert.True(t, ok)
+		assert.Equal(t, TaskFailureCustom{Err: "MyTool.Failed", Cause: "exit 64: usage: mytool"}, failure)
+		_, ok = rules.failure(79, "")
+		assert.False(t, ok)
+	})
+
+	t.Run("falls back to stderr if the cause template fails", func(t *testing.T) {
+		var rules exitCodeErrors
+		require.NoError(t, rules.Set("1=MyTool.Failed:{{.Missing}}"))
+		failure, ok := rules.failure(1, "stderr")
+		assert.True(t, ok)
+		assert.Equal(t, TaskFailureCustom{Err: "MyTool.Failed", Cause: "stderr"}, failure)
+	})
+
+	t.Run("rejects invalid rules", func(t *testing.T) {
+		var rules exitCodeErrors
+		for _, value := range []string{
+			"MyTool.Failed",
+			"75=",
+			"seventy=MyTool.Failed",
+			"0=MyTool.Failed",
+			"78-64=MyTool.Failed",
+			"1-256=MyTool.Failed",
+			"1=MyTool.Failed:{{.ExitCode",
+		} {
+			assert.Error(t, rules.Set(value), value)
+		}
+		assert.Empty(t, rules)
+	})
+}
@@ -0,0 +1,62 @@
+package main
+
+// Exit codes of sfncli when it stops on its own with -max-tasks, -run-once or -idle-timeout, and of
+// sfncli run. They reflect the outcome of the last task so that orchestration like ECS or Batch, or a
+// script, can react to it without parsing logs. 1 is sfncli failing to start and 2 is a usage error of the flags.
+const (
+	exitCodeSuccess = 0
+	// exitCodeCustomError is a custom error name: reported by the command or HTTP endpoint, in an error
+	// envelope, or from a matching -exit-code-error or -stderr-error rule
+	exitCodeCustomError = 10
+	// exitCodeCommandFailed is sfncli.CommandExitedNonzero, sfncli.CommandNotFound or sfncli.CommandStartFailed
+	exitCodeCommandFailed = 11
+	// exitCodeCommandKilled is sfncli.CommandKilled or sfncli.CommandTerminated
+	exitCodeCommandKilled = 12
+	// exitCodeCommandStalled is sfncli.CommandStalled
+	exitCodeCommandStalled = 13
+	// exitCodeTaskInputInvalid is sfncli.TaskInputNotJSON, sfncli.TaskInputMissingExecutionName,
+	// sfncli.TaskInputPayloadUnavailable or sfncli.TaskInputInvalidTimeout
+	exitCodeTaskInputInvalid = 14
+	// exitCodeTaskOutputInvalid is sfncli.TaskOutputNotJSON, sfncli.TaskOutputTooLarge or
+	// sfncli.TaskOutputUploadFailed
+	exitCodeTaskOutputInvalid = 15
+	// exitCodeHTTPFailed is any of the sfncli.HTTP* errors
+	exitCodeHTTPFailed = 16
+	// exitCodeCommandTimedOut is sfncli.CommandTimedOut
+	exitCodeCommandTimedOut = 17
+	// exitCodeCommandOOMKilled is sfncli.CommandOOMKilled
+	exitCodeCommandOOMKilled = 18
+	// exitCodeUnknown is sfncli.Unknown or any other error
+	exitCodeUnknown = 19
+)
+
+// exitCodeForTask returns the exit code for the outcome of a task: the error it failed with, or nil.
+func exitCodeForTask(err error) int {
+	if structured, ok := err.(taskFailureStructured); ok {
+		err = structured.TaskFailureError
+	}
+	switch err.(type) {
+	case nil:
+		return exitCodeSuccess
+	case TaskFailureCustom:
+		return exitCodeCustomError
+	case TaskFailureCommandExitedNonzero, TaskFailureCommandNotFound, TaskFailureCommandStartFailed:
+		return exitCodeCommandFailed
+	case TaskFailureCommandKilled, TaskFailureCommandTerminated:
+		return exitCodeCommandKilled
+	case TaskFailureCommandStalled:
+		return exitCodeCommandStalled
+	case TaskFailureCommandTimedOut:
+		return exitCodeCommandTimedOut
+	case TaskFailureCommandOOMKilled:
+		return exitCodeCommandOOMKilled
+	case TaskFailureTaskInputNotJSON, TaskFailureTaskInputMissingExecutionName, TaskFailureTaskInputPayloadUnavailable, TaskFailureTaskInputInvalidTimeout:
+		return exitCodeTaskInputInvalid
+	case TaskFailureTaskOutputNotJSON, TaskFailureTaskOutputTooLarge, TaskFailureTaskOutputUploadFailed:
+		return exitCodeTaskOutputInvalid
+	case TaskFailureHTTPConnectionFailed, TaskFailureHTTPTimedOut, TaskFailureHTTPResponseNotJSON, TaskFailureHTTPResponseNotOK:
+		return exitCodeHTTPFailed
+	default:
+		return exitCodeUnknown
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/Clever/sfncli/worker"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sfn"
+)
+
+// execHandler is the worker.Handler of sfncli. It processes every task with a TaskRunner, which runs
+// the command, or sends the task to the persistent worker of the slot or to the HTTP endpoint.
+type execHandler struct {
+	cmd           string
+	cmdArgs       []string
+	workDirectory string
+
+	commandHeartbeatTimeout time.Duration
+	taskTimeout             time.Duration
+	causeFormat             string
+	workerName              string
+	errorEnvelope           bool
+	exitCodeErrors          exitCodeErrors
+	stderrErrors            stderrErrors
+	sigtermGracePeriod      time.Duration
+	signals                 signalPolicy
+	inputMode               string
+	outputMode              string
+	stdoutBufferSize        int
+	stderrBufferSize        int
+	payloads                *payloadStore
+	httpHandler             *httpHandler
+	terminate               <-chan struct{}
+
+	// persistentWorkers has a persistent worker per slot in the persistent worker mode, so that slots
+	// process tasks side by side. It is nil in the exec worker mode.
+	persistentWorkers []*persistentWorker
+}
+
+// Handle processes a task with a new TaskRunner.
+func (h *execHandler) Handle(ctx context.Context, input json.RawMessage) (json.RawMessage, error) {
+	task, ok := worker.TaskFromContext(ctx)
+	if !ok {
+		task = &worker.Task{}
+	}
+
+	result := &taskResult{}
+	taskRunner := NewTaskRunner(h.cmd, result, task.Token, h.workDirectory)
+	taskRunner.commandHeartbeatTimeout = h.commandHeartbeatTimeout
+	taskRunner.taskTimeout = h.taskTimeout
+	taskRunner.causeFormat = h.causeFormat
+	taskRunner.workerName = h.workerName
+	taskRunner.errorEnvelope = h.errorEnvelope
+	taskRunner.exitCodeErrors = h.exitCodeErrors
+	taskRunner.stderrErrors = h.stderrErrors
+	taskRunner.sigtermGracePeriod = h.sigtermGracePeriod
+	taskRunner.signals = h.signals
+	taskRunner.inputMode = h.inputMode
+	taskRunner.outputMode = h.outputMode
+	taskRunner.stdoutBufferSize = h.stdoutBufferSize
+	taskRunner.stderrBufferSize = h.stderrBufferSize
+	taskRunner.payloads = h.payloads
+	taskRunner.httpHandler = h.httpHandler
+	taskRunner.terminate = h.terminate
+	if h.persistentWorkers != nil {
+		taskRunner.persistentWorker = h.persistentWorkers[task.Slot]
+	}
+	// in command-heartbeat mode, heartbeats are only forwarded while the command checks in
+	if h.commandHeartbeatTimeout > 0 {
+		task.SetHeartbeatCheck(taskRunner.commandCheckedInSince)
+	}
+
+	// Copy the additional args so concurrent slots don't share the backing array that Process appends the input to.
+	if err := taskRunner.Process(ctx, append([]string{}, h.cmdArgs...), string(input)); err != nil {
+		return nil, err
+	}
+	return json.RawMessage(result.output), nil
+}
+
+// stop stops the persistent workers, if any.
+func (h *execHandler) stop() {
+	for _, w := range h.persistentWorkers {
+		w.stop(canceledTaskGracePeriod)
+	}
+}
+
+// taskResult is the SFNAPI of the TaskRunners of execHandler. It records the output of the task
+// for the worker to report, instead of sending it to Step Functions. Failures are returned by Process.
+type taskResult struct {
+	output string
+}
+
+func (r *taskResult) SendTaskSuccess(ctx context.Context, params *sfn.SendTaskSuccessInput, optFns ...func(*sfn.Options)) (*sfn.SendTaskSuccessOutput, error) {
+	r.output = aws.ToString(params.Output)
+	return &sfn.SendTaskSuccessOutput{}, nil
+}
+
+func (r *taskResult) SendTaskFailure(ctx context.Context, params *sfn.SendTaskFailureInput, optFns ...func(*sfn.Options)) (*sfn.SendTaskFailureOutput, error) {
+	return &sfn.SendTaskFailureOutput{}, nil
+}
+
+func (r *taskResult) SendTaskHeartbeat(ctx context.Context, params *sfn.SendTaskHeartbeatInput, optFns ...func(*sfn.Options)) (*sfn.SendTaskHeartbeatOutput, error) {
+	return &sfn.SendTaskHeartbeatOutput{}, nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExecHandler(t *testing.T) {
+	newHandler := func(cmd string, args ...string) *execHandler {
+		return &execHandler{
+			cmd:              path.Join(testScriptsDir, cmd),
+			cmdArgs:          args,
+			inputMode:        inputModeArgv,
+			outputMode:       outputModeStdout,
+			stdoutBufferSize: defaultStdoutBufferSize,
+			stderrBufferSize: defaultStderrBufferSize,
+
+			sigtermGracePeriod: defaultSigtermGracePeriod,
+			signals:            defaultSignalPolicy,
+		}
+	}
+
+	t.Run("returns the task output", func(t *testing.T) {
+		output, err := newHandler("stdout_parsing.sh").Handle(context.Background(), json.RawMessage(emptyTaskInput))
+		require.NoError(t, err)
+		assert.JSONEq(t, `{"_EXECUTION_NAME":"fake-WFM-uuid","task":"output"}`, string(output))
+	})
+
+	t.Run("returns the task failure", func(t *testing.T) {
+		handler := newHandler("stderr_stdout_exitcode.sh", "stderr", `{"error": "custom.error_name", "cause": "bar"}`, "10")
+		_, err := handler.Handle(context.Background(), json.RawMessage(emptyTaskInput))
+		require.Equal(t, TaskFailureCustom{Err: "custom.error_name", Cause: "bar"}, err)
+	})
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// headers of the request sent to the HTTP endpoint for every task
+const (
+	httpExecutionNameHeader = "X-Sfncli-Execution-Name"
+	// httpDeadlineHeader is when sfncli stops waiting for a response, in RFC 3339 format.
+	httpDeadlineHeader = "X-Sfncli-Deadline"
+)
+
+// defaultHTTPTimeout is how long sfncli waits for a response from the HTTP endpoint by default.
+const defaultHTTPTimeout = time.Hour
+
+// httpHandler is a local HTTP service that processes tasks instead of a command:
+// the input of every task is POSTed to its endpoint, and the response is the result of the task.
+type httpHandler struct {
+	endpoint string
+	timeout  time.Duration
+	client   *http.Client
+}
+
+func newHTTPHandler(endpoint string, timeout time.Duration) *httpHandler {
+	return &httpHandler{
+		endpoint: endpoint,
+		timeout:  timeout,
+		client:   &http.Client{},
+	}
+}
+
+// processHTTP POSTs the input of the task to the HTTP endpoint and reports its response:
+//   - a 2xx response is the output of the task, and an empty one is treated like {}, as a command's empty stdout is
+//   - a non-2xx response with an error field in its body is reported as a custom error, like a command's
+//
+// The request times out after the HTTP timeout, or after the task timeout if it is shorter.
+func (t *TaskRunner) processHTTP(ctx context.Context, executionName string, marshaledInput []byte, taskTimeout time.Duration) error {
+	h := t.httpHandler
+	t.started = time.Now()
+	// the request is canceled like a command is terminated once a drain ends
+	taskCtx, taskCtxCancel := context.WithCancel(ctx)
+	defer taskCtxCancel()
+	go func() {
+		select {
+		case <-t.terminate:
+			taskCtxCancel()
+		case <-taskCtx.Done():
+		}
+	}()
+	timeout := h.timeout
+	if taskTimeout > 0 && taskTimeout < timeout {
+		timeout = taskTimeout
+	}
+	deadline := time.Now().Add(timeout)
+	requestCtx, requestCtxCancel := context.WithDeadline(taskCtx, deadline)
+	defer requestCtxCancel()
+
+	req, err := http.NewRequestWithContext(requestCtx, http.MethodPost, h.endpoint, bytes.NewReader(marshaledInput))
+	if err != nil {
+		return t.sendTaskFailure(TaskFailureUnknown{err})
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(httpExecutionNameHeader, executionName)
+	req.Header.Set(httpDeadlineHeader, deadline.UTC().Format(time.RFC3339))
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return t.sendTaskFailure(t.httpFailure(taskCtx, requestCtx, timeout, err))
+	}
+	defer resp.Body.Close()
+
+	limit := t.maxOutputLength()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, int64(limit)+1))
+	if err != nil {
+		return t.sendTaskFailure(t.httpFailure(taskCtx, requestCtx, timeout, err))
+	}
+	if len(body) > limit {
+		size := len(body)
+		if resp.ContentLength > int64(size) {
+			size = int(resp.ContentLength)
+		}
+		return t.sendTaskFailure(TaskFailureTaskOutputTooLarge{size: size, limit: limit})
+	}
+
+	response := strings.TrimSpace(string(body))
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		var output map[string]interface{}
+		if response != "" && (json.Unmarshal([]byte(response), &output) != nil || output == nil) {
+			return t.sendTaskFailure(TaskFailureHTTPResponseNotJSON{status: resp.StatusCode, body: response})
+		}
+		return t.sendTaskOutput(ctx, executionName, response, false)
+	}
+	var customError TaskFailureCustom
+	if err := json.Unmarshal([]byte(response), &customError); err == nil && customError.Err != "" {
+		return t.sendTaskFailure(customError)
+	}
+	return t.sendTaskFailure(TaskFailureHTTPResponseNotOK{status: resp.StatusCode, body: response})
+}
+
+// httpFailure classifies an error sending the request or reading the response, which had timeout to complete.
+func (t *TaskRunner) httpFailure(taskCtx, requestCtx context.Context, timeout time.Duration, err error) TaskFailureError {
+	if taskCtx.Err() != nil {
+		// the task was canceled, e.g. because SFN timed it out, sfncli received SIGTERM or a drain ended
+		return TaskFailureCommandTerminated{stderr: fmt.Sprintf("task canceled while waiting for a response from %s", t.httpHandler.endpoint)}
+	}
+	if errors.Is(requestCtx.Err(), context.DeadlineExceeded) {
+		return TaskFailureHTTPTimedOut{endpoint: t.httpHandler.endpoint, timeout: timeout}
+	}
+	return TaskFailureHTTPConnectionFailed{err}
+}
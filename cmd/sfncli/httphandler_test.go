@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Clever/sfncli/mocks"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sfn"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTaskHTTPHandler(t *testing.T) {
+	// respond writes a response with the given status and body
+	respond := func(status int, body string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+			io.WriteString(w, body)
+		}
+	}
+
+	t.Run("posts the task input and reports a 2xx response as the output", func(t *testing.T) {
+		t.Parallel()
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, http.MethodPost, r.Method)
+			assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+			assert.Equal(t, "fake-WFM-uuid", r.Header.Get(httpExecutionNameHeader))
+			deadline, err := time.Parse(time.RFC3339, r.Header.Get(httpDeadlineHeader))
+			assert.NoError(t, err)
+			assert.WithinDuration(t, time.Now().Add(time.Minute), deadline, 5*time.Second)
+			body, _ := io.ReadAll(r.Body)
+			assert.JSONEq(t, `{"_EXECUTION_NAME":"fake-WFM-uuid","hello":"world"}`, string(body))
+			io.WriteString(w, `{"task": "output"}`)
+		}))
+		defer server.Close()
+		controller := gomock.NewController(t)
+		defer controller.Finish()
+		mockSFN := mocks.NewMockSFNAPI(controller)
+		mockSFN.EXPECT().SendTaskSuccess(gomock.Any(), &sfn.SendTaskSuccessInput{
+			Output:    aws.String(`{"_EXECUTION_NAME":"fake-WFM-uuid","task":"output"}`),
+			TaskToken: aws.String(mockTaskToken),
+		})
+		taskRunner := NewTaskRunner("", mockSFN, mockTaskToken, "")
+		taskRunner.httpHandler = newHTTPHandler(server.URL, time.Minute)
+		require.NoError(t, taskRunner.Process(context.Background(), []string{}, `{"_EXECUTION_NAME":"fake-WFM-uuid","hello":"world"}`))
+	})
+
+	t.Run("treats an empty 2xx response like {}", func(t *testing.T) {
+		t.Parallel()
+		server := httptest.NewServer(respond(http.StatusNoContent, ""))
+		defer server.Close()
+		controller := gomock.NewController(t)
+		defer controller.Finish()
+		mockSFN := mocks.NewMockSFNAPI(controller)
+		mockSFN.EXPECT().SendTaskSuccess(gomock.Any(), &sfn.SendTaskSuccessInput{
+			Output:    aws.String(`{"_EXECUTION_NAME":"fake-WFM-uuid"}`),
+			TaskToken: aws.String(mockTaskToken),
+		})
+		taskRunner := NewTaskRunner("", mockSFN, mockTaskToken, "")
+		taskRunner.httpHandler = newHTTPHandler(server.URL, time.Minute)
+		require.NoError(t, taskRunner.Process(context.Background(), []string{}, emptyTaskInput))
+	})
+
+	for _, test := range []struct {
+		name          string
+		handler       http.HandlerFunc
+		timeout       time.Duration
+		expectedError TaskFailureError
+	}{
+		{
+			name:          "non-2xx response with an error is a custom error",
+			handler:       respond(http.StatusUnprocessableEntity, `{"error": "custom.error_name", "cause": "bar"}`),
+			expectedError: TaskFailureCustom{Err: "custom.error_name", Cause: "bar"},
+		},
+		{
+			name:          "non-2xx response without an error",
+			handler:       respond(http.StatusInternalServerError, `{"message": "oops"}`),
+			expectedError: TaskFailureHTTPResponseNotOK{status: http.StatusInternalServerError, body: `{"message": "oops"}`},
+		},
+		{
+			name:          "non-2xx response not JSON",
+			handler:       respond(http.StatusBadGateway, "bad gateway"),
+			expectedError: TaskFailureHTTPResponseNotOK{status: http.StatusBadGateway, body: "bad gateway"},
+		},
+		{
+			name:          "response not JSON",
+			handler:       respond(http.StatusOK, "not json"),
+			expectedError: TaskFailureHTTPResponseNotJSON{status: http.StatusOK, body: "not json"},
+		},
+		{
+			name:          "2xx response that is not a JSON object",
+			handler:       respond(http.StatusOK, `["a", "b"]`),
+			expectedError: TaskFailureHTTPResponseNotJSON{status: http.StatusOK, body: `["a", "b"]`},
+		},
+		{
+			name: "no response within the timeout",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				time.Sleep(time.Second)
+			},
+			timeout: 100 * time.Millisecond,
+		},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			server := httptest.NewServer(test.handler)
+			defer server.Close()
+			timeout := test.timeout
+			if timeout == 0 {
+				timeout = time.Minute
+			}
+			expectedError := test.expectedError
+			if expectedError == nil {
+				expectedError = TaskFailureHTTPTimedOut{endpoint: server.URL, timeout: timeout}
+			}
+			controller := gomock.NewController(t)
+			defer controller.Finish()
+			mockSFN := mocks.NewMockSFNAPI(controller)
+			mockSFN.EXPECT().SendTaskFailure(gomock.Any(), &sfn.SendTaskFailureInput{
+				Cause:     aws.String(expectedError.ErrorCause()),
+				Error:     aws.String(expectedError.ErrorName()),
+				TaskToken: aws.String(mockTaskToken),
+			})
+			taskRunner := NewTaskRunner("", mockSFN, mockTaskToken, "")
+			taskRunner.httpHandler = newHTTPHandler(server.URL, timeout)
+			require.Equal(t, expectedError, taskRunner.Process(context.Background(), []string{}, emptyTaskInput))
+		})
+	}
+
+	t.Run("task timeout shorter than the HTTP timeout", func(t *testing.T) {
+		t.Parallel()
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(time.Second)
+		}))
+		defer server.Close()
+		expectedError := TaskFailureHTTPTimedOut{endpoint: server.URL, timeout: 100 * time.Millisecond}
+		controller := gomock.NewController(t)
+		defer controller.Finish()
+		mockSFN := mocks.NewMockSFNAPI(controller)
+		mockSFN.EXPECT().SendTaskFailure(gomock.Any(), &sfn.SendTaskFailureInput{
+			Cause:     aws.String(expectedError.ErrorCause()),
+			Error:     aws.String(expectedError.ErrorName()),
+			TaskToken: aws.String(mockTaskToken),
+		})
+		taskRunner := NewTaskRunner("", mockSFN, mockTaskToken, "")
+		taskRunner.httpHandler = newHTTPHandler(server.URL, time.Minute)
+		err := taskRunner.Process(context.Background(), []string{}, `{"_EXECUTION_NAME":"fake-WFM-uuid","_SFNCLI_TIMEOUT_SECONDS":0.1}`)
+		require.Equal(t, expectedError, err)
+	})
+
+	t.Run("connection refused", func(t *testing.T) {
+		t.Parallel()
+		server := httptest.NewServer(respond(http.StatusOK, "{}"))
+		server.Close()
+		controller := gomock.NewController(t)
+		defer controller.Finish()
+		mockSFN := mocks.NewMockSFNAPI(controller)
+		mockSFN.EXPECT().SendTaskFailure(gomock.Any(), gomock.Any())
+		taskRunner := NewTaskRunner("", mockSFN, mockTaskToken, "")
+		taskRunner.httpHandler = newHTTPHandler(server.URL, time.Minute)
+		err := taskRunner.Process(context.Background(), []string{}, emptyTaskInput)
+		require.IsType(t, TaskFailureHTTPConnectionFailed{}, err)
+	})
+}
@@ -0,0 +1,211 @@
+//go:build integration
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/Clever/sfncli/s3fake"
+	"github.com/Clever/sfncli/sfnfake"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// These tests run the sfncli binary against an in-process fake of Step Functions.
+// Run them with `go test -tags integration ./cmd/sfncli`.
+
+var sfncliBinary string
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "sfncli-integration")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	sfncliBinary = path.Join(dir, "sfncli")
+	if out, err := exec.Command("go", "build", "-o", sfncliBinary, ".").CombinedOutput(); err != nil {
+		fmt.Printf("error building sfncli: %s\n%s", err, out)
+		os.Exit(1)
+	}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// startSFNCLI runs sfncli against the fake until the test ends.
+func startSFNCLI(t *testing.T, fake *sfnfake.Server, env []string, args ...string) *exec.Cmd {
+	cmd := exec.Command(sfncliBinary, append([]string{"-sfn-endpoint", fake.URL(), "-workername", "integration-worker"}, args...)...)
+	cmd.Env = append(os.Environ(),
+		"AWS_REGION="+sfnfake.Region,
+		"AWS_ACCESS_KEY_ID=fake",
+		"AWS_SECRET_ACCESS_KEY=fake",
+		"AWS_EC2_METADATA_DISABLED=true",
+	)
+	cmd.Env = append(cmd.Env, env...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	require.NoError(t, cmd.Start())
+	t.Cleanup(func() {
+		cmd.Process.Signal(syscall.SIGTERM)
+		cmd.Wait()
+	})
+	return cmd
+}
+
+func testScript(name string) string {
+	script, _ := filepath.Abs(path.Join(testScriptsDir, name))
+	return script
+}
+
+func TestIntegrationStartup(t *testing.T) {
+	fake := sfnfake.NewServer()
+	defer fake.Close()
+	startSFNCLI(t, fake, []string{"_DEPLOY_ENV=integration", "_APP_NAME=sfncli"}, "-activityname", "startup", "-cmd", "echo")
+
+	require.Eventually(t, func() bool {
+		_, ok := fake.Activity("startup")
+		return ok && len(fake.Polls("startup")) > 0
+	}, 10*time.Second, 50*time.Millisecond)
+	activity, _ := fake.Activity("startup")
+	assert.Equal(t, map[string]string{"environment": "integration", "application": "sfncli"}, activity.Tags)
+}
+
+func TestIntegrationTaskSuccess(t *testing.T) {
+	fake := sfnfake.NewServer()
+	defer fake.Close()
+	startSFNCLI(t, fake, nil, "-activityname", "success", "-cmd", testScript("stdout_parsing.sh"))
+
+	token := fake.AddTask("success", emptyTaskInput)
+	result, ok := fake.WaitForResult(token, 10*time.Second)
+	require.True(t, ok)
+	assert.Equal(t, sfnfake.Result{Succeeded: true, Output: `{"_EXECUTION_NAME":"fake-WFM-uuid","task":"output"}`}, result)
+	assert.Equal(t, "integration-worker", fake.WorkerName(token))
+	assert.True(t, fake.Heartbeats(token) >= 1)
+}
+
+func TestIntegrationTaskFailure(t *testing.T) {
+	fake := sfnfake.NewServer()
+	defer fake.Close()
+	startSFNCLI(t, fake, nil, "-activityname", "failure", "-cmd", testScript("stderr_stdout_exitcode.sh"), "stderr", "", "10")
+
+	token := fake.AddTask("failure", emptyTaskInput)
+	result, ok := fake.WaitForResult(token, 10*time.Second)
+	require.True(t, ok)
+	assert.Equal(t, sfnfake.Result{Error: "sfncli.CommandExitedNonzero", Cause: "stderr"}, result)
+}
+
+func TestIntegrationMultipleActivitiesAndConcurrency(t *testing.T) {
+	fake := sfnfake.NewServer()
+	defer fake.Close()
+	startSFNCLI(t, fake, nil,
+		"-concurrency", "2",
+		"-activity", "sleep-a="+testScript("sleep_and_succeed.sh")+" 2",
+		"-activity", "sleep-b="+testScript("sleep_and_succeed.sh")+" 2",
+	)
+
+	start := time.Now()
+	tokens := []string{}
+	for _, activity := range []string{"sleep-a", "sleep-a", "sleep-b", "sleep-b"} {
+		tokens = append(tokens, fake.AddTask(activity, emptyTaskInput))
+	}
+	for _, token := range tokens {
+		result, ok := fake.WaitForResult(token, 10*time.Second)
+		require.True(t, ok)
+		assert.True(t, result.Succeeded)
+	}
+	// two slots per activity, so all four tasks run side by side
+	assert.True(t, time.Since(start) < 4*time.Second, "tasks did not run concurrently")
+}
+
+func TestIntegrationRateLimit(t *testing.T) {
+	fake := sfnfake.NewServer()
+	defer fake.Close()
+	fake.PollTimeout = 10 * time.Millisecond
+	startSFNCLI(t, fake, nil, "-activityname", "ratelimit", "-cmd", "echo")
+
+	require.Eventually(t, func() bool { return len(fake.Polls("ratelimit")) > 0 }, 10*time.Second, 10*time.Millisecond)
+	time.Sleep(3 * time.Second)
+	polls := fake.Polls("ratelimit")
+	// one GetActivityTask per second, even though every poll returns right away
+	assert.True(t, len(polls) <= 5, "polled %d times", len(polls))
+	for i := 1; i < len(polls); i++ {
+		assert.True(t, polls[i].Sub(polls[i-1]) > 900*time.Millisecond)
+	}
+}
+
+func TestIntegrationTaskTimedOut(t *testing.T) {
+	fake := sfnfake.NewServer()
+	defer fake.Close()
+	startSFNCLI(t, fake, nil, "-activityname", "timeout", "-cmd", testScript("log_to_stderr_and_wait.sh"), "waiting")
+
+	token := fake.AddTask("timeout", emptyTaskInput)
+	require.Eventually(t, func() bool { return fake.Heartbeats(token) >= 1 }, 10*time.Second, 50*time.Millisecond)
+	pollsBeforeTimeout := len(fake.Polls("timeout"))
+	fake.TimeOutTask(token)
+
+	// the next heartbeat is rejected, so sfncli stops the command and goes back to polling
+	require.Eventually(t, func() bool {
+		return len(fake.Polls("timeout")) > pollsBeforeTimeout
+	}, 40*time.Second, 100*time.Millisecond)
+	_, reported := fake.WaitForResult(token, 0)
+	assert.False(t, reported)
+}
+
+func TestIntegrationPayloadOffloading(t *testing.T) {
+	fake := sfnfake.NewServer()
+	defer fake.Close()
+	s3 := s3fake.NewServer()
+	defer s3.Close()
+	startSFNCLI(t, fake, nil,
+		"-activityname", "offload",
+		"-payload-bucket", "payloads",
+		"-s3-endpoint", s3.URL(),
+		"-input-mode", "stdin",
+		"-output-mode", "file",
+		"-cmd", testScript("stdout_long_line.sh"), "300000",
+	)
+
+	token := fake.AddTask("offload", emptyTaskInput)
+	result, ok := fake.WaitForResult(token, 10*time.Second)
+	require.True(t, ok)
+	require.True(t, result.Succeeded, result.Cause)
+	var envelope struct {
+		ExecutionName string         `json:"_EXECUTION_NAME"`
+		Payload       payloadPointer `json:"_SFNCLI_PAYLOAD"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(result.Output), &envelope))
+	assert.Equal(t, "fake-WFM-uuid", envelope.ExecutionName)
+	stored, ok := s3.Object(envelope.Payload.Bucket, envelope.Payload.Key)
+	require.True(t, ok)
+	assert.Equal(t, envelope.Payload.Size, int64(len(stored)))
+}
+
+func TestIntegrationRunOnce(t *testing.T) {
+	fake := sfnfake.NewServer()
+	defer fake.Close()
+	cmd := startSFNCLI(t, fake, nil, "-run-once", "-activityname", "runonce", "-cmd", testScript("stderr_stdout_exitcode.sh"), "stderr", "", "10")
+
+	token := fake.AddTask("runonce", emptyTaskInput)
+	result, ok := fake.WaitForResult(token, 10*time.Second)
+	require.True(t, ok)
+	assert.Equal(t, "sfncli.CommandExitedNonzero", result.Error)
+
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	select {
+	case err := <-exited:
+		var exitErr *exec.ExitError
+		require.ErrorAs(t, err, &exitErr)
+		assert.Equal(t, exitCodeCommandFailed, exitErr.ExitCode())
+	case <-time.After(10 * time.Second):
+		t.Fatal("sfncli did not exit after the task")
+	}
+}
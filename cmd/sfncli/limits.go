@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/Clever/kayvee-go/v7/logger"
+	"github.com/Clever/sfncli/worker"
+)
+
+// runLimits makes sfncli stop on its own: after maxTasks tasks, or once no task was in progress for
+// idleTimeout. It drains the workers, so that the tasks in progress finish, and records the outcome of
+// the last task for the exit code of sfncli.
+type runLimits struct {
+	maxTasks    int
+	idleTimeout time.Duration
+	// drain stops every worker from polling for tasks
+	drain func()
+
+	mu         sync.Mutex
+	started    int
+	inProgress int
+	idleTimer  *time.Timer
+	processed  bool
+	lastErr    error
+}
+
+func newRunLimits(maxTasks int, idleTimeout time.Duration, drain func()) *runLimits {
+	return &runLimits{maxTasks: maxTasks, idleTimeout: idleTimeout, drain: drain}
+}
+
+// start starts the idle timeout, once the workers are about to poll for tasks.
+func (l *runLimits) start() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.idleTimeout > 0 {
+		l.idleTimer = time.AfterFunc(l.idleTimeout, l.idle)
+	}
+}
+
+func (l *runLimits) idle() {
+	log.InfoD("idle-timeout", logger.M{"timeout": l.idleTimeout.String()})
+	l.drain()
+}
+
+// handler counts the tasks processed by h. Once maxTasks tasks started, the tasks that other slots
+// received before they stopped polling are failed with sfncli.WorkerShuttingDown without being processed.
+func (l *runLimits) handler(h worker.Handler) worker.Handler {
+	return worker.HandlerFunc(func(ctx context.Context, input json.RawMessage) (json.RawMessage, error) {
+		if !l.taskStarted() {
+			return nil, worker.TaskFailureWorkerShuttingDown{}
+		}
+		output, err := h.Handle(ctx, input)
+		l.taskDone(err)
+		return output, err
+	})
+}
+
+// taskStarted counts a task, unless maxTasks tasks started already.
+func (l *runLimits) taskStarted() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.maxTasks > 0 && l.started >= l.maxTasks {
+		log.WarnD("max-tasks-task-refused", logger.M{"max-tasks": l.maxTasks})
+		return false
+	}
+	l.started++
+	l.inProgress++
+	if l.idleTimer != nil {
+		l.idleTimer.Stop()
+	}
+	if l.maxTasks > 0 && l.started == l.maxTasks {
+		log.InfoD("max-tasks", logger.M{"max-tasks": l.maxTasks})
+		l.drain()
+	}
+	return true
+}
+
+func (l *runLimits) taskDone(err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inProgress--
+	l.processed = true
+	l.lastErr = err
+	if l.idleTimer != nil && l.inProgress == 0 {
+		l.idleTimer.Reset(l.idleTimeout)
+	}
+}
+
+// exitCode is the exit code for the outcome of the last task, see exitCodeForTask.
+func (l *runLimits) exitCode() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.processed {
+		return exitCodeSuccess
+	}
+	return exitCodeForTask(l.lastErr)
+}
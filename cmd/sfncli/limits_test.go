@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Clever/sfncli/worker"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunLimits(t *testing.T) {
+	handle := func(l *runLimits, err error) {
+		h := l.handler(worker.HandlerFunc(func(ctx context.Context, input json.RawMessage) (json.RawMessage, error) {
+			return nil, err
+		}))
+		h.Handle(context.Background(), json.RawMessage(`{}`))
+	}
+
+	t.Run("drains after max tasks", func(t *testing.T) {
+		var drains int32
+		l := newRunLimits(2, 0, func() { atomic.AddInt32(&drains, 1) })
+		l.start()
+		handle(l, nil)
+		assert.Equal(t, int32(0), atomic.LoadInt32(&drains))
+		handle(l, TaskFailureCommandExitedNonzero{stderr: "stderr"})
+		assert.Equal(t, int32(1), atomic.LoadInt32(&drains))
+		assert.Equal(t, exitCodeCommandFailed, l.exitCode())
+	})
+
+	t.Run("refuses tasks past max tasks", func(t *testing.T) {
+		l := newRunLimits(1, 0, func() {})
+		l.start()
+		handle(l, nil)
+		var calls int32
+		h := l.handler(worker.HandlerFunc(func(ctx context.Context, input json.RawMessage) (json.RawMessage, error) {
+			atomic.AddInt32(&calls, 1)
+			return nil, nil
+		}))
+		_, err := h.Handle(context.Background(), json.RawMessage(`{}`))
+		assert.Equal(t, worker.TaskFailureWorkerShuttingDown{}, err)
+		assert.Equal(t, int32(0), atomic.LoadInt32(&calls))
+		// the refused task does not count as the last task
+		assert.Equal(t, exitCodeSuccess, l.exitCode())
+	})
+
+	t.Run("drains once idle", func(t *testing.T) {
+		var drains int32
+		l := newRunLimits(0, 50*time.Millisecond, func() { atomic.AddInt32(&drains, 1) })
+		l.start()
+		handle(l, nil)
+		assert.Equal(t, int32(0), atomic.LoadInt32(&drains))
+		assert.Eventually(t, func() bool { return atomic.LoadInt32(&drains) > 0 }, time.Second, 10*time.Millisecond)
+		assert.Equal(t, exitCodeSuccess, l.exitCode())
+	})
+
+	t.Run("exit code is success without tasks", func(t *testing.T) {
+		l := newRunLimits(1, 0, func() {})
+		assert.Equal(t, exitCodeSuccess, l.exitCode())
+	})
+}
+
+func TestExitCodeForTask(t *testing.T) {
+	for _, test := range []struct {
+		err      error
+		expected int
+	}{
+		{nil, exitCodeSuccess},
+		{TaskFailureCustom{Err: "custom.error_name"}, exitCodeCustomError},
+		{TaskFailureCommandExitedNonzero{}, exitCodeCommandFailed},
+		{TaskFailureCommandNotFound{}, exitCodeCommandFailed},
+		{TaskFailureCommandStartFailed{}, exitCodeCommandFailed},
+		{TaskFailureCommandKilled{}, exitCodeCommandKilled},
+		{TaskFailureCommandTerminated{}, exitCodeCommandKilled},
+		{TaskFailureCommandOOMKilled{}, exitCodeCommandOOMKilled},
+		{TaskFailureCommandStalled{}, exitCodeCommandStalled},
+		{TaskFailureCommandTimedOut{}, exitCodeCommandTimedOut},
+		{TaskFailureTaskInputNotJSON{}, exitCodeTaskInputInvalid},
+		{TaskFailureTaskOutputTooLarge{}, exitCodeTaskOutputInvalid},
+		{TaskFailureHTTPTimedOut{}, exitCodeHTTPFailed},
+		{TaskFailureUnknown{errors.New("unknown")}, exitCodeUnknown},
+		{errors.New("other"), exitCodeUnknown},
+	} {
+		assert.Equal(t, test.expected, exitCodeForTask(test.err), "%T", test.err)
+	}
+}
@@ -0,0 +1,8 @@
+package main
+
+import "syscall"
+
+// maxrssBytes is the Maxrss of a rusage in bytes. Linux reports it in kilobytes.
+func maxrssBytes(rusage *syscall.Rusage) int64 {
+	return int64(rusage.Maxrss) * 1024
+}
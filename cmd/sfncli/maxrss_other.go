@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+import "syscall"
+
+// maxrssBytes is the Maxrss of a rusage in bytes. Its unit differs between the other systems, e.g. bytes
+// on darwin and kilobytes on the BSDs, and OOM kills are only detected on Linux, so it is left unknown.
+func maxrssBytes(rusage *syscall.Rusage) int64 {
+	return 0
+}
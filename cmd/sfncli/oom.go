@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// When a command uses more memory than the limit of its cgroup, e.g. the memory limit of its
+// container, the kernel SIGKILLs it. sfncli tells this apart from other SIGKILLs by the oom_kill
+// counter of the memory cgroup it runs in, which the command inherits.
+
+var (
+	// cgroupMountpoint and procSelfCgroup are variables so that tests can use a fake cgroup
+	cgroupMountpoint = "/sys/fs/cgroup"
+	procSelfCgroup   = "/proc/self/cgroup"
+)
+
+// unlimitedMemoryV1 is the smallest memory.limit_in_bytes cgroup v1 reports for no limit, the
+// largest page aligned int64.
+const unlimitedMemoryV1 = 1<<63 - 4096
+
+// memoryCgroup is the directory of the cgroup v1 or v2 memory controller of sfncli.
+type memoryCgroup struct {
+	dir string
+	v2  bool
+}
+
+// findMemoryCgroup finds the memory cgroup of sfncli from /proc/self/cgroup. Inside a cgroup
+// namespace, e.g. a container, the cgroup is mounted at the root of the mountpoint instead.
+func findMemoryCgroup() (memoryCgroup, bool) {
+	f, err := os.Open(procSelfCgroup)
+	if err != nil {
+		return memoryCgroup{}, false
+	}
+	defer f.Close()
+
+	v1Path, v2Path := "", ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// hierarchy-ID:controller-list:cgroup-path
+		fields := strings.SplitN(scanner.Text(), ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		if fields[0] == "0" && fields[1] == "" {
+			v2Path = fields[2]
+			continue
+		}
+		for _, controller := range strings.Split(fields[1], ",") {
+			if controller == "memory" {
+				v1Path = fields[2]
+			}
+		}
+	}
+
+	// with both, the memory controller is on the v1 hierarchy
+	if v1Path != "" {
+		for _, dir := range []string{filepath.Join(cgroupMountpoint, "memory", v1Path), filepath.Join(cgroupMountpoint, "memory")} {
+			if fileExists(filepath.Join(dir, "memory.oom_control")) {
+				return memoryCgroup{dir: dir}, true
+			}
+		}
+	}
+	if v2Path != "" {
+		for _, dir := range []string{filepath.Join(cgroupMountpoint, v2Path), cgroupMountpoint} {
+			if fileExists(filepath.Join(dir, "memory.events")) {
+				return memoryCgroup{dir: dir, v2: true}, true
+			}
+		}
+	}
+	return memoryCgroup{}, false
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// oomKills is how many processes of the cgroup the kernel killed for running out of memory.
+func (c memoryCgroup) oomKills() (int64, bool) {
+	file := "memory.oom_control"
+	if c.v2 {
+		file = "memory.events"
+	}
+	contents, err := os.ReadFile(filepath.Join(c.dir, file))
+	if err != nil {
+		return 0, false
+	}
+	for _, line := range strings.Split(string(contents), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "oom_kill" {
+			kills, err := strconv.ParseInt(fields[1], 10, 64)
+			return kills, err == nil
+		}
+	}
+	return 0, false
+}
+
+// limit is the memory limit of the cgroup in bytes, or zero if it has none.
+func (c memoryCgroup) limit() int64 {
+	file := "memory.limit_in_bytes"
+	if c.v2 {
+		file = "memory.max"
+	}
+	contents, err := os.ReadFile(filepath.Join(c.dir, file))
+	if err != nil {
+		return 0
+	}
+	limit, err := strconv.ParseInt(strings.TrimSpace(string(contents)), 10, 64)
+	if err != nil || limit >= unlimitedMemoryV1 {
+		return 0 // "max" in v2
+	}
+	return limit
+}
+
+// oomWatch records the oom_kill counter of the memory cgroup before a command runs, to tell
+// whether a SIGKILL of the command was an OOM kill. A nil oomWatch never reports one.
+type oomWatch struct {
+	cgroup memoryCgroup
+	kills  int64
+}
+
+// watchForOOMKills starts watching the memory cgroup of sfncli, if it can be read.
+func watchForOOMKills() *oomWatch {
+	cgroup, ok := findMemoryCgroup()
+	if !ok {
+		return nil
+	}
+	kills, ok := cgroup.oomKills()
+	if !ok {
+		return nil
+	}
+	return &oomWatch{cgroup: cgroup, kills: kills}
+}
+
+// killed is whether the kernel killed a process of the cgroup for running out of memory since the
+// watch started. With more than one command running in the cgroup, the process may have been another one.
+func (w *oomWatch) killed() bool {
+	if w == nil {
+		return false
+	}
+	kills, ok := w.cgroup.oomKills()
+	return ok && kills > w.kills
+}
+
+// peakRSS is the maximum resident set size of an exited process in bytes, if known.
+func peakRSS(state *os.ProcessState) int64 {
+	if state == nil {
+		return 0
+	}
+	rusage, ok := state.SysUsage().(*syscall.Rusage)
+	if !ok {
+		return 0
+	}
+	return maxrssBytes(rusage)
+}
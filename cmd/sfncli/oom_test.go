@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Clever/sfncli/mocks"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeCgroup points sfncli at a fake cgroup mountpoint and /proc/self/cgroup until the test ends.
+func fakeCgroup(t *testing.T, procSelfCgroupContents string) string {
+	mountpoint := t.TempDir()
+	selfCgroup := filepath.Join(t.TempDir(), "cgroup")
+	require.NoError(t, os.WriteFile(selfCgroup, []byte(procSelfCgroupContents), 0644))
+
+	oldMountpoint, oldProcSelfCgroup := cgroupMountpoint, procSelfCgroup
+	cgroupMountpoint, procSelfCgroup = mountpoint, selfCgroup
+	t.Cleanup(func() { cgroupMountpoint, procSelfCgroup = oldMountpoint, oldProcSelfCgroup })
+	return mountpoint
+}
+
+func writeCgroupFile(t *testing.T, dir, name, contents string) {
+	require.NoError(t, os.MkdirAll(dir, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(contents), 0644))
+}
+
+func TestFindMemoryCgroup(t *testing.T) {
+	t.Run("cgroup v2", func(t *testing.T) {
+		mountpoint := fakeCgroup(t, "0::/ecs/task/container\n")
+		dir := filepath.Join(mountpoint, "ecs/task/container")
+		writeCgroupFile(t, dir, "memory.events", "low 0\nhigh 0\nmax 0\noom 0\noom_kill 2\n")
+		writeCgroupFile(t, dir, "memory.max", "536870912\n")
+
+		cgroup, ok := findMemoryCgroup()
+		require.True(t, ok)
+		assert.Equal(t, memoryCgroup{dir: dir, v2: true}, cgroup)
+		kills, ok := cgroup.oomKills()
+		assert.True(t, ok)
+		assert.Equal(t, int64(2), kills)
+		assert.Equal(t, int64(536870912), cgroup.limit())
+
+		writeCgroupFile(t, dir, "memory.max", "max\n")
+		assert.Equal(t, int64(0), cgroup.limit())
+	})
+
+	t.Run("cgroup v2 in a cgroup namespace", func(t *testing.T) {
+		mountpoint := fakeCgroup(t, "0::/ecs/task/container\n")
+		writeCgroupFile(t, mountpoint, "memory.events", "oom_kill 0\n")
+
+		cgroup, ok := findMemoryCgroup()
+		require.True(t, ok)
+		assert.Equal(t, memoryCgroup{dir: mountpoint, v2: true}, cgroup)
+	})
+
+	t.Run("cgroup v1", func(t *testing.T) {
+		mountpoint := fakeCgroup(t, "12:pids:/docker/abc\n4:memory:/docker/abc\n1:cpu,cpuacct:/docker/abc\n0::/\n")
+		dir := filepath.Join(mountpoint, "memory/docker/abc")
+		writeCgroupFile(t, dir, "memory.oom_control", "oom_kill_disable 0\nunder_oom 0\noom_kill 1\n")
+		writeCgroupFile(t, dir, "memory.limit_in_bytes", "9223372036854771712\n")
+
+		cgroup, ok := findMemoryCgroup()
+		require.True(t, ok)
+		assert.Equal(t, memoryCgroup{dir: dir}, cgroup)
+		kills, ok := cgroup.oomKills()
+		assert.True(t, ok)
+		assert.Equal(t, int64(1), kills)
+		assert.Equal(t, int64(0), cgroup.limit())
+	})
+
+	t.Run("no memory cgroup", func(t *testing.T) {
+		fakeCgroup(t, "0::/\n")
+		_, ok := findMemoryCgroup()
+		assert.False(t, ok)
+		assert.Nil(t, watchForOOMKills())
+		assert.False(t, watchForOOMKills().killed())
+	})
+}
+
+func TestOOMWatch(t *testing.T) {
+	mountpoint := fakeCgroup(t, "0::/\n")
+	writeCgroupFile(t, mountpoint, "memory.events", "oom 1\noom_kill 1\n")
+
+	watch := watchForOOMKills()
+	require.NotNil(t, watch)
+	assert.False(t, watch.killed())
+	writeCgroupFile(t, mountpoint, "memory.events", "oom 2\noom_kill 2\n")
+	assert.True(t, watch.killed())
+}
+
+func TestTaskFailureCommandOOMKilled(t *testing.T) {
+	mountpoint := fakeCgroup(t, "0::/\n")
+	writeCgroupFile(t, mountpoint, "memory.events", "low 0\nhigh 0\nmax 0\noom 0\noom_kill 0\n")
+	writeCgroupFile(t, mountpoint, "memory.max", "536870912\n")
+
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+	mockSFN := mocks.NewMockSFNAPI(controller)
+	mockSFN.EXPECT().SendTaskFailure(gomock.Any(), gomock.Any())
+	taskRunner := NewTaskRunner(path.Join(testScriptsDir, "oom_kill.sh"), mockSFN, mockTaskToken, "")
+	err := taskRunner.Process(context.Background(), []string{filepath.Join(mountpoint, "memory.events")}, emptyTaskInput)
+
+	oomKilled, ok := err.(TaskFailureCommandOOMKilled)
+	require.True(t, ok, "got %v", err)
+	assert.Equal(t, "sfncli.CommandOOMKilled", oomKilled.ErrorName())
+	assert.Equal(t, int64(536870912), oomKilled.limit)
+	assert.True(t, oomKilled.peakRSS > 0)
+	assert.Equal(t, "allocating too much", oomKilled.stderr)
+	assert.True(t, strings.HasPrefix(oomKilled.ErrorCause(), "command was killed for running out of memory (limit 536870912 bytes, peak RSS "))
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// S3API defines the methods of the S3 client used to offload payloads
+type S3API interface {
+	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+}
+
+// payloadPointerField is the field of a pointer envelope that holds the location of the payload:
+//
+//	{"_EXECUTION_NAME": "...", "_SFNCLI_PAYLOAD": {"bucket": "...", "key": "...", "size": 1234, "sha256": "..."}}
+const payloadPointerField = "_SFNCLI_PAYLOAD"
+
+// maxPayloadLength is the largest payload that can be offloaded or downloaded. Payloads are held in memory
+// and parsed as JSON, so it is far below the size limit of a single S3 PutObject.
+const maxPayloadLength int64 = 64 * 1024 * 1024
+
+// payloadPointer is the location of a payload stored in S3.
+type payloadPointer struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// payloadStore uploads payloads too large for Step Functions to a bucket, and downloads them back.
+type payloadStore struct {
+	s3api  S3API
+	bucket string
+	prefix string
+}
+
+// upload stores a payload under <prefix><execution name>/<sha256>.json and returns a pointer to it.
+func (p *payloadStore) upload(ctx context.Context, executionName string, payload []byte) (payloadPointer, error) {
+	sum := sha256.Sum256(payload)
+	pointer := payloadPointer{
+		Bucket: p.bucket,
+		Key:    p.prefix + path.Join(executionName, hex.EncodeToString(sum[:])+".json"),
+		Size:   int64(len(payload)),
+		SHA256: hex.EncodeToString(sum[:]),
+	}
+	_, err := p.s3api.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:        aws.String(pointer.Bucket),
+		Key:           aws.String(pointer.Key),
+		Body:          bytes.NewReader(payload),
+		ContentLength: aws.Int64(pointer.Size),
+		ContentType:   aws.String("application/json"),
+	})
+	if err != nil {
+		return payloadPointer{}, fmt.Errorf("error uploading payload to s3://%s/%s: %s", pointer.Bucket, pointer.Key, err)
+	}
+	return pointer, nil
+}
+
+// download fetches the payload a pointer refers to, and checks it against the size and checksum in the pointer.
+func (p *payloadStore) download(ctx context.Context, pointer payloadPointer) ([]byte, error) {
+	if pointer.Size > maxPayloadLength {
+		return nil, fmt.Errorf("payload s3://%s/%s is %d bytes, more than the %d bytes sfncli downloads", pointer.Bucket, pointer.Key, pointer.Size, maxPayloadLength)
+	}
+	out, err := p.s3api.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(pointer.Bucket),
+		Key:    aws.String(pointer.Key),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error downloading payload from s3://%s/%s: %s", pointer.Bucket, pointer.Key, err)
+	}
+	defer out.Body.Close()
+	payload, err := io.ReadAll(io.LimitReader(out.Body, pointer.Size+1))
+	if err != nil {
+		return nil, fmt.Errorf("error downloading payload from s3://%s/%s: %s", pointer.Bucket, pointer.Key, err)
+	}
+	if int64(len(payload)) != pointer.Size {
+		return nil, fmt.Errorf("payload s3://%s/%s is not %d bytes", pointer.Bucket, pointer.Key, pointer.Size)
+	}
+	if sum := sha256.Sum256(payload); hex.EncodeToString(sum[:]) != pointer.SHA256 {
+		return nil, fmt.Errorf("payload s3://%s/%s does not match its sha256 %s", pointer.Bucket, pointer.Key, pointer.SHA256)
+	}
+	return payload, nil
+}
+
+// parsePayloadPointer returns the pointer in a task input, if the input is a pointer envelope.
+func parsePayloadPointer(taskInput map[string]interface{}) (payloadPointer, bool, error) {
+	field, ok := taskInput[payloadPointerField]
+	if !ok {
+		return payloadPointer{}, false, nil
+	}
+	// round trip through JSON to validate the pointer
+	b, err := json.Marshal(field)
+	if err != nil {
+		return payloadPointer{}, true, err
+	}
+	var pointer payloadPointer
+	if err := json.Unmarshal(b, &pointer); err != nil {
+		return payloadPointer{}, true, fmt.Errorf("invalid %s: %s", payloadPointerField, err)
+	}
+	if pointer.Bucket == "" || pointer.Key == "" || pointer.SHA256 == "" {
+		return payloadPointer{}, true, fmt.Errorf("invalid %s: bucket, key and sha256 are required", payloadPointerField)
+	}
+	return pointer, true, nil
+}
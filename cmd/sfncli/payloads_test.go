@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	"github.com/Clever/sfncli/s3fake"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newFakePayloadStore(fake *s3fake.Server) *payloadStore {
+	return &payloadStore{
+		s3api: s3.New(s3.Options{
+			Region:       "us-west-2",
+			BaseEndpoint: aws.String(fake.URL()),
+			UsePathStyle: true,
+			Credentials:  aws.AnonymousCredentials{},
+		}),
+		bucket: "payloads",
+		prefix: "sfncli/",
+	}
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestPayloadStoreRoundTrip(t *testing.T) {
+	fake := s3fake.NewServer()
+	defer fake.Close()
+	store := newFakePayloadStore(fake)
+	payload := []byte(`{"_EXECUTION_NAME":"fake-WFM-uuid","big":"output"}`)
+
+	pointer, err := store.upload(context.Background(), "fake-WFM-uuid", payload)
+	require.NoError(t, err)
+	assert.Equal(t, payloadPointer{
+		Bucket: "payloads",
+		Key:    "sfncli/fake-WFM-uuid/" + sha256Hex(payload) + ".json",
+		Size:   int64(len(payload)),
+		SHA256: sha256Hex(payload),
+	}, pointer)
+	stored, ok := fake.Object(pointer.Bucket, pointer.Key)
+	require.True(t, ok)
+	assert.Equal(t, payload, stored)
+
+	downloaded, err := store.download(context.Background(), pointer)
+	require.NoError(t, err)
+	assert.Equal(t, payload, downloaded)
+}
+
+func TestPayloadStoreDownloadChecksPointer(t *testing.T) {
+	fake := s3fake.NewServer()
+	defer fake.Close()
+	store := newFakePayloadStore(fake)
+	payload := []byte(`{"a":"b"}`)
+	fake.PutObject("payloads", "object.json", payload)
+
+	_, err := store.download(context.Background(), payloadPointer{Bucket: "payloads", Key: "object.json", Size: int64(len(payload)), SHA256: sha256Hex(payload)})
+	assert.NoError(t, err)
+	_, err = store.download(context.Background(), payloadPointer{Bucket: "payloads", Key: "object.json", Size: 3, SHA256: sha256Hex(payload)})
+	assert.Error(t, err)
+	_, err = store.download(context.Background(), payloadPointer{Bucket: "payloads", Key: "object.json", Size: int64(len(payload)), SHA256: sha256Hex([]byte("other"))})
+	assert.Error(t, err)
+	_, err = store.download(context.Background(), payloadPointer{Bucket: "payloads", Key: "missing.json", Size: 1, SHA256: "abc"})
+	assert.Error(t, err)
+	_, err = store.download(context.Background(), payloadPointer{Bucket: "payloads", Key: "object.json", Size: maxPayloadLength + 1, SHA256: sha256Hex(payload)})
+	assert.EqualError(t, err, "payload s3://payloads/object.json is 67108865 bytes, more than the 67108864 bytes sfncli downloads")
+}
+
+func TestParsePayloadPointer(t *testing.T) {
+	_, isPointer, err := parsePayloadPointer(map[string]interface{}{"_EXECUTION_NAME": "name"})
+	assert.False(t, isPointer)
+	assert.NoError(t, err)
+
+	pointer, isPointer, err := parsePayloadPointer(map[string]interface{}{
+		"_EXECUTION_NAME": "name",
+		"_SFNCLI_PAYLOAD": map[string]interface{}{"bucket": "b", "key": "k", "size": 10.0, "sha256": "abc"},
+	})
+	assert.True(t, isPointer)
+	assert.NoError(t, err)
+	assert.Equal(t, payloadPointer{Bucket: "b", Key: "k", Size: 10, SHA256: "abc"}, pointer)
+
+	_, isPointer, err = parsePayloadPointer(map[string]interface{}{"_SFNCLI_PAYLOAD": "s3://b/k"})
+	assert.True(t, isPointer)
+	assert.Error(t, err)
+
+	_, isPointer, err = parsePayloadPointer(map[string]interface{}{"_SFNCLI_PAYLOAD": map[string]interface{}{"bucket": "b"}})
+	assert.True(t, isPointer)
+	assert.Error(t, err)
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Clever/kayvee-go/v7/logger"
+	"github.com/armon/circbuf"
+)
+
+// worker modes
+const (
+	// workerModeExec starts the command once for every task.
+	workerModeExec = "exec"
+	// workerModePersistent starts the command once and sends it one task at a time as JSON lines on its stdin.
+	workerModePersistent = "persistent"
+)
+
+// persistentRequest is the line sent on the stdin of a persistent worker for every task.
+type persistentRequest struct {
+	ExecutionName string          `json:"execution_name"`
+	Input         json.RawMessage `json:"input"`
+	WorkDir       string          `json:"work_dir,omitempty"`
+}
+
+// persistentResponseField is the field of the line a persistent worker writes to its stdout when it is
+// done with a task:
+//
+//	{"_sfncli_response": {"output": {...}}}
+//	{"_sfncli_response": {"error": "custom.error_name", "cause": "..."}}
+//
+// Other lines on stdout, including JSON log lines, are passed through as logs.
+const persistentResponseField = "_sfncli_response"
+
+// persistentResponse is the value of persistentResponseField.
+type persistentResponse struct {
+	Output json.RawMessage `json:"output"`
+	Error  string          `json:"error"`
+	Cause  string          `json:"cause"`
+}
+
+// persistentWorker is a long-lived command that processes tasks sent to it on stdin.
+// It is started when it is first needed, and again after it exits.
+type persistentWorker struct {
+	cmd    string
+	args   []string
+	logger logger.KayveeLogger
+
+	execCmd   *exec.Cmd
+	stdin     io.WriteCloser
+	stderrbuf *lockedBuffer
+	responses chan persistentResponse
+	exited    chan struct{} // closed once the command exited and exitErr is set
+	exitErr   error
+}
+
+func newPersistentWorker(cmd string, args []string, stderrBufferSize int) *persistentWorker {
+	stderrbuf, _ := circbuf.NewBuffer(int64(stderrBufferSize))
+	return &persistentWorker{
+		cmd:       cmd,
+		args:      args,
+		logger:    logger.New("sfncli"),
+		stderrbuf: &lockedBuffer{buf: stderrbuf},
+	}
+}
+
+// running is true if the command was started and has not exited.
+func (w *persistentWorker) running() bool {
+	if w.exited == nil {
+		return false
+	}
+	select {
+	case <-w.exited:
+		return false
+	default:
+		return true
+	}
+}
+
+func (w *persistentWorker) start() error {
+	w.execCmd = exec.Command(w.cmd, w.args...)
+	w.execCmd.Env = os.Environ()
+	w.execCmd.Stderr = io.MultiWriter(os.Stderr, w.stderrbuf)
+	stdin, err := w.execCmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := w.execCmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	w.execCmd.SysProcAttr = processGroupAttr()
+	if err := w.execCmd.Start(); err != nil {
+		return err
+	}
+	w.stdin = stdin
+	w.responses = make(chan persistentResponse, 1)
+	w.exited = make(chan struct{})
+	go func() {
+		// all of stdout has to be read before calling Wait
+		w.readResponses(stdout)
+		w.exitErr = w.execCmd.Wait()
+		stopStragglers(w.execCmd.Process.Pid, w.logger)
+		close(w.exited)
+	}()
+	w.logger.InfoD("persistent-worker-start", logger.M{"cmd": w.cmd, "pid": w.execCmd.Process.Pid})
+	return nil
+}
+
+func (w *persistentWorker) readResponses(stdout io.Reader) {
+	reader := bufio.NewReader(stdout)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			if response, ok := parsePersistentResponse(line); ok {
+				select {
+				case w.responses <- response:
+				default:
+					w.logger.Warn("persistent-worker-unexpected-response")
+				}
+			} else {
+				os.Stdout.Write(line)
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// parsePersistentResponse returns the response on a line of stdout, if it is one.
+func parsePersistentResponse(line []byte) (persistentResponse, bool) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(line, &fields); err != nil {
+		return persistentResponse{}, false
+	}
+	field, ok := fields[persistentResponseField]
+	if !ok {
+		return persistentResponse{}, false
+	}
+	var response persistentResponse
+	if err := json.Unmarshal(field, &response); err != nil {
+		return persistentResponse{}, false
+	}
+	return response, true
+}
+
+// send writes a task to the stdin of the command, after discarding anything left over from the previous task.
+func (w *persistentWorker) send(request persistentRequest) error {
+	w.stderrbuf.Reset()
+	select {
+	case <-w.responses:
+	default:
+	}
+	line, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	_, err = w.stdin.Write(append(line, '\n'))
+	return err
+}
+
+// stop closes the stdin of the command, sends it SIGTERM and, if it is still running after
+// the grace period, SIGKILL. Like stopCommand, but closes stdin first and waits for the command to exit.
+func (w *persistentWorker) stop(gracePeriod time.Duration) {
+	if !w.running() {
+		return
+	}
+	w.stdin.Close()
+	signalProcess(w.execCmd.Process.Pid, os.Signal(syscall.SIGTERM))
+	select {
+	case <-w.exited:
+	case <-time.After(gracePeriod):
+		signalProcess(w.execCmd.Process.Pid, os.Signal(syscall.SIGKILL))
+		<-w.exited
+	}
+}
+
+// processPersistent sends the task to the persistent worker, starting it if it is not running, and
+// reports its response. If the worker exits before responding, the task fails the same way it would
+// have if the command had been run just for this task, and the worker is restarted for the next task.
+func (t *TaskRunner) processPersistent(ctx context.Context, executionName string, marshaledInput []byte, timeout time.Duration) error {
+	w := t.persistentWorker
+	if !w.running() {
+		if err := w.start(); err != nil {
+			return t.sendTaskFailure(t.commandFailure(err, "", TaskFailureCustom{}))
+		}
+	}
+
+	request := persistentRequest{ExecutionName: executionName, Input: marshaledInput}
+	if t.workDirectory != "" {
+		tmpDir, err := ioutil.TempDir(t.workDirectory, "")
+		if err != nil {
+			return t.sendTaskFailure(TaskFailureUnknown{fmt.Errorf("failed to create tmp dir: %s", err)})
+		}
+		defer os.RemoveAll(tmpDir)
+		request.WorkDir = tmpDir
+	}
+
+	// forward signals to the worker, handle SIGTERM. Like in waitForCommand, the goroutine doing so is
+	// done before what it recorded is read.
+	signalsCtx, signalsCtxCancel := context.WithCancel(context.Background())
+	var forwarding sync.WaitGroup
+	stopForwarding := func() {
+		signalsCtxCancel()
+		forwarding.Wait()
+	}
+	defer stopForwarding()
+	pid, exited := w.execCmd.Process.Pid, w.exited
+	forwarding.Add(1)
+	go func() {
+		defer forwarding.Done()
+		t.forwardSignalsToPersistentWorker(signalsCtx, pid, exited)
+	}()
+
+	if err := w.send(request); err != nil {
+		// the worker exited, which is handled below
+		t.logger.ErrorD("persistent-worker-send-error", logger.M{"error": err.Error()})
+	}
+
+	t.oom = watchForOOMKills()
+	var timedOut <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timedOut = timer.C
+	}
+
+	start := time.Now()
+	t.started = start
+	t.stderrbuf = w.stderrbuf
+	select {
+	case response := <-w.responses:
+		stopForwarding()
+		return t.sendPersistentResponse(ctx, executionName, response)
+	case <-w.exited:
+	case <-timedOut:
+		t.logger.ErrorD("command-timed-out", logger.M{"timeout": timeout.String()})
+		// the worker is restarted for the next task
+		w.stop(canceledTaskGracePeriod)
+		stopForwarding()
+		stderr := strings.TrimSpace(w.stderrbuf.String())
+		return t.sendTaskFailure(TaskFailureCommandTimedOut{timeout: timeout, elapsed: time.Since(start), stderr: stderr})
+	case <-ctx.Done():
+		// the worker is stuck on a task that was canceled, most likely because SFN timed it out
+		w.stop(canceledTaskGracePeriod)
+	}
+	stopForwarding()
+
+	// the worker may have responded right before exiting
+	select {
+	case response := <-w.responses:
+		return t.sendPersistentResponse(ctx, executionName, response)
+	default:
+	}
+	stderr := strings.TrimSpace(w.stderrbuf.String())
+	if w.exitErr == nil {
+		return t.sendTaskFailure(TaskFailureUnknown{errors.New("persistent worker exited without responding")})
+	}
+	return t.sendTaskFailure(t.commandFailure(w.exitErr, stderr, TaskFailureCustom{}))
+}
+
+func (t *TaskRunner) sendPersistentResponse(ctx context.Context, executionName string, response persistentResponse) error {
+	if response.Error != "" {
+		return t.sendTaskFailure(TaskFailureCustom{Err: response.Error, Cause: response.Cause})
+	}
+	return t.sendTaskOutput(ctx, executionName, strings.TrimSpace(string(response.Output)), false)
+}
+
+// forwardSignalsToPersistentWorker is handleSignals for a persistent worker. The worker outlives the
+// task, so unlike handleSignals it leaves the worker running when ctx is done.
+func (t *TaskRunner) forwardSignalsToPersistentWorker(ctx context.Context, pid int, exited <-chan struct{}) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, t.signals.notify()...)
+	defer signal.Stop(sigChan)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-exited:
+			return
+		case <-t.terminate:
+			t.receivedSigterm = true
+			stopCommand(pid, t.sigtermGracePeriod, exited)
+			return
+		case sigReceived := <-sigChan:
+			if t.drainsOn(sigReceived) {
+				continue
+			}
+			sig, ok := t.signals.signalFor(sigReceived)
+			if !ok {
+				continue
+			}
+			if sig == syscall.SIGTERM {
+				t.receivedSigterm = true
+				stopCommand(pid, t.sigtermGracePeriod, exited)
+				return
+			}
+			signalProcess(pid, sig)
+		}
+	}
+}
+
+// lockedBuffer is a circbuf.Buffer that can be written to by the command while it is read and reset between tasks.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf *circbuf.Buffer
+}
+
+func (l *lockedBuffer) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.buf.Write(p)
+}
+
+func (l *lockedBuffer) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.buf.String()
+}
+
+func (l *lockedBuffer) Reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.buf.Reset()
+}
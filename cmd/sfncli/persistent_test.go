@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/Clever/sfncli/mocks"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sfn"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type persistentWorkerOutput struct {
+	ExecutionName string `json:"_EXECUTION_NAME"`
+	PID           int    `json:"pid"`
+	Count         int    `json:"count"`
+}
+
+// processWithPersistentWorker runs a task with the given action on a persistent worker,
+// and returns the output it reported to Step Functions if the action is "succeed".
+func processWithPersistentWorker(t *testing.T, ctx context.Context, worker *persistentWorker, mockSFN *mocks.MockSFNAPI, action string) (persistentWorkerOutput, error) {
+	var output persistentWorkerOutput
+	if action == "succeed" {
+		mockSFN.EXPECT().SendTaskSuccess(gomock.Any(), gomock.Any()).Do(
+			func(ctx context.Context, input *sfn.SendTaskSuccessInput, optFns ...func(*sfn.Options)) {
+				require.NoError(t, json.Unmarshal([]byte(*input.Output), &output))
+			},
+		)
+	}
+	taskRunner := NewTaskRunner(path.Join(testScriptsDir, "persistent_worker.sh"), mockSFN, mockTaskToken, "")
+	taskRunner.persistentWorker = worker
+	err := taskRunner.Process(ctx, []string{}, `{"_EXECUTION_NAME":"fake-WFM-uuid","action":"`+action+`"}`)
+	return output, err
+}
+
+func TestPersistentWorker(t *testing.T) {
+	t.Run("processes tasks in one process", func(t *testing.T) {
+		t.Parallel()
+		controller := gomock.NewController(t)
+		defer controller.Finish()
+		mockSFN := mocks.NewMockSFNAPI(controller)
+		worker := newPersistentWorker(path.Join(testScriptsDir, "persistent_worker.sh"), []string{}, defaultStderrBufferSize)
+		defer worker.stop(time.Second)
+
+		first, err := processWithPersistentWorker(t, context.Background(), worker, mockSFN, "succeed")
+		require.NoError(t, err)
+		second, err := processWithPersistentWorker(t, context.Background(), worker, mockSFN, "succeed")
+		require.NoError(t, err)
+		assert.Equal(t, persistentWorkerOutput{ExecutionName: "fake-WFM-uuid", PID: first.PID, Count: 1}, first)
+		assert.Equal(t, persistentWorkerOutput{ExecutionName: "fake-WFM-uuid", PID: first.PID, Count: 2}, second)
+	})
+
+	t.Run("reports custom errors", func(t *testing.T) {
+		t.Parallel()
+		expectedError := TaskFailureCustom{Err: "custom.error_name", Cause: "task failed"}
+		controller := gomock.NewController(t)
+		defer controller.Finish()
+		mockSFN := mocks.NewMockSFNAPI(controller)
+		mockSFN.EXPECT().SendTaskFailure(gomock.Any(), &sfn.SendTaskFailureInput{
+			Cause:     aws.String(expectedError.ErrorCause()),
+			Error:     aws.String(expectedError.ErrorName()),
+			TaskToken: aws.String(mockTaskToken),
+		})
+		worker := newPersistentWorker(path.Join(testScriptsDir, "persistent_worker.sh"), []string{}, defaultStderrBufferSize)
+		defer worker.stop(time.Second)
+
+		_, err := processWithPersistentWorker(t, context.Background(), worker, mockSFN, "fail")
+		require.Equal(t, expectedError, err)
+		assert.True(t, worker.running())
+	})
+
+	t.Run("restarts the worker after it crashes", func(t *testing.T) {
+		t.Parallel()
+		expectedError := TaskFailureCommandExitedNonzero{stderr: "crashing on task 1"}
+		controller := gomock.NewController(t)
+		defer controller.Finish()
+		mockSFN := mocks.NewMockSFNAPI(controller)
+		mockSFN.EXPECT().SendTaskFailure(gomock.Any(), &sfn.SendTaskFailureInput{
+			Cause:     aws.String(expectedError.ErrorCause()),
+			Error:     aws.String(expectedError.ErrorName()),
+			TaskToken: aws.String(mockTaskToken),
+		})
+		worker := newPersistentWorker(path.Join(testScriptsDir, "persistent_worker.sh"), []string{}, defaultStderrBufferSize)
+		defer worker.stop(time.Second)
+
+		_, err := processWithPersistentWorker(t, context.Background(), worker, mockSFN, "crash")
+		require.Equal(t, expectedError, err)
+		output, err := processWithPersistentWorker(t, context.Background(), worker, mockSFN, "succeed")
+		require.NoError(t, err)
+		assert.Equal(t, 1, output.Count)
+	})
+
+	t.Run("stops the worker when the task is canceled", func(t *testing.T) {
+		t.Parallel()
+		controller := gomock.NewController(t)
+		defer controller.Finish()
+		mockSFN := mocks.NewMockSFNAPI(controller)
+		mockSFN.EXPECT().SendTaskFailure(gomock.Any(), gomock.Any())
+		worker := newPersistentWorker(path.Join(testScriptsDir, "persistent_worker.sh"), []string{}, defaultStderrBufferSize)
+		defer worker.stop(time.Second)
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_, err := processWithPersistentWorker(t, ctx, worker, mockSFN, "hang")
+		require.Error(t, err)
+		assert.False(t, worker.running())
+
+		output, err := processWithPersistentWorker(t, context.Background(), worker, mockSFN, "succeed")
+		require.NoError(t, err)
+		assert.Equal(t, 1, output.Count)
+	})
+
+	t.Run("stops the worker when the task times out", func(t *testing.T) {
+		t.Parallel()
+		controller := gomock.NewController(t)
+		defer controller.Finish()
+		mockSFN := mocks.NewMockSFNAPI(controller)
+		mockSFN.EXPECT().SendTaskFailure(gomock.Any(), gomock.Any())
+		worker := newPersistentWorker(path.Join(testScriptsDir, "persistent_worker.sh"), []string{}, defaultStderrBufferSize)
+		defer worker.stop(time.Second)
+
+		taskRunner := NewTaskRunner(path.Join(testScriptsDir, "persistent_worker.sh"), mockSFN, mockTaskToken, "")
+		taskRunner.persistentWorker = worker
+		err := taskRunner.Process(context.Background(), []string{}, `{"_EXECUTION_NAME":"fake-WFM-uuid","action":"hang","_SFNCLI_TIMEOUT_SECONDS":1}`)
+		var timedOut TaskFailureCommandTimedOut
+		require.ErrorAs(t, err, &timedOut)
+		assert.Equal(t, time.Second, timedOut.timeout)
+		assert.False(t, worker.running())
+	})
+
+	t.Run("terminates the worker when sfncli drains", func(t *testing.T) {
+		t.Parallel()
+		controller := gomock.NewController(t)
+		defer controller.Finish()
+		mockSFN := mocks.NewMockSFNAPI(controller)
+		mockSFN.EXPECT().SendTaskFailure(gomock.Any(), gomock.Any())
+		worker := newPersistentWorker(path.Join(testScriptsDir, "persistent_worker.sh"), []string{}, defaultStderrBufferSize)
+		defer worker.stop(time.Second)
+
+		terminate := make(chan struct{})
+		taskRunner := NewTaskRunner(path.Join(testScriptsDir, "persistent_worker.sh"), mockSFN, mockTaskToken, "")
+		taskRunner.persistentWorker = worker
+		taskRunner.terminate = terminate
+		time.AfterFunc(time.Second, func() { close(terminate) })
+		err := taskRunner.Process(context.Background(), []string{}, `{"_EXECUTION_NAME":"fake-WFM-uuid","action":"hang"}`)
+		require.IsType(t, TaskFailureCommandTerminated{}, err)
+		assert.False(t, worker.running())
+	})
+
+	t.Run("fails when the command does not exist", func(t *testing.T) {
+		t.Parallel()
+		cmd := path.Join(testScriptsDir, "doesntexist.sh")
+		expectedError := TaskFailureCommandNotFound{path: cmd}
+		controller := gomock.NewController(t)
+		defer controller.Finish()
+		mockSFN := mocks.NewMockSFNAPI(controller)
+		mockSFN.EXPECT().SendTaskFailure(gomock.Any(), &sfn.SendTaskFailureInput{
+			Cause:     aws.String(expectedError.ErrorCause()),
+			Error:     aws.String(expectedError.ErrorName()),
+			TaskToken: aws.String(mockTaskToken),
+		})
+		worker := newPersistentWorker(cmd, []string{}, defaultStderrBufferSize)
+
+		_, err := processWithPersistentWorker(t, context.Background(), worker, mockSFN, "none")
+		require.Equal(t, expectedError, err)
+	})
+}
+
+func TestParsePersistentResponse(t *testing.T) {
+	response, ok := parsePersistentResponse([]byte(`{"_sfncli_response": {"output": {"a": 1}}}` + "\n"))
+	assert.True(t, ok)
+	assert.JSONEq(t, `{"a": 1}`, string(response.Output))
+
+	response, ok = parsePersistentResponse([]byte(`{"_sfncli_response": {"error": "custom.error_name", "cause": "bar"}}`))
+	assert.True(t, ok)
+	assert.Equal(t, persistentResponse{Error: "custom.error_name", Cause: "bar"}, response)
+
+	_, ok = parsePersistentResponse([]byte("a log line\n"))
+	assert.False(t, ok)
+	_, ok = parsePersistentResponse([]byte(`{"level": "info", "msg": "a structured log line"}`))
+	assert.False(t, ok)
+	_, ok = parsePersistentResponse([]byte(`{"level": "error", "error": "a structured log line"}`))
+	assert.False(t, ok)
+	_, ok = parsePersistentResponse([]byte(`{"output": {"a": 1}}`))
+	assert.False(t, ok)
+}
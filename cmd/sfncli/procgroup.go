@@ -0,0 +1,107 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Clever/kayvee-go/v7/logger"
+)
+
+// Commands run in their own process group, whose ID is the PID of the command, so that signals reach
+// the processes they start too, e.g. the children of a shell script.
+
+const (
+	// stragglerWaitDelay is how long to wait for the stdout and stderr of a command to close after it
+	// exits. Processes it left running may hold them open.
+	stragglerWaitDelay = time.Second
+	// stragglerKillTimeout is how long to wait for the processes a command left running to die after SIGKILL.
+	stragglerKillTimeout = 5 * time.Second
+)
+
+// processGroupAttr starts a command in a new process group.
+func processGroupAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setpgid: true}
+}
+
+// signalProcess signals the process group of the command with the given PID.
+func signalProcess(pid int, signal os.Signal) {
+	sig, ok := signal.(syscall.Signal)
+	if !ok {
+		proc := os.Process{Pid: pid}
+		proc.Signal(signal)
+		return
+	}
+	syscall.Kill(-pid, sig)
+}
+
+// stopStragglers kills the processes a command left running in its process group after it exited,
+// so that none of them outlive the task, e.g. holding WORK_DIR open. pgid is the PID of the command.
+func stopStragglers(pgid int, log logger.KayveeLogger) {
+	reaped := reapProcessGroup(pgid)
+	if syscall.Kill(-pgid, 0) != nil {
+		if len(reaped) > 0 {
+			log.WarnD("command-stragglers-reaped", logger.M{"pids": reaped})
+		}
+		return // nothing is left in the group
+	}
+
+	// the group may only hold zombies that another parent reaps, which are not worth a warning
+	if members := processGroupMembers(pgid); len(members) > 0 {
+		log.WarnD("command-stragglers", logger.M{"pids": members})
+	}
+	syscall.Kill(-pgid, syscall.SIGKILL)
+	deadline := time.Now().Add(stragglerKillTimeout)
+	for time.Now().Before(deadline) {
+		reaped = append(reaped, reapProcessGroup(pgid)...)
+		if syscall.Kill(-pgid, 0) != nil {
+			if len(reaped) > 0 {
+				log.WarnD("command-stragglers-reaped", logger.M{"pids": reaped})
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if members := processGroupMembers(pgid); len(members) > 0 {
+		log.ErrorD("command-stragglers-alive", logger.M{"pids": members})
+	}
+}
+
+// reapProcessGroup waits for the processes of a process group that exited and are children of sfncli,
+// which they become when sfncli is PID 1 of a container. It returns their PIDs.
+func reapProcessGroup(pgid int) []int {
+	reaped := []int{}
+	for {
+		var status syscall.WaitStatus
+		pid, err := syscall.Wait4(-pgid, &status, syscall.WNOHANG, nil)
+		if err != nil || pid <= 0 {
+			return reaped
+		}
+		reaped = append(reaped, pid)
+	}
+}
+
+// processGroupMembers returns the PIDs of the live processes of a process group, as far as /proc tells.
+func processGroupMembers(pgid int) []int {
+	pids := []int{}
+	stats, _ := filepath.Glob("/proc/[0-9]*/stat")
+	for _, stat := range stats {
+		contents, err := os.ReadFile(stat)
+		if err != nil {
+			continue // the process exited
+		}
+		// the fields after the parenthesized command name are: state ppid pgrp ...
+		s := string(contents)
+		fields := strings.Fields(s[strings.LastIndex(s, ")")+1:])
+		if len(fields) < 3 || fields[0] == "Z" || fields[2] != strconv.Itoa(pgid) {
+			continue
+		}
+		if pid, err := strconv.Atoi(filepath.Base(filepath.Dir(stat))); err == nil {
+			pids = append(pids, pid)
+		}
+	}
+	return pids
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"os/exec"
+	"path"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/Clever/kayvee-go/v7/logger"
+	"github.com/Clever/sfncli/mocks"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignalProcessSignalsProcessGroup(t *testing.T) {
+	t.Parallel()
+	cmd := exec.Command(path.Join(testScriptsDir, "spawn_grandchild.sh"), "wait")
+	cmd.SysProcAttr = processGroupAttr()
+	require.NoError(t, cmd.Start())
+	pgid := cmd.Process.Pid
+	require.Eventually(t, func() bool { return len(processGroupMembers(pgid)) == 2 }, 5*time.Second, 10*time.Millisecond)
+
+	signalProcess(pgid, syscall.SIGTERM)
+	cmd.Wait()
+	// the grandchild got the signal too
+	assert.Eventually(t, func() bool { return len(processGroupMembers(pgid)) == 0 }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestStopStragglers(t *testing.T) {
+	t.Parallel()
+	cmd := exec.Command(path.Join(testScriptsDir, "spawn_grandchild.sh"), "{}")
+	cmd.SysProcAttr = processGroupAttr()
+	require.NoError(t, cmd.Start())
+	pgid := cmd.Process.Pid
+	require.NoError(t, cmd.Wait())
+	require.NotEmpty(t, processGroupMembers(pgid))
+
+	stopStragglers(pgid, logger.New("sfncli"))
+	assert.Empty(t, processGroupMembers(pgid))
+}
+
+func TestTaskStopsStragglers(t *testing.T) {
+	t.Parallel()
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+	mockSFN := mocks.NewMockSFNAPI(controller)
+	mockSFN.EXPECT().SendTaskSuccess(gomock.Any(), gomock.Any())
+	taskRunner := NewTaskRunner(path.Join(testScriptsDir, "spawn_grandchild.sh"), mockSFN, mockTaskToken, "")
+
+	start := time.Now()
+	// the grandchild holds stdout open, but the task does not wait for it
+	require.NoError(t, taskRunner.Process(context.Background(), []string{}, emptyTaskInput))
+	assert.True(t, time.Since(start) < 10*time.Second)
+	assert.Empty(t, processGroupMembers(taskRunner.execCmd.Process.Pid))
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sfn"
+)
+
+// exit codes of `sfncli run`. A failed task exits with the code of its failure, see exitCodeForTask.
+const (
+	runExitSuccess = exitCodeSuccess
+	runExitUsage   = 2
+)
+
+const localTaskToken = "sfncli-run-local-task-token"
+
+// runLocal implements `sfncli run`: it processes a single task read from a local JSON file,
+// without talking to AWS. The task goes through the same TaskRunner as tasks from Step Functions,
+// and the result that would have been sent to Step Functions is printed to out.
+func runLocal(args []string, out io.Writer) int {
+	fs := flag.NewFlagSet("run", flag.ContinueOnError)
+	cmd := fs.String("cmd", "", "The command to run to process the task.")
+	httpEndpoint := fs.String("http-endpoint", "", "POST the input of the task to this URL instead of running a command. Alternative to cmd.")
+	httpTimeout := fs.Duration("http-timeout", defaultHTTPTimeout, "How long to wait for a response from http-endpoint.")
+	inputFile := fs.String("input", "", "A file containing the JSON task input. Use - to read it from stdin.")
+	workDirectory := fs.String("workdirectory", "", "Create the specified directory pass the path using the environment variable WORK_DIR to the cmd processing the task. Default is to not create the path.")
+	inputMode := fs.String("input-mode", inputModeArgv, "How the task input is passed to the command. 'argv' appends it as the last argument. 'stdin' writes it to the command's stdin. 'file' writes it to the file at SFNCLI_INPUT_FILE.")
+	outputMode := fs.String("output-mode", outputModeStdout, "Where the task output is read from. 'stdout' uses the last line of the command's stdout. 'file' uses the whole file at SFNCLI_OUTPUT_FILE.")
+	causeFormat := fs.String("cause-format", causeFormatText, "How the cause of a task failure is reported. 'text' reports it as is. 'json' reports a JSON document with the error name, cause and what is known about the command.")
+	errorEnvelope := fs.Bool("error-envelope", false, "Fail the task when its output has a _sfncli_error field, even if the command exited 0.")
+	stdoutBufferSize := fs.Int("stdout-buffer-size", defaultStdoutBufferSize, "How many bytes of the end of the command's stdout are kept to find the task output.")
+	stderrBufferSize := fs.Int("stderr-buffer-size", defaultStderrBufferSize, "How many bytes of the end of the command's stderr are kept to use as the cause of a task failure.")
+	taskTimeout := fs.Duration("task-timeout", 0, "Stop the command and fail the task with sfncli.CommandTimedOut if it runs longer than this. Default is no timeout.")
+	var exitCodeRules exitCodeErrors
+	fs.Var(&exitCodeRules, "exit-code-error", "Fail the task with an error name when the command exits with an exit code, as codes=name[:cause]. May be repeated.")
+	var stderrRules stderrErrors
+	fs.Var(&stderrRules, "stderr-error", "Fail the task with an error name when the stderr of a command that exits nonzero matches a regular expression, as name=regexp. May be repeated.")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: sfncli run -cmd <cmd> -input <file> [args...]")
+		fmt.Fprintln(fs.Output(), "       sfncli run -http-endpoint <url> -input <file>")
+		fmt.Fprintln(fs.Output(), "Runs a single task locally and prints the output or error it would send to AWS Step Functions.")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return runExitUsage
+	}
+
+	if (*cmd == "") == (*httpEndpoint == "") {
+		fmt.Fprintln(fs.Output(), "one of cmd or http-endpoint is required")
+		return runExitUsage
+	}
+	*cmd = os.ExpandEnv(*cmd)
+	*httpEndpoint = os.ExpandEnv(*httpEndpoint)
+	if err := validateEndpoint("http-endpoint", *httpEndpoint); err != nil {
+		fmt.Fprintln(fs.Output(), err)
+		return runExitUsage
+	}
+	if *httpTimeout <= 0 {
+		fmt.Fprintln(fs.Output(), "http-timeout must be positive")
+		return runExitUsage
+	}
+
+	if *taskTimeout < 0 {
+		fmt.Fprintln(fs.Output(), "task-timeout cannot be negative")
+		return runExitUsage
+	}
+
+	if *inputFile == "" {
+		fmt.Fprintln(fs.Output(), "input is required")
+		return runExitUsage
+	}
+	var input []byte
+	var err error
+	if *inputFile == "-" {
+		input, err = io.ReadAll(os.Stdin)
+	} else {
+		input, err = os.ReadFile(*inputFile)
+	}
+	if err != nil {
+		fmt.Fprintf(fs.Output(), "error reading input: %s\n", err)
+		return runExitUsage
+	}
+
+	if *workDirectory != "" {
+		if err := validateWorkDirectory(*workDirectory); err != nil {
+			fmt.Fprintln(fs.Output(), err)
+			return runExitUsage
+		}
+	}
+
+	if err := validateInputMode(*inputMode); err != nil {
+		fmt.Fprintln(fs.Output(), err)
+		return runExitUsage
+	}
+
+	if err := validateOutputMode(*outputMode); err != nil {
+		fmt.Fprintln(fs.Output(), err)
+		return runExitUsage
+	}
+
+	if err := validateCauseFormat(*causeFormat); err != nil {
+		fmt.Fprintln(fs.Output(), err)
+		return runExitUsage
+	}
+
+	if err := validateBufferSize("stdout-buffer-size", *stdoutBufferSize, maxTaskOutputLength); err != nil {
+		fmt.Fprintln(fs.Output(), err)
+		return runExitUsage
+	}
+	if err := validateBufferSize("stderr-buffer-size", *stderrBufferSize, maxTaskFailureCauseLength); err != nil {
+		fmt.Fprintln(fs.Output(), err)
+		return runExitUsage
+	}
+
+	sfnapi := &localSFN{out: out}
+	taskRunner := NewTaskRunner(*cmd, sfnapi, localTaskToken, *workDirectory)
+	taskRunner.inputMode = *inputMode
+	taskRunner.outputMode = *outputMode
+	taskRunner.stdoutBufferSize = *stdoutBufferSize
+	taskRunner.stderrBufferSize = *stderrBufferSize
+	taskRunner.taskTimeout = *taskTimeout
+	taskRunner.causeFormat = *causeFormat
+	taskRunner.errorEnvelope = *errorEnvelope
+	taskRunner.exitCodeErrors = exitCodeRules
+	taskRunner.stderrErrors = stderrRules
+	if *httpEndpoint != "" {
+		taskRunner.httpHandler = newHTTPHandler(*httpEndpoint, *httpTimeout)
+	}
+	return exitCodeForTask(taskRunner.Process(context.Background(), fs.Args(), string(input)))
+}
+
+// localSFN is an in-memory SFNAPI that prints task results instead of sending them to AWS.
+type localSFN struct {
+	out io.Writer
+}
+
+func (l *localSFN) SendTaskSuccess(ctx context.Context, params *sfn.SendTaskSuccessInput, optFns ...func(*sfn.Options)) (*sfn.SendTaskSuccessOutput, error) {
+	fmt.Fprintf(l.out, "SendTaskSuccess output: %s\n", aws.ToString(params.Output))
+	return &sfn.SendTaskSuccessOutput{}, nil
+}
+
+func (l *localSFN) SendTaskFailure(ctx context.Context, params *sfn.SendTaskFailureInput, optFns ...func(*sfn.Options)) (*sfn.SendTaskFailureOutput, error) {
+	failure, _ := json.Marshal(TaskFailureCustom{Err: aws.ToString(params.Error), Cause: aws.ToString(params.Cause)})
+	fmt.Fprintf(l.out, "SendTaskFailure: %s\n", failure)
+	return &sfn.SendTaskFailureOutput{}, nil
+}
+
+func (l *localSFN) SendTaskHeartbeat(ctx context.Context, params *sfn.SendTaskHeartbeatInput, optFns ...func(*sfn.Options)) (*sfn.SendTaskHeartbeatOutput, error) {
+	return &sfn.SendTaskHeartbeatOutput{}, nil
+}
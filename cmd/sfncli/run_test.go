@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunLocal(t *testing.T) {
+	inputFile := path.Join(t.TempDir(), "input.json")
+	require.NoError(t, os.WriteFile(inputFile, []byte(emptyTaskInput), 0600))
+
+	t.Run("prints the task output on success", func(t *testing.T) {
+		var out bytes.Buffer
+		code := runLocal([]string{"-cmd", path.Join(testScriptsDir, "stdout_parsing.sh"), "-input", inputFile}, &out)
+		assert.Equal(t, runExitSuccess, code)
+		assert.Equal(t, "SendTaskSuccess output: {\"_EXECUTION_NAME\":\"fake-WFM-uuid\",\"task\":\"output\"}\n", out.String())
+	})
+
+	t.Run("prints the error and cause on failure", func(t *testing.T) {
+		var out bytes.Buffer
+		code := runLocal([]string{
+			"-cmd", path.Join(testScriptsDir, "stderr_stdout_exitcode.sh"), "-input", inputFile,
+			"stderr", `{"error": "custom.error_name", "cause": "bar"}`, "10",
+		}, &out)
+		assert.Equal(t, exitCodeCustomError, code)
+		assert.Equal(t, "SendTaskFailure: {\"error\":\"custom.error_name\",\"cause\":\"bar\"}\n", out.String())
+	})
+
+	t.Run("truncates the error and cause like Step Functions", func(t *testing.T) {
+		var out bytes.Buffer
+		longName := strings.Repeat("a", 300)
+		code := runLocal([]string{
+			"-cmd", path.Join(testScriptsDir, "stderr_stdout_exitcode.sh"), "-input", inputFile,
+			"stderr", `{"error": "` + longName + `", "cause": "bar"}`, "10",
+		}, &out)
+		assert.Equal(t, exitCodeCustomError, code)
+		truncatedName := longName[:256-len("[truncated]")] + "[truncated]"
+		assert.Equal(t, "SendTaskFailure: {\"error\":\""+truncatedName+"\",\"cause\":\"bar\"}\n", out.String())
+	})
+
+	t.Run("exits with the code of the failure", func(t *testing.T) {
+		var out bytes.Buffer
+		code := runLocal([]string{
+			"-cmd", path.Join(testScriptsDir, "stderr_stdout_exitcode.sh"), "-input", inputFile,
+			"stderr", "not json", "10",
+		}, &out)
+		assert.Equal(t, exitCodeCommandFailed, code)
+		assert.Contains(t, out.String(), TaskFailureCommandExitedNonzero{}.ErrorName())
+
+		out.Reset()
+		code = runLocal([]string{"-cmd", path.Join(testScriptsDir, "sleep_and_succeed.sh"), "-input", inputFile, "-task-timeout", "100ms", "5"}, &out)
+		assert.Equal(t, exitCodeCommandTimedOut, code)
+
+		out.Reset()
+		code = runLocal([]string{"-cmd", path.Join(testScriptsDir, "stderr_stdout_exitcode.sh"), "-input", inputFile, "stderr", "not json", "0"}, &out)
+		assert.Equal(t, exitCodeTaskOutputInvalid, code)
+	})
+
+	t.Run("validates the input like a task from Step Functions", func(t *testing.T) {
+		missingExecutionName := path.Join(t.TempDir(), "input.json")
+		require.NoError(t, os.WriteFile(missingExecutionName, []byte(`{"hello":"world"}`), 0600))
+		var out bytes.Buffer
+		code := runLocal([]string{"-cmd", "echo", "-input", missingExecutionName}, &out)
+		assert.Equal(t, exitCodeTaskInputInvalid, code)
+		assert.Contains(t, out.String(), TaskFailureTaskInputMissingExecutionName{}.ErrorName())
+	})
+
+	t.Run("requires cmd and input", func(t *testing.T) {
+		var out bytes.Buffer
+		assert.Equal(t, runExitUsage, runLocal([]string{"-input", inputFile}, &out))
+		assert.Equal(t, runExitUsage, runLocal([]string{"-cmd", "echo"}, &out))
+		assert.Equal(t, runExitUsage, runLocal([]string{"-cmd", "echo", "-input", path.Join(t.TempDir(), "missing.json")}, &out))
+		assert.Equal(t, runExitUsage, runLocal([]string{"-cmd", "echo", "-http-endpoint", "http://localhost:8080", "-input", inputFile}, &out))
+		assert.Empty(t, out.String())
+	})
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
@@ -10,7 +11,10 @@ import (
 	"os"
 	"os/exec"
 	"os/signal"
+	"path"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -27,12 +31,55 @@ type SFNAPI interface {
 	SendTaskHeartbeat(ctx context.Context, params *sfn.SendTaskHeartbeatInput, optFns ...func(*sfn.Options)) (*sfn.SendTaskHeartbeatOutput, error)
 }
 
+// canceledTaskGracePeriod is the grace period between SIGTERM and SIGKILL when sfncli itself stops a
+// command, e.g. because SFN timed out the activity or the command stalled.
+const canceledTaskGracePeriod = 5 * time.Second
+
 // stay within documented limits of SFN APIs
 const (
-	maxTaskOutputLength       = 32768
+	maxTaskOutputLength       = 262144
 	maxTaskFailureCauseLength = 32768
 )
 
+// default sizes of the buffers that capture the stdout and stderr of the command
+const (
+	defaultStdoutBufferSize = 32768
+	defaultStderrBufferSize = 32768
+)
+
+// maxStdoutBufferSize is the largest stdout buffer when outputs are offloaded to S3. Every task keeps a
+// buffer of that size, so larger outputs should be written to the output file instead.
+const maxStdoutBufferSize = 8 * 1024 * 1024
+
+// input modes
+const (
+	// inputModeArgv passes the input of the task as the last argument of the command.
+	inputModeArgv = "argv"
+	// inputModeStdin writes the input of the task to the stdin of the command.
+	inputModeStdin = "stdin"
+	// inputModeFile writes the input of the task to the file at $SFNCLI_INPUT_FILE.
+	inputModeFile = "file"
+)
+
+// inputFileEnvVar is the env var that holds the path of the task input in the file input mode.
+const inputFileEnvVar = "SFNCLI_INPUT_FILE"
+
+// output modes
+const (
+	// outputModeStdout reads the result of the command from the last line of its stdout.
+	outputModeStdout = "stdout"
+	// outputModeFile reads the result of the command from the file at $SFNCLI_OUTPUT_FILE,
+	// so stdout is only used for logs.
+	outputModeFile = "file"
+)
+
+// taskTimeoutField is a reserved field of the task input that overrides the task timeout of sfncli
+// for that task, in seconds.
+const taskTimeoutField = "_SFNCLI_TIMEOUT_SECONDS"
+
+// outputFileEnvVar is the env var that holds the path the command writes its result to in the file output mode.
+const outputFileEnvVar = "SFNCLI_OUTPUT_FILE"
+
 // TaskRunner manages resources for executing a task
 type TaskRunner struct {
 	sfnapi             SFNAPI
@@ -42,8 +89,62 @@ type TaskRunner struct {
 	execCmd            *exec.Cmd
 	receivedSigterm    bool
 	sigtermGracePeriod time.Duration
-	workDirectory      string
-	ctxCancel          context.CancelFunc
+	// signals is which signals received by sfncli are forwarded to the command
+	signals       signalPolicy
+	workDirectory string
+	ctxCancel     context.CancelFunc
+
+	// commandHeartbeatTimeout enables command-heartbeat mode when nonzero: the command must check in on
+	// its control socket at least this often, or it is stopped and the task fails with sfncli.CommandStalled
+	commandHeartbeatTimeout time.Duration
+	checkins                *checkins
+	stalled                 atomic.Bool
+
+	// taskTimeout stops the command and fails the task with sfncli.CommandTimedOut if it runs longer,
+	// unless the task input overrides it with taskTimeoutField. Zero means no timeout.
+	taskTimeout time.Duration
+	timedOut    atomic.Bool
+
+	// exitCodeErrors and stderrErrors name the failure of a command by its exit code or stderr, see classifyExit
+	exitCodeErrors exitCodeErrors
+	stderrErrors   stderrErrors
+
+	// causeFormat is how the cause of failures is reported, see causeFormatText and causeFormatJSON.
+	// The json cause format has the worker name, execution name, start time and stderr of the task.
+	causeFormat   string
+	workerName    string
+	executionName string
+	started       time.Time
+	stderrbuf     fmt.Stringer
+
+	// errorEnvelope enables the error envelope protocol: an output with errorEnvelopeField fails the
+	// task whatever the exit code of the command
+	errorEnvelope bool
+
+	// oom tells an OOM kill of the command apart from other SIGKILLs, see watchForOOMKills
+	oom *oomWatch
+
+	// inputMode is how the input of the task is passed to the command, see inputModeArgv, inputModeStdin and inputModeFile
+	inputMode string
+	// outputMode is where the result of the command is read from, see outputModeStdout and outputModeFile
+	outputMode string
+
+	// stdoutBufferSize and stderrBufferSize are how many bytes of the end of stdout and stderr are kept
+	stdoutBufferSize int
+	stderrBufferSize int
+
+	// payloads offloads outputs too large for Step Functions to S3 and resolves pointer inputs. nil disables offloading.
+	payloads *payloadStore
+
+	// persistentWorker processes the task instead of a new command, if set. See workerModePersistent.
+	persistentWorker *persistentWorker
+
+	// httpHandler processes the task instead of a command, if set.
+	httpHandler *httpHandler
+
+	// terminate is set when sfncli drains on SIGTERM (see drainer). SIGTERM and SIGINT are then not
+	// forwarded to the command; instead it is terminated like on SIGTERM once terminate is closed.
+	terminate <-chan struct{}
 }
 
 // NewTaskRunner instantiates a new TaskRunner
@@ -54,9 +155,15 @@ func NewTaskRunner(cmd string, sfnapi SFNAPI, taskToken string, workDirectory st
 		cmd:           cmd,
 		logger:        logger.New("sfncli"),
 		workDirectory: workDirectory,
-		// set the default grace period to something slightly lower than the default
-		// docker stop grace period in ECS (30s)
-		sigtermGracePeriod: 25 * time.Second,
+		checkins:      &checkins{},
+		inputMode:     inputModeArgv,
+		outputMode:    outputModeStdout,
+
+		stdoutBufferSize: defaultStdoutBufferSize,
+		stderrBufferSize: defaultStderrBufferSize,
+
+		sigtermGracePeriod: defaultSigtermGracePeriod,
+		signals:            defaultSignalPolicy,
 	}
 }
 
@@ -74,25 +181,71 @@ func (t *TaskRunner) Process(ctx context.Context, args []string, input string) e
 		return t.sendTaskFailure(TaskFailureTaskInputNotJSON{input: input})
 	}
 
+	// a pointer envelope stands in for an input that was too large for Step Functions
+	if pointer, isPointer, err := parsePayloadPointer(taskInput); isPointer {
+		if err != nil {
+			return t.sendTaskFailure(TaskFailureTaskInputPayloadUnavailable{err})
+		}
+		if t.payloads == nil {
+			return t.sendTaskFailure(TaskFailureTaskInputPayloadUnavailable{errors.New("task input is a payload pointer, but payload offloading is not enabled")})
+		}
+		payload, err := t.payloads.download(ctx, pointer)
+		if err != nil {
+			return t.sendTaskFailure(TaskFailureTaskInputPayloadUnavailable{err})
+		}
+		var payloadInput map[string]interface{}
+		if err := json.Unmarshal(payload, &payloadInput); err != nil {
+			return t.sendTaskFailure(TaskFailureTaskInputNotJSON{input: string(payload)})
+		}
+		// fields next to the pointer, e.g. _EXECUTION_NAME, take precedence over the payload
+		for key, value := range taskInput {
+			if key != payloadPointerField {
+				payloadInput[key] = value
+			}
+		}
+		taskInput = payloadInput
+		t.logger.InfoD("task-input-downloaded", logger.M{"bucket": pointer.Bucket, "key": pointer.Key, "size": pointer.Size})
+	}
+
 	// _EXECUTION_NAME is a required payload parameter that we inject into the environment
 	executionName, ok := taskInput["_EXECUTION_NAME"].(string)
 	if !ok {
 		return t.sendTaskFailure(TaskFailureTaskInputMissingExecutionName{input: input})
 	}
 	t.logger.AddContext("execution_name", executionName)
+	t.executionName = executionName
+
+	timeout, err := taskTimeoutFromInput(taskInput, t.taskTimeout)
+	if err != nil {
+		return t.sendTaskFailure(TaskFailureTaskInputInvalidTimeout{err})
+	}
+	// like the payload pointer, the timeout is for sfncli, not the command
+	delete(taskInput, taskTimeoutField)
 
 	marshaledInput, err := json.Marshal(taskInput)
 	if err != nil {
 		return t.sendTaskFailure(TaskFailureUnknown{fmt.Errorf("JSON input re-marshalling failed. This should never happen. %s", err)})
 	}
 
-	args = append(args, string(marshaledInput))
+	if t.httpHandler != nil {
+		return t.processHTTP(ctx, executionName, marshaledInput, timeout)
+	}
+	if t.persistentWorker != nil {
+		return t.processPersistent(ctx, executionName, marshaledInput, timeout)
+	}
+
+	if t.inputMode == inputModeArgv {
+		args = append(args, string(marshaledInput))
+	}
 
 	// don't use exec.CommandContext, since we want to do graceful
 	// sigterm + (grace period) + sigkill on the context finishing
 	// CommandContext does sigkill immediately.
 	t.execCmd = exec.Command(t.cmd, args...)
 	t.execCmd.Env = append(os.Environ(), "_EXECUTION_NAME="+executionName)
+	t.execCmd.SysProcAttr = processGroupAttr()
+	// don't wait for processes the command left running to close stdout and stderr, they are stopped below
+	t.execCmd.WaitDelay = stragglerWaitDelay
 
 	tmpDir := ""
 	if t.workDirectory != "" {
@@ -106,50 +259,146 @@ func (t *TaskRunner) Process(ctx context.Context, args []string, input string) e
 		defer os.RemoveAll(tmpDir)
 	}
 
+	// the input and output files live in WORK_DIR if there is one
+	filesDir := tmpDir
+	if filesDir == "" && (t.inputMode == inputModeFile || t.outputMode == outputModeFile) {
+		filesDir, err = ioutil.TempDir("", "sfncli-task-")
+		if err != nil {
+			return t.sendTaskFailure(TaskFailureUnknown{fmt.Errorf("failed to create tmp dir: %s", err)})
+		}
+		defer os.RemoveAll(filesDir)
+	}
+
+	switch t.inputMode {
+	case inputModeStdin:
+		t.execCmd.Stdin = bytes.NewReader(marshaledInput)
+	case inputModeFile:
+		inputFile := path.Join(filesDir, "sfncli-input.json")
+		if err := ioutil.WriteFile(inputFile, marshaledInput, 0600); err != nil {
+			return t.sendTaskFailure(TaskFailureUnknown{fmt.Errorf("failed to write input file: %s", err)})
+		}
+		t.execCmd.Env = append(t.execCmd.Env, fmt.Sprintf("%s=%s", inputFileEnvVar, inputFile))
+	}
+
+	outputFile := ""
+	if t.outputMode == outputModeFile {
+		outputFile = path.Join(filesDir, "sfncli-output.json")
+		t.execCmd.Env = append(t.execCmd.Env, fmt.Sprintf("%s=%s", outputFileEnvVar, outputFile))
+	}
+
+	// give the command a socket to send heartbeats and progress on
+	control, err := newControlSocket(t.checkins, t.logger)
+	if err != nil {
+		return t.sendTaskFailure(TaskFailureUnknown{fmt.Errorf("failed to create control socket: %s", err)})
+	}
+	defer control.Close()
+	t.execCmd.Env = append(t.execCmd.Env, fmt.Sprintf("%s=%s", controlSocketEnvVar, control.path))
+
 	// Write the stdout and stderr of the process to both this process' stdout and stderr
 	// and also write to a byte buffer so that we can send the result to step functions
-	stderrbuf, _ := circbuf.NewBuffer(maxTaskFailureCauseLength)
-	stdoutbuf, _ := circbuf.NewBuffer(maxTaskOutputLength)
+	stderrbuf, _ := circbuf.NewBuffer(int64(t.stderrBufferSize))
+	t.stderrbuf = stderrbuf
+	stdoutbuf, _ := circbuf.NewBuffer(int64(t.stdoutBufferSize) + 1) // room for the newline ending the output line
+	stdoutLastLine := &lastLineWriter{}
 	t.execCmd.Stderr = io.MultiWriter(os.Stderr, stderrbuf)
-	t.execCmd.Stdout = io.MultiWriter(os.Stdout, stdoutbuf)
+	t.execCmd.Stdout = io.MultiWriter(os.Stdout, stdoutbuf, stdoutLastLine)
 
-	// forward signals to the command, handle SIGTERM
-	go t.handleSignals(ctx)
-
-	if err := t.execCmd.Run(); err != nil {
-		stderr := strings.TrimSpace(stderrbuf.String())                  // remove trailing newline
-		customError, _ := parseCustomErrorFromStdout(stdoutbuf.String()) // ignore parsing errors
-		if t.receivedSigterm {
-			if customError.ErrorName() != "" {
-				return t.sendTaskFailure(customError)
-			}
-			return t.sendTaskFailure(TaskFailureCommandTerminated{stderr: stderr})
-		}
-		switch err := err.(type) {
-		case *os.PathError:
-			return t.sendTaskFailure(TaskFailureCommandNotFound{path: err.Path})
-		case *exec.ExitError:
-			if customError.ErrorName() != "" {
-				return t.sendTaskFailure(customError)
+	t.oom = watchForOOMKills()
+	start := time.Now()
+	t.started = start
+	err = t.execCmd.Start()
+	if err == nil {
+		err = t.waitForCommand(ctx, timeout)
+	}
+	if errors.Is(err, exec.ErrWaitDelay) {
+		err = nil // the command itself succeeded
+	}
+	if t.execCmd.Process != nil {
+		stopStragglers(t.execCmd.Process.Pid, t.logger)
+	}
+	if t.stalled.Load() {
+		stderr := strings.TrimSpace(stderrbuf.String())
+		return t.sendTaskFailure(TaskFailureCommandStalled{timeout: t.commandHeartbeatTimeout, stderr: stderr})
+	}
+	if t.timedOut.Load() {
+		stderr := strings.TrimSpace(stderrbuf.String())
+		return t.sendTaskFailure(TaskFailureCommandTimedOut{timeout: timeout, elapsed: time.Since(start), stderr: stderr})
+	}
+	taskOutput, taskOutputErr := readTaskOutput(stdoutbuf.String(), outputFile, t.maxOutputLength())
+	if err != nil {
+		stderr := strings.TrimSpace(stderrbuf.String()) // remove trailing newline
+		customError, _ := parseCustomError(taskOutput)  // ignore parsing errors
+		if t.errorEnvelope {
+			if envelopeError, ok := parseCustomErrorEnvelope(taskOutput); ok {
+				customError = envelopeError
 			}
-			status := err.ProcessState.Sys().(syscall.WaitStatus)
-			switch {
-			case status.Exited() && status.ExitStatus() > 0:
-				return t.sendTaskFailure(TaskFailureCommandExitedNonzero{stderr: stderr})
-			case status.Signaled() && status.Signal() == syscall.SIGKILL:
-				return t.sendTaskFailure(TaskFailureCommandKilled{stderr: stderr})
+		}
+		return t.sendTaskFailure(t.commandFailure(err, stderr, customError))
+	}
+
+	if taskOutputErr != nil {
+		if tooLarge, ok := taskOutputErr.(TaskFailureTaskOutputTooLarge); ok {
+			return t.sendTaskFailure(tooLarge)
+		}
+		return t.sendTaskFailure(TaskFailureUnknown{fmt.Errorf("failed to read output file: %s", taskOutputErr)})
+	}
+	// a result line longer than the buffer has lost its beginning, so don't try to parse it
+	if outputFile == "" && (stdoutLastLine.size() > t.stdoutBufferSize || stdoutLastLine.truncatedIn(stdoutbuf.Size())) {
+		return t.sendTaskFailure(TaskFailureTaskOutputTooLarge{size: stdoutLastLine.size(), limit: t.stdoutBufferSize})
+	}
+
+	return t.sendTaskOutput(ctx, executionName, taskOutput, outputFile != "")
+}
+
+// commandFailure classifies why the command failed to run or exited unsuccessfully.
+// A custom error reported by the command takes precedence when it exited on its own.
+func (t *TaskRunner) commandFailure(err error, stderr string, customError TaskFailureCustom) TaskFailureError {
+	if t.receivedSigterm {
+		if customError.ErrorName() != "" {
+			return customError
+		}
+		return TaskFailureCommandTerminated{stderr: stderr}
+	}
+	switch err := err.(type) {
+	case *os.PathError:
+		if errors.Is(err.Err, syscall.ENOENT) {
+			return TaskFailureCommandNotFound{path: err.Path}
+		}
+		return TaskFailureCommandStartFailed{path: err.Path, err: err.Err}
+	case *exec.ExitError:
+		if customError.ErrorName() != "" {
+			return customError
+		}
+		status := err.ProcessState.Sys().(syscall.WaitStatus)
+		switch {
+		case status.Exited() && status.ExitStatus() > 0:
+			return classifyExit(t.exitCodeErrors, t.stderrErrors, status.ExitStatus(), stderr)
+		case status.Signaled() && status.Signal() == syscall.SIGKILL:
+			if t.oom.killed() {
+				oomKilled := TaskFailureCommandOOMKilled{limit: t.oom.cgroup.limit(), peakRSS: peakRSS(err.ProcessState), stderr: stderr}
+				t.logger.ErrorD("command-oom-killed", logger.M{"limit": oomKilled.limit, "peak-rss": oomKilled.peakRSS})
+				return oomKilled
 			}
+			return TaskFailureCommandKilled{stderr: stderr}
 		}
-		return t.sendTaskFailure(TaskFailureUnknown{err})
 	}
+	return TaskFailureUnknown{err}
+}
 
+// sendTaskOutput validates the output of the command and reports it to Step Functions,
+// offloading it to S3 if it is too large to send directly.
+func (t *TaskRunner) sendTaskOutput(ctx context.Context, executionName string, taskOutput string, fromFile bool) error {
 	// AWS / states language requires JSON output
-	taskOutput := taskOutputFromStdout(stdoutbuf.String())
 	var taskOutputMap map[string]interface{}
 	if len(taskOutput) == 0 { // Treat "" output like {}.  Makes worker implementions easier.
 		taskOutputMap = map[string]interface{}{}
-	} else if err := json.Unmarshal([]byte(taskOutput), &taskOutputMap); err != nil {
-		return t.sendTaskFailure(TaskFailureTaskOutputNotJSON{output: taskOutput})
+	} else if err := json.Unmarshal([]byte(taskOutput), &taskOutputMap); err != nil || taskOutputMap == nil {
+		return t.sendTaskFailure(TaskFailureTaskOutputNotJSON{output: taskOutput, fromFile: fromFile})
+	}
+	if t.errorEnvelope {
+		if failure, ok := parseErrorEnvelope(taskOutputMap); ok {
+			return t.sendTaskFailure(failure)
+		}
 	}
 	// Add _EXECUTION_NAME back into the payload in case the executing worker omits the value
 	// in the output.
@@ -159,68 +408,285 @@ func (t *TaskRunner) Process(ctx context.Context, args []string, input string) e
 	if err != nil {
 		return t.sendTaskFailure(TaskFailureUnknown{fmt.Errorf("JSON output re-marshalling failed. This should never happen. %s", err)})
 	}
+	if len(finalTaskOutput) > t.maxOutputLength() {
+		return t.sendTaskFailure(TaskFailureTaskOutputTooLarge{size: len(finalTaskOutput), limit: t.maxOutputLength()})
+	}
+	if len(finalTaskOutput) > maxTaskOutputLength {
+		// too large for Step Functions, so send a pointer to a copy in S3 instead
+		pointer, err := t.payloads.upload(ctx, executionName, finalTaskOutput)
+		if err != nil {
+			return t.sendTaskFailure(TaskFailureTaskOutputUploadFailed{err})
+		}
+		t.logger.InfoD("task-output-uploaded", logger.M{"bucket": pointer.Bucket, "key": pointer.Key, "size": pointer.Size})
+		finalTaskOutput, err = json.Marshal(map[string]interface{}{
+			"_EXECUTION_NAME":   executionName,
+			payloadPointerField: pointer,
+		})
+		if err != nil {
+			return t.sendTaskFailure(TaskFailureUnknown{fmt.Errorf("JSON pointer marshalling failed. This should never happen. %s", err)})
+		}
+	}
 
 	return t.sendTaskSuccess(ctx, string(finalTaskOutput))
 }
 
-func (t *TaskRunner) handleSignals(ctx context.Context) {
+// waitForCommand waits for the started command to exit, while forwarding signals to it and stopping
+// it if it stalls or runs longer than timeout. The goroutines doing so only use the pid of the command,
+// since execCmd is written by Wait, and they are done once waitForCommand returns so that what they
+// recorded can be read.
+func (t *TaskRunner) waitForCommand(ctx context.Context, timeout time.Duration) error {
+	pid := t.execCmd.Process.Pid
+	exited := make(chan struct{})
+	var watchers sync.WaitGroup
+	watch := func(watcher func()) {
+		watchers.Add(1)
+		go func() {
+			defer watchers.Done()
+			watcher()
+		}()
+	}
+
+	// forward signals to the command, handle SIGTERM
+	watch(func() { t.handleSignals(ctx, pid, exited) })
+	if t.commandHeartbeatTimeout > 0 {
+		watch(func() { t.watchForStall(ctx, pid, exited) })
+	}
+	if timeout > 0 {
+		watch(func() { t.enforceTimeout(ctx, pid, exited, timeout) })
+	}
+
+	err := t.execCmd.Wait()
+	close(exited)
+	watchers.Wait()
+	return err
+}
+
+func (t *TaskRunner) handleSignals(ctx context.Context, pid int, exited <-chan struct{}) {
 	// a buffer of one should be safe here as we're basically just catching container exits
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan)
+	signal.Notify(sigChan, t.signals.notify()...)
 	defer signal.Stop(sigChan)
 	for {
 		select {
+		case <-exited:
+			return
 		case <-ctx.Done():
 			// if the context has ended, but the command is still running,
 			// initiate graceful shutdown with a much shorter grace period,
 			// since most likely this is a case of SFN timing out the
 			// activity. This means there is likely another activity
 			// out there beginning work on the same input.
-			if t.execCmd.Process != nil && t.execCmd.ProcessState == nil {
-				sigTermAndThenKill(t.execCmd.Process.Pid, 5*time.Second)
-			}
+			stopCommand(pid, canceledTaskGracePeriod, exited)
+			return
+		case <-t.terminate:
+			t.receivedSigterm = true
+			stopCommand(pid, t.sigtermGracePeriod, exited)
 			return
 		case sigReceived := <-sigChan:
-			if t.execCmd.Process == nil {
+			if t.drainsOn(sigReceived) {
+				continue
+			}
+			sig, ok := t.signals.signalFor(sigReceived)
+			if !ok {
 				continue
 			}
-			pid := t.execCmd.Process.Pid
 			// SIGTERM is special. If it gets sent to sfncli, initiate a docker-stop like shutdown process:
 			// - forward the SIGTERM to the command
 			// - after a grace period send SIGKILL to the command if it's still running
-			if sigReceived == syscall.SIGTERM {
+			if sig == syscall.SIGTERM {
 				t.receivedSigterm = true
-				sigTermAndThenKill(pid, t.sigtermGracePeriod)
+				stopCommand(pid, t.sigtermGracePeriod, exited)
 				return
 			}
-			signalProcess(pid, sigReceived)
+			signalProcess(pid, sig)
 		}
-		if t.receivedSigterm {
+	}
+}
+
+// drainsOn reports whether sfncli drains on a signal instead of forwarding it to the command.
+func (t *TaskRunner) drainsOn(sig os.Signal) bool {
+	return t.terminate != nil && (sig == syscall.SIGTERM || sig == os.Interrupt)
+}
+
+// watchForStall stops the command if it goes longer than commandHeartbeatTimeout without checking in
+// on its control socket. The time before the command's first check in counts too.
+func (t *TaskRunner) watchForStall(ctx context.Context, pid int, exited <-chan struct{}) {
+	start := time.Now()
+	ticker := time.NewTicker(stallCheckInterval(t.commandHeartbeatTimeout))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-exited:
+			return
+		case <-ticker.C:
+			lastCheckin := t.checkins.lastCheckin()
+			if lastCheckin.Before(start) {
+				lastCheckin = start
+			}
+			if time.Since(lastCheckin) < t.commandHeartbeatTimeout {
+				continue
+			}
+			t.logger.ErrorD("command-stalled", logger.M{"last-checkin": lastCheckin.Format(time.RFC3339)})
+			t.stalled.Store(true)
+			stopCommand(pid, canceledTaskGracePeriod, exited)
 			return
 		}
 	}
 }
 
-func signalProcess(pid int, signal os.Signal) {
-	proc := os.Process{Pid: pid}
-	proc.Signal(signal)
+// enforceTimeout stops the command if it is still running after the timeout.
+func (t *TaskRunner) enforceTimeout(ctx context.Context, pid int, exited <-chan struct{}, timeout time.Duration) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return
+	case <-exited:
+		return
+	case <-timer.C:
+	}
+	t.logger.ErrorD("command-timed-out", logger.M{"timeout": timeout.String()})
+	t.timedOut.Store(true)
+	stopCommand(pid, canceledTaskGracePeriod, exited)
 }
 
-// sigTermAndThenKill is a docker-stop like shutdown process:
+// maxTaskTimeoutSeconds is the longest taskTimeoutField can be: a year, the longest a Step Functions
+// execution can run. It also keeps the timeout well within what a time.Duration can hold.
+const maxTaskTimeoutSeconds = 365 * 24 * 60 * 60
+
+// taskTimeoutFromInput returns the timeout of a task: taskTimeoutField if the input has it, otherwise defaultTimeout.
+func taskTimeoutFromInput(taskInput map[string]interface{}, defaultTimeout time.Duration) (time.Duration, error) {
+	value, ok := taskInput[taskTimeoutField]
+	if !ok {
+		return defaultTimeout, nil
+	}
+	seconds, ok := value.(float64)
+	if !ok || seconds <= 0 {
+		return 0, fmt.Errorf("%s must be a positive number of seconds, got %v", taskTimeoutField, value)
+	}
+	if seconds > maxTaskTimeoutSeconds {
+		return 0, fmt.Errorf("%s must be at most %d seconds, got %v", taskTimeoutField, maxTaskTimeoutSeconds, value)
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// stallCheckInterval checks for stalls often enough to stop a stalled command soon after its timeout
+func stallCheckInterval(timeout time.Duration) time.Duration {
+	if interval := timeout / 10; interval < time.Second {
+		return interval
+	}
+	return time.Second
+}
+
+// commandCheckedInSince is true if the command checked in on its control socket after the given time.
+func (t *TaskRunner) commandCheckedInSince(since time.Time) bool {
+	return t.checkins.lastCheckin().After(since)
+}
+
+// stopCommand is a docker-stop like shutdown process for the process group of a command being waited for:
 // - send sigterm
 // - after a grace period send SIGKILL if the command is still running
-func sigTermAndThenKill(pid int, gracePeriod time.Duration) {
+// It returns as soon as the command exits, without sending SIGKILL to a process that is gone.
+func stopCommand(pid int, gracePeriod time.Duration, exited <-chan struct{}) {
 	signalProcess(pid, os.Signal(syscall.SIGTERM))
-	time.Sleep(gracePeriod)
-	signalProcess(pid, os.Signal(syscall.SIGKILL))
+	select {
+	case <-exited:
+	case <-time.After(gracePeriod):
+		signalProcess(pid, os.Signal(syscall.SIGKILL))
+	}
 }
 
-func parseCustomErrorFromStdout(stdout string) (TaskFailureCustom, error) {
+func parseCustomError(taskOutput string) (TaskFailureCustom, error) {
 	var customError TaskFailureCustom
-	err := json.Unmarshal([]byte(taskOutputFromStdout(stdout)), &customError)
+	err := json.Unmarshal([]byte(taskOutput), &customError)
 	return customError, err
 }
 
+// maxOutputLength is the largest output a task can have: what Step Functions accepts,
+// or what can be offloaded to S3 if offloading is enabled.
+func (t *TaskRunner) maxOutputLength() int {
+	if t.payloads != nil {
+		return int(maxPayloadLength)
+	}
+	return maxTaskOutputLength
+}
+
+// readTaskOutput returns the result of the command: the last line of stdout, or the
+// whole output file in the file output mode. A missing output file is treated like empty output.
+func readTaskOutput(stdout string, outputFile string, maxLength int) (string, error) {
+	if outputFile == "" {
+		return taskOutputFromStdout(stdout), nil
+	}
+	info, err := os.Stat(outputFile)
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	if info.Size() > int64(maxLength) {
+		return "", TaskFailureTaskOutputTooLarge{size: int(info.Size()), limit: maxLength}
+	}
+	f, err := os.Open(outputFile)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	// the command may still be writing to the file if it left processes running
+	b, err := io.ReadAll(io.LimitReader(f, int64(maxLength)+1))
+	if err != nil {
+		return "", err
+	}
+	if len(b) > maxLength {
+		return "", TaskFailureTaskOutputTooLarge{size: len(b), limit: maxLength}
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// lastLineWriter measures the last non-empty line written to it,
+// so that its size is known even when it does not fit in the stdout buffer.
+type lastLineWriter struct {
+	written   int // total bytes written
+	lineStart int // offset of the start of the current line
+	lastStart int // offset of the start of the last non-empty line that ended
+	lastSize  int // size of the last non-empty line that ended
+}
+
+func (l *lastLineWriter) Write(p []byte) (int, error) {
+	for i, b := range p {
+		if b != '\n' {
+			continue
+		}
+		offset := l.written + i
+		if offset > l.lineStart {
+			l.lastStart = l.lineStart
+			l.lastSize = offset - l.lineStart
+		}
+		l.lineStart = offset + 1
+	}
+	l.written += len(p)
+	return len(p), nil
+}
+
+// size returns the size in bytes of the last non-empty line.
+func (l *lastLineWriter) size() int {
+	if l.written > l.lineStart {
+		return l.written - l.lineStart
+	}
+	return l.lastSize
+}
+
+// truncatedIn returns whether the beginning of the last non-empty line is lost
+// in a buffer that keeps the last capacity bytes.
+func (l *lastLineWriter) truncatedIn(capacity int64) bool {
+	start := l.lastStart
+	if l.written > l.lineStart {
+		start = l.lineStart
+	}
+	return int64(l.written-start) > capacity
+}
+
 func taskOutputFromStdout(stdout string) string {
 	stdout = strings.TrimSpace(stdout) // remove trailing newline
 	stdoutLines := strings.Split(stdout, "\n")
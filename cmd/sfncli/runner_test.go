@@ -3,7 +3,10 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
+	"os/signal"
 	"path"
 	"strings"
 	"syscall"
@@ -11,6 +14,7 @@ import (
 	"time"
 
 	"github.com/Clever/sfncli/mocks"
+	"github.com/Clever/sfncli/s3fake"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/sfn"
 	"github.com/golang/mock/gomock"
@@ -119,6 +123,36 @@ func TestTaskFailureCommandNotFound(t *testing.T) {
 	require.Equal(t, err, expectedError)
 }
 
+func TestTaskFailureCommandStartFailed(t *testing.T) {
+	t.Run("input too long for argv", func(t *testing.T) {
+		t.Parallel()
+		controller := gomock.NewController(t)
+		defer controller.Finish()
+		mockSFN := mocks.NewMockSFNAPI(controller)
+		mockSFN.EXPECT().SendTaskFailure(gomock.Any(), gomock.Any())
+		taskRunner := NewTaskRunner(path.Join(testScriptsDir, "echo_input.sh"), mockSFN, mockTaskToken, "")
+		input := `{"_EXECUTION_NAME":"fake-WFM-uuid","data":"` + strings.Repeat("x", 512*1024) + `"}`
+		err := taskRunner.Process(context.Background(), []string{}, input)
+		var startFailed TaskFailureCommandStartFailed
+		require.ErrorAs(t, err, &startFailed)
+		require.ErrorIs(t, startFailed.err, syscall.E2BIG)
+		require.Contains(t, startFailed.ErrorCause(), "input-mode stdin or file")
+	})
+
+	t.Run("not executable", func(t *testing.T) {
+		t.Parallel()
+		cmd := path.Join(t.TempDir(), "not_executable.sh")
+		require.NoError(t, os.WriteFile(cmd, []byte("#!/bin/sh\n"), 0644))
+		controller := gomock.NewController(t)
+		defer controller.Finish()
+		mockSFN := mocks.NewMockSFNAPI(controller)
+		mockSFN.EXPECT().SendTaskFailure(gomock.Any(), gomock.Any())
+		taskRunner := NewTaskRunner(cmd, mockSFN, mockTaskToken, "")
+		err := taskRunner.Process(context.Background(), []string{}, emptyTaskInput)
+		require.Equal(t, TaskFailureCommandStartFailed{path: cmd, err: syscall.EACCES}, err)
+	})
+}
+
 func TestTaskFailureCommandKilled(t *testing.T) {
 	t.Parallel()
 	testCtx, testCtxCancel := context.WithCancel(context.Background())
@@ -165,6 +199,80 @@ func TestTaskFailureCommandExitedNonzero(t *testing.T) {
 	require.Equal(t, err, expectedError)
 }
 
+func TestTaskFailureExitCodeError(t *testing.T) {
+	t.Parallel()
+	testCtx, testCtxCancel := context.WithCancel(context.Background())
+	defer testCtxCancel()
+	cmd := "stderr_stdout_exitcode.sh"
+
+	for _, test := range []struct {
+		description   string
+		cmdArgs       []string
+		expectedError TaskFailureError
+	}{
+		{
+			description:   "the first rule matching the exit code names the error",
+			cmdArgs:       []string{"stderr", `{"stdout":"mustbejson"}`, "75"},
+			expectedError: TaskFailureCustom{Err: "MyTool.TempFailure", Cause: "exited 75: stderr"},
+		},
+		{
+			description:   "the cause defaults to stderr",
+			cmdArgs:       []string{"stderr", `{"stdout":"mustbejson"}`, "2"},
+			expectedError: TaskFailureCustom{Err: "MyTool.BadInput", Cause: "stderr"},
+		},
+		{
+			description:   "a custom error reported by the command takes precedence",
+			cmdArgs:       []string{"stderr", `{"error": "custom.error_name", "cause": "bar"}`, "75"},
+			expectedError: TaskFailureCustom{Err: "custom.error_name", Cause: "bar"},
+		},
+		{
+			description:   "other exit codes are sfncli.CommandExitedNonzero",
+			cmdArgs:       []string{"stderr", `{"stdout":"mustbejson"}`, "10"},
+			expectedError: TaskFailureCommandExitedNonzero{stderr: "stderr"},
+		},
+	} {
+		t.Run(test.description, func(t *testing.T) {
+			controller := gomock.NewController(t)
+			defer controller.Finish()
+			mockSFN := mocks.NewMockSFNAPI(controller)
+			mockSFN.EXPECT().SendTaskFailure(gomock.Any(), &sfn.SendTaskFailureInput{
+				Cause:     aws.String(test.expectedError.ErrorCause()),
+				Error:     aws.String(test.expectedError.ErrorName()),
+				TaskToken: aws.String(mockTaskToken),
+			})
+			taskRunner := NewTaskRunner(path.Join(testScriptsDir, cmd), mockSFN, mockTaskToken, "")
+			require.NoError(t, taskRunner.exitCodeErrors.Set("2=MyTool.BadInput"))
+			require.NoError(t, taskRunner.exitCodeErrors.Set("64-78=MyTool.TempFailure:exited {{.ExitCode}}: {{.Stderr}}"))
+			require.NoError(t, taskRunner.exitCodeErrors.Set("75=MyTool.Unreachable"))
+			err := taskRunner.Process(testCtx, test.cmdArgs, emptyTaskInput)
+			require.Equal(t, test.expectedError, err)
+		})
+	}
+}
+
+func TestTaskFailureStderrError(t *testing.T) {
+	t.Parallel()
+	testCtx, testCtxCancel := context.WithCancel(context.Background())
+	defer testCtxCancel()
+	cmd := "stderr_stdout_exitcode.sh"
+	cmdArgs := []string{"read tcp: connection reset by peer", `{"stdout":"mustbejson"}`, "1"}
+	expectedError := TaskFailureCustom{Err: "Transient.Network", Cause: "read tcp: connection reset by peer"}
+
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+	mockSFN := mocks.NewMockSFNAPI(controller)
+	mockSFN.EXPECT().SendTaskFailure(gomock.Any(), &sfn.SendTaskFailureInput{
+		Cause:     aws.String(expectedError.ErrorCause()),
+		Error:     aws.String(expectedError.ErrorName()),
+		TaskToken: aws.String(mockTaskToken),
+	})
+	taskRunner := NewTaskRunner(path.Join(testScriptsDir, cmd), mockSFN, mockTaskToken, "")
+	require.NoError(t, taskRunner.stderrErrors.Set("Resource.Disk=(?i)no space left on device"))
+	require.NoError(t, taskRunner.stderrErrors.Set("Transient.Network=connection reset by peer|Throttling"))
+	err := taskRunner.Process(testCtx, cmdArgs, emptyTaskInput)
+	require.Equal(t, expectedError, err)
+}
+
 func TestTaskFailureCustomErrorName(t *testing.T) {
 	t.Parallel()
 	testCtx, testCtxCancel := context.WithCancel(context.Background())
@@ -186,6 +294,68 @@ func TestTaskFailureCustomErrorName(t *testing.T) {
 	require.Equal(t, err, expectedError)
 }
 
+func TestTaskFailureErrorEnvelope(t *testing.T) {
+	t.Parallel()
+	testCtx, testCtxCancel := context.WithCancel(context.Background())
+	defer testCtxCancel()
+	cmd := "stderr_stdout_exitcode.sh"
+
+	for _, test := range []struct {
+		description   string
+		cmdArgs       []string
+		expectedError TaskFailureError
+	}{
+		{
+			description:   "an envelope fails a command that exits 0",
+			cmdArgs:       []string{"stderr", `{"_sfncli_error": {"error": "custom.error_name", "cause": "bar"}}`, "0"},
+			expectedError: TaskFailureCustom{Err: "custom.error_name", Cause: "bar"},
+		},
+		{
+			description:   "the envelope carries a partial result",
+			cmdArgs:       []string{"stderr", `{"_sfncli_error": {"error": "custom.error_name", "cause": "bar"}, "done": 3}`, "0"},
+			expectedError: TaskFailureCustom{Err: "custom.error_name", Cause: `{"cause":"bar","partial_result":{"done":3}}`},
+		},
+		{
+			description:   "an envelope names the error of a command that exits nonzero",
+			cmdArgs:       []string{"stderr", `{"_sfncli_error": {"error": "custom.error_name", "cause": "bar"}}`, "10"},
+			expectedError: TaskFailureCustom{Err: "custom.error_name", Cause: "bar"},
+		},
+		{
+			description:   "custom errors still work",
+			cmdArgs:       []string{"stderr", `{"error": "custom.error_name", "cause": "bar"}`, "10"},
+			expectedError: TaskFailureCustom{Err: "custom.error_name", Cause: "bar"},
+		},
+	} {
+		t.Run(test.description, func(t *testing.T) {
+			controller := gomock.NewController(t)
+			defer controller.Finish()
+			mockSFN := mocks.NewMockSFNAPI(controller)
+			mockSFN.EXPECT().SendTaskFailure(gomock.Any(), &sfn.SendTaskFailureInput{
+				Cause:     aws.String(test.expectedError.ErrorCause()),
+				Error:     aws.String(test.expectedError.ErrorName()),
+				TaskToken: aws.String(mockTaskToken),
+			})
+			taskRunner := NewTaskRunner(path.Join(testScriptsDir, cmd), mockSFN, mockTaskToken, "")
+			taskRunner.errorEnvelope = true
+			err := taskRunner.Process(testCtx, test.cmdArgs, emptyTaskInput)
+			require.Equal(t, test.expectedError, err)
+		})
+	}
+
+	t.Run("the envelope is an output like any other unless enabled", func(t *testing.T) {
+		controller := gomock.NewController(t)
+		defer controller.Finish()
+		mockSFN := mocks.NewMockSFNAPI(controller)
+		mockSFN.EXPECT().SendTaskSuccess(gomock.Any(), &sfn.SendTaskSuccessInput{
+			Output:    aws.String(`{"_EXECUTION_NAME":"fake-WFM-uuid","_sfncli_error":{"cause":"bar","error":"custom.error_name"}}`),
+			TaskToken: aws.String(mockTaskToken),
+		})
+		taskRunner := NewTaskRunner(path.Join(testScriptsDir, cmd), mockSFN, mockTaskToken, "")
+		err := taskRunner.Process(testCtx, []string{"stderr", `{"_sfncli_error": {"error": "custom.error_name", "cause": "bar"}}`, "0"}, emptyTaskInput)
+		require.NoError(t, err)
+	})
+}
+
 func TestTaskFailureTaskOutputNotJSON(t *testing.T) {
 	t.Parallel()
 	testCtx, testCtxCancel := context.WithCancel(context.Background())
@@ -286,6 +456,54 @@ func TestTaskFailureCommandTerminated(t *testing.T) {
 	})
 }
 
+func TestTaskDrain(t *testing.T) {
+	t.Run("sigterm is not forwarded while draining", func(t *testing.T) {
+		testCtx, testCtxCancel := context.WithCancel(context.Background())
+		defer testCtxCancel()
+		cmd := "sleep_and_succeed.sh"
+		cmdArgs := []string{"2"}
+
+		controller := gomock.NewController(t)
+		defer controller.Finish()
+		mockSFN := mocks.NewMockSFNAPI(controller)
+		mockSFN.EXPECT().SendTaskSuccess(gomock.Any(), gomock.Any())
+		taskRunner := NewTaskRunner(path.Join(testScriptsDir, cmd), mockSFN, mockTaskToken, "")
+		taskRunner.terminate = make(chan struct{})
+		go func() {
+			time.Sleep(1 * time.Second)
+			process, _ := os.FindProcess(os.Getpid())
+			process.Signal(syscall.SIGTERM)
+		}()
+		require.NoError(t, taskRunner.Process(testCtx, cmdArgs, emptyTaskInput))
+	})
+
+	t.Run("command is terminated when the drain ends", func(t *testing.T) {
+		testCtx, testCtxCancel := context.WithCancel(context.Background())
+		defer testCtxCancel()
+		cmd := "stderr_stdout_exitcode_onsigterm.sh"
+		cmdArgs := []string{"stderr", "", "1"}
+		expectedError := TaskFailureCommandTerminated{stderr: "stderr"}
+
+		controller := gomock.NewController(t)
+		defer controller.Finish()
+		mockSFN := mocks.NewMockSFNAPI(controller)
+		mockSFN.EXPECT().SendTaskFailure(gomock.Any(), &sfn.SendTaskFailureInput{
+			Cause:     aws.String(expectedError.ErrorCause()),
+			Error:     aws.String(expectedError.ErrorName()),
+			TaskToken: aws.String(mockTaskToken),
+		})
+		taskRunner := NewTaskRunner(path.Join(testScriptsDir, cmd), mockSFN, mockTaskToken, "")
+		terminate := make(chan struct{})
+		taskRunner.terminate = terminate
+		go func() {
+			time.Sleep(1 * time.Second)
+			close(terminate)
+		}()
+		err := taskRunner.Process(testCtx, cmdArgs, emptyTaskInput)
+		require.Equal(t, err, expectedError)
+	})
+}
+
 func TestTaskSuccessSignalForwarded(t *testing.T) {
 	testCtx, testCtxCancel := context.WithCancel(context.Background())
 	defer testCtxCancel()
@@ -308,6 +526,99 @@ func TestTaskSuccessSignalForwarded(t *testing.T) {
 	require.Nil(t, taskRunner.Process(testCtx, cmdArgs, emptyTaskInput))
 }
 
+// signalEchoHelperEnvVar makes TestSignalEchoHelper act as a command.
+const signalEchoHelperEnvVar = "SFNCLI_TEST_SIGNAL_ECHO_HELPER"
+
+// TestSignalEchoHelper is not a test but a command for TestTaskSignalPolicy, run by re-executing the test
+// binary. Like signal_echo.sh, it outputs the first signal it receives, SIGCHLD included.
+func TestSignalEchoHelper(t *testing.T) {
+	if os.Getenv(signalEchoHelperEnvVar) == "" {
+		t.Skip("only run as a command by TestTaskSignalPolicy")
+	}
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGHUP, syscall.SIGCHLD, syscall.SIGWINCH)
+	sig := <-sigChan
+	fmt.Printf("{\"signal\": \"%d\"}\n", sig)
+	os.Exit(0)
+}
+
+func TestTaskSignalPolicy(t *testing.T) {
+	t.Run("runtime and terminal signals are not forwarded", func(t *testing.T) {
+		testCtx, testCtxCancel := context.WithCancel(context.Background())
+		defer testCtxCancel()
+		cmd := "signal_echo.sh"
+
+		controller := gomock.NewController(t)
+		defer controller.Finish()
+		mockSFN := mocks.NewMockSFNAPI(controller)
+		// signal_echo.sh echoes the first signal it gets
+		mockSFN.EXPECT().SendTaskSuccess(gomock.Any(), &sfn.SendTaskSuccessInput{
+			Output:    aws.String(`{"_EXECUTION_NAME":"fake-WFM-uuid","signal":"1"}`),
+			TaskToken: aws.String(mockTaskToken),
+		})
+		taskRunner := NewTaskRunner(path.Join(testScriptsDir, cmd), mockSFN, mockTaskToken, "")
+		go func() {
+			process, _ := os.FindProcess(os.Getpid())
+			time.Sleep(500 * time.Millisecond)
+			process.Signal(syscall.SIGURG)
+			process.Signal(syscall.SIGWINCH)
+			process.Signal(syscall.SIGCHLD)
+			time.Sleep(300 * time.Millisecond)
+			process.Signal(syscall.SIGHUP)
+		}()
+		require.Nil(t, taskRunner.Process(testCtx, []string{}, emptyTaskInput))
+	})
+
+	t.Run("SIGCHLD is not forwarded", func(t *testing.T) {
+		testCtx, testCtxCancel := context.WithCancel(context.Background())
+		defer testCtxCancel()
+
+		controller := gomock.NewController(t)
+		defer controller.Finish()
+		mockSFN := mocks.NewMockSFNAPI(controller)
+		mockSFN.EXPECT().SendTaskSuccess(gomock.Any(), &sfn.SendTaskSuccessInput{
+			Output:    aws.String(`{"_EXECUTION_NAME":"fake-WFM-uuid","signal":"1"}`),
+			TaskToken: aws.String(mockTaskToken),
+		})
+		// bash only runs a SIGCHLD trap when one of its children exits, so signal_echo.sh cannot tell
+		// whether it was sent SIGCHLD: the command is this test binary instead, see TestSignalEchoHelper
+		t.Setenv(signalEchoHelperEnvVar, "1")
+		taskRunner := NewTaskRunner(os.Args[0], mockSFN, mockTaskToken, "")
+		go func() {
+			process, _ := os.FindProcess(os.Getpid())
+			time.Sleep(500 * time.Millisecond)
+			process.Signal(syscall.SIGCHLD)
+			time.Sleep(300 * time.Millisecond)
+			process.Signal(syscall.SIGHUP)
+		}()
+		require.Nil(t, taskRunner.Process(testCtx, []string{"-test.run=^TestSignalEchoHelper$"}, emptyTaskInput))
+	})
+
+	t.Run("signals are translated", func(t *testing.T) {
+		testCtx, testCtxCancel := context.WithCancel(context.Background())
+		defer testCtxCancel()
+		cmd := "signal_echo.sh"
+
+		controller := gomock.NewController(t)
+		defer controller.Finish()
+		mockSFN := mocks.NewMockSFNAPI(controller)
+		mockSFN.EXPECT().SendTaskSuccess(gomock.Any(), &sfn.SendTaskSuccessInput{
+			Output:    aws.String(`{"_EXECUTION_NAME":"fake-WFM-uuid","signal":"12"}`),
+			TaskToken: aws.String(mockTaskToken),
+		})
+		taskRunner := NewTaskRunner(path.Join(testScriptsDir, cmd), mockSFN, mockTaskToken, "")
+		signals, err := parseSignalPolicy("", "HUP=USR2")
+		require.NoError(t, err)
+		taskRunner.signals = signals
+		go func() {
+			time.Sleep(500 * time.Millisecond)
+			process, _ := os.FindProcess(os.Getpid())
+			process.Signal(syscall.SIGHUP)
+		}()
+		require.Nil(t, taskRunner.Process(testCtx, []string{}, emptyTaskInput))
+	})
+}
+
 func TestTaskSuccessOutputIsLastLineOfStdout(t *testing.T) {
 	testCtx, testCtxCancel := context.WithCancel(context.Background())
 	defer testCtxCancel()
@@ -391,3 +702,445 @@ func TestTaskWorkDirectoryCleaned(t *testing.T) {
 		require.Fail(t, "directory /tmp/test not deleted")
 	}
 }
+
+func TestTaskCommandHeartbeat(t *testing.T) {
+	t.Run("command that keeps checking in succeeds", func(t *testing.T) {
+		t.Parallel()
+		testCtx, testCtxCancel := context.WithCancel(context.Background())
+		defer testCtxCancel()
+		cmd := "control_heartbeat.sh"
+		cmdArgs := []string{"1", "3"}
+
+		controller := gomock.NewController(t)
+		defer controller.Finish()
+		mockSFN := mocks.NewMockSFNAPI(controller)
+		mockSFN.EXPECT().SendTaskSuccess(gomock.Any(), &sfn.SendTaskSuccessInput{
+			Output:    aws.String(`{"_EXECUTION_NAME":"fake-WFM-uuid","heartbeats":"3"}`),
+			TaskToken: aws.String(mockTaskToken),
+		})
+		taskRunner := NewTaskRunner(path.Join(testScriptsDir, cmd), mockSFN, mockTaskToken, "")
+		taskRunner.commandHeartbeatTimeout = 2 * time.Second
+		require.NoError(t, taskRunner.Process(testCtx, cmdArgs, emptyTaskInput))
+		require.True(t, taskRunner.commandCheckedInSince(time.Time{}))
+	})
+
+	t.Run("command that goes quiet is stopped", func(t *testing.T) {
+		t.Parallel()
+		testCtx, testCtxCancel := context.WithCancel(context.Background())
+		defer testCtxCancel()
+		cmd := "log_to_stderr_and_wait.sh"
+		cmdArgs := []string{"log this to stderr"}
+		expectedError := TaskFailureCommandStalled{timeout: 1 * time.Second, stderr: cmdArgs[0]}
+
+		controller := gomock.NewController(t)
+		defer controller.Finish()
+		mockSFN := mocks.NewMockSFNAPI(controller)
+		mockSFN.EXPECT().SendTaskFailure(gomock.Any(), &sfn.SendTaskFailureInput{
+			Cause:     aws.String(expectedError.ErrorCause()),
+			Error:     aws.String(expectedError.ErrorName()),
+			TaskToken: aws.String(mockTaskToken),
+		})
+		taskRunner := NewTaskRunner(path.Join(testScriptsDir, cmd), mockSFN, mockTaskToken, "")
+		taskRunner.commandHeartbeatTimeout = 1 * time.Second
+		err := taskRunner.Process(testCtx, cmdArgs, emptyTaskInput)
+		require.Equal(t, expectedError, err)
+		require.False(t, taskRunner.commandCheckedInSince(time.Time{}))
+	})
+}
+
+func TestTaskTimeout(t *testing.T) {
+	t.Run("command that runs too long is stopped", func(t *testing.T) {
+		t.Parallel()
+		testCtx, testCtxCancel := context.WithCancel(context.Background())
+		defer testCtxCancel()
+		cmd := "log_to_stderr_and_wait.sh"
+		cmdArgs := []string{"log this to stderr"}
+
+		controller := gomock.NewController(t)
+		defer controller.Finish()
+		mockSFN := mocks.NewMockSFNAPI(controller)
+		mockSFN.EXPECT().SendTaskFailure(gomock.Any(), gomock.Any())
+		taskRunner := NewTaskRunner(path.Join(testScriptsDir, cmd), mockSFN, mockTaskToken, "")
+		taskRunner.taskTimeout = 1 * time.Second
+		err := taskRunner.Process(testCtx, cmdArgs, emptyTaskInput)
+		var timedOut TaskFailureCommandTimedOut
+		require.ErrorAs(t, err, &timedOut)
+		require.Equal(t, "sfncli.CommandTimedOut", timedOut.ErrorName())
+		require.Equal(t, 1*time.Second, timedOut.timeout)
+		require.Equal(t, cmdArgs[0], timedOut.stderr)
+		require.True(t, timedOut.elapsed >= 1*time.Second)
+	})
+
+	t.Run("task input overrides the timeout", func(t *testing.T) {
+		t.Parallel()
+		testCtx, testCtxCancel := context.WithCancel(context.Background())
+		defer testCtxCancel()
+		cmd := "log_to_stderr_and_wait.sh"
+		cmdArgs := []string{"log this to stderr"}
+
+		controller := gomock.NewController(t)
+		defer controller.Finish()
+		mockSFN := mocks.NewMockSFNAPI(controller)
+		mockSFN.EXPECT().SendTaskFailure(gomock.Any(), gomock.Any())
+		taskRunner := NewTaskRunner(path.Join(testScriptsDir, cmd), mockSFN, mockTaskToken, "")
+		taskRunner.taskTimeout = time.Hour
+		err := taskRunner.Process(testCtx, cmdArgs, `{"_EXECUTION_NAME":"fake-WFM-uuid","_SFNCLI_TIMEOUT_SECONDS":0.5}`)
+		var timedOut TaskFailureCommandTimedOut
+		require.ErrorAs(t, err, &timedOut)
+		require.Equal(t, 500*time.Millisecond, timedOut.timeout)
+	})
+
+	t.Run("the timeout is not passed to the command", func(t *testing.T) {
+		t.Parallel()
+		controller := gomock.NewController(t)
+		defer controller.Finish()
+		mockSFN := mocks.NewMockSFNAPI(controller)
+		mockSFN.EXPECT().SendTaskSuccess(gomock.Any(), &sfn.SendTaskSuccessInput{
+			Output:    aws.String(`{"_EXECUTION_NAME":"fake-WFM-uuid","args":2,"input":{"_EXECUTION_NAME":"fake-WFM-uuid"}}`),
+			TaskToken: aws.String(mockTaskToken),
+		})
+		taskRunner := NewTaskRunner(path.Join(testScriptsDir, "echo_input.sh"), mockSFN, mockTaskToken, "")
+		require.NoError(t, taskRunner.Process(context.Background(), []string{"argv"}, `{"_EXECUTION_NAME":"fake-WFM-uuid","_SFNCLI_TIMEOUT_SECONDS":60}`))
+	})
+
+	t.Run("command that finishes in time succeeds", func(t *testing.T) {
+		t.Parallel()
+		testCtx, testCtxCancel := context.WithCancel(context.Background())
+		defer testCtxCancel()
+		cmd := "sleep_and_succeed.sh"
+		cmdArgs := []string{"0"}
+
+		controller := gomock.NewController(t)
+		defer controller.Finish()
+		mockSFN := mocks.NewMockSFNAPI(controller)
+		mockSFN.EXPECT().SendTaskSuccess(gomock.Any(), gomock.Any())
+		taskRunner := NewTaskRunner(path.Join(testScriptsDir, cmd), mockSFN, mockTaskToken, "")
+		taskRunner.taskTimeout = 5 * time.Second
+		require.NoError(t, taskRunner.Process(testCtx, cmdArgs, emptyTaskInput))
+	})
+
+	t.Run("invalid timeout in the task input", func(t *testing.T) {
+		t.Parallel()
+		testCtx, testCtxCancel := context.WithCancel(context.Background())
+		defer testCtxCancel()
+		input := `{"_EXECUTION_NAME":"fake-WFM-uuid","_SFNCLI_TIMEOUT_SECONDS":"soon"}`
+		expectedError := TaskFailureTaskInputInvalidTimeout{errors.New("_SFNCLI_TIMEOUT_SECONDS must be a positive number of seconds, got soon")}
+
+		controller := gomock.NewController(t)
+		defer controller.Finish()
+		mockSFN := mocks.NewMockSFNAPI(controller)
+		mockSFN.EXPECT().SendTaskFailure(gomock.Any(), &sfn.SendTaskFailureInput{
+			Cause:     aws.String(expectedError.ErrorCause()),
+			Error:     aws.String(expectedError.ErrorName()),
+			TaskToken: aws.String(mockTaskToken),
+		})
+		taskRunner := NewTaskRunner(path.Join(testScriptsDir, "stdout_parsing.sh"), mockSFN, mockTaskToken, "")
+		require.Equal(t, expectedError, taskRunner.Process(testCtx, []string{}, input))
+	})
+
+	t.Run("timeout in the task input longer than a year", func(t *testing.T) {
+		t.Parallel()
+		_, err := taskTimeoutFromInput(map[string]interface{}{taskTimeoutField: 1e10}, 0)
+		require.EqualError(t, err, "_SFNCLI_TIMEOUT_SECONDS must be at most 31536000 seconds, got 1e+10")
+	})
+}
+
+func TestTaskOutputFile(t *testing.T) {
+	cmd := "output_file.sh"
+
+	t.Run("whole file is the output", func(t *testing.T) {
+		t.Parallel()
+		testCtx, testCtxCancel := context.WithCancel(context.Background())
+		defer testCtxCancel()
+		cmdArgs := []string{"{\n  \"task\": \"output\"\n}", "0"}
+
+		controller := gomock.NewController(t)
+		defer controller.Finish()
+		mockSFN := mocks.NewMockSFNAPI(controller)
+		mockSFN.EXPECT().SendTaskSuccess(gomock.Any(), &sfn.SendTaskSuccessInput{
+			Output:    aws.String(`{"_EXECUTION_NAME":"fake-WFM-uuid","task":"output"}`),
+			TaskToken: aws.String(mockTaskToken),
+		})
+		taskRunner := NewTaskRunner(path.Join(testScriptsDir, cmd), mockSFN, mockTaskToken, "")
+		taskRunner.outputMode = outputModeFile
+		require.NoError(t, taskRunner.Process(testCtx, cmdArgs, emptyTaskInput))
+	})
+
+	t.Run("missing file is treated like empty output", func(t *testing.T) {
+		t.Parallel()
+		testCtx, testCtxCancel := context.WithCancel(context.Background())
+		defer testCtxCancel()
+		cmdArgs := []string{"", "0"}
+
+		controller := gomock.NewController(t)
+		defer controller.Finish()
+		mockSFN := mocks.NewMockSFNAPI(controller)
+		mockSFN.EXPECT().SendTaskSuccess(gomock.Any(), &sfn.SendTaskSuccessInput{
+			Output:    aws.String(emptyTaskInput),
+			TaskToken: aws.String(mockTaskToken),
+		})
+		taskRunner := NewTaskRunner(path.Join(testScriptsDir, cmd), mockSFN, mockTaskToken, "")
+		taskRunner.outputMode = outputModeFile
+		require.NoError(t, taskRunner.Process(testCtx, cmdArgs, emptyTaskInput))
+	})
+
+	t.Run("custom error is read from the file", func(t *testing.T) {
+		t.Parallel()
+		testCtx, testCtxCancel := context.WithCancel(context.Background())
+		defer testCtxCancel()
+		cmdArgs := []string{`{"error": "custom.error_name", "cause": "bar"}`, "10"}
+		expectedError := TaskFailureCustom{Err: "custom.error_name", Cause: "bar"}
+
+		controller := gomock.NewController(t)
+		defer controller.Finish()
+		mockSFN := mocks.NewMockSFNAPI(controller)
+		mockSFN.EXPECT().SendTaskFailure(gomock.Any(), &sfn.SendTaskFailureInput{
+			Cause:     aws.String(expectedError.ErrorCause()),
+			Error:     aws.String(expectedError.ErrorName()),
+			TaskToken: aws.String(mockTaskToken),
+		})
+		taskRunner := NewTaskRunner(path.Join(testScriptsDir, cmd), mockSFN, mockTaskToken, "")
+		taskRunner.outputMode = outputModeFile
+		err := taskRunner.Process(testCtx, cmdArgs, emptyTaskInput)
+		require.Equal(t, expectedError, err)
+	})
+
+	t.Run("file that is not JSON fails the task", func(t *testing.T) {
+		t.Parallel()
+		testCtx, testCtxCancel := context.WithCancel(context.Background())
+		defer testCtxCancel()
+		cmdArgs := []string{"not JSON!", "0"}
+		expectedError := TaskFailureTaskOutputNotJSON{output: "not JSON!", fromFile: true}
+
+		controller := gomock.NewController(t)
+		defer controller.Finish()
+		mockSFN := mocks.NewMockSFNAPI(controller)
+		mockSFN.EXPECT().SendTaskFailure(gomock.Any(), &sfn.SendTaskFailureInput{
+			Cause:     aws.String(expectedError.ErrorCause()),
+			Error:     aws.String(expectedError.ErrorName()),
+			TaskToken: aws.String(mockTaskToken),
+		})
+		taskRunner := NewTaskRunner(path.Join(testScriptsDir, cmd), mockSFN, mockTaskToken, "")
+		taskRunner.outputMode = outputModeFile
+		err := taskRunner.Process(testCtx, cmdArgs, emptyTaskInput)
+		require.Equal(t, expectedError, err)
+	})
+}
+
+func TestTaskInputModes(t *testing.T) {
+	cmd := "echo_input.sh"
+	for _, test := range []struct {
+		inputMode string
+		args      int
+	}{
+		{inputMode: inputModeArgv, args: 2},
+		{inputMode: inputModeStdin, args: 1},
+		{inputMode: inputModeFile, args: 1},
+	} {
+		test := test
+		t.Run(test.inputMode, func(t *testing.T) {
+			t.Parallel()
+			testCtx, testCtxCancel := context.WithCancel(context.Background())
+			defer testCtxCancel()
+			cmdArgs := []string{test.inputMode}
+
+			controller := gomock.NewController(t)
+			defer controller.Finish()
+			mockSFN := mocks.NewMockSFNAPI(controller)
+			mockSFN.EXPECT().SendTaskSuccess(gomock.Any(), &sfn.SendTaskSuccessInput{
+				Output:    aws.String(fmt.Sprintf(`{"_EXECUTION_NAME":"fake-WFM-uuid","args":%d,"input":{"_EXECUTION_NAME":"fake-WFM-uuid"}}`, test.args)),
+				TaskToken: aws.String(mockTaskToken),
+			})
+			taskRunner := NewTaskRunner(path.Join(testScriptsDir, cmd), mockSFN, mockTaskToken, "")
+			taskRunner.inputMode = test.inputMode
+			require.NoError(t, taskRunner.Process(testCtx, cmdArgs, emptyTaskInput))
+		})
+	}
+
+	t.Run("input is validated in every mode", func(t *testing.T) {
+		t.Parallel()
+		testCtx, testCtxCancel := context.WithCancel(context.Background())
+		defer testCtxCancel()
+		expectedError := TaskFailureTaskInputNotJSON{input: "notjson"}
+
+		controller := gomock.NewController(t)
+		defer controller.Finish()
+		mockSFN := mocks.NewMockSFNAPI(controller)
+		mockSFN.EXPECT().SendTaskFailure(gomock.Any(), &sfn.SendTaskFailureInput{
+			Cause:     aws.String(expectedError.ErrorCause()),
+			Error:     aws.String(expectedError.ErrorName()),
+			TaskToken: aws.String(mockTaskToken),
+		})
+		taskRunner := NewTaskRunner(path.Join(testScriptsDir, cmd), mockSFN, mockTaskToken, "")
+		taskRunner.inputMode = inputModeStdin
+		err := taskRunner.Process(testCtx, []string{inputModeStdin}, "notjson")
+		require.Equal(t, expectedError, err)
+	})
+}
+
+func TestTaskFailureTaskOutputTooLarge(t *testing.T) {
+	cmd := "stdout_long_line.sh"
+	// the output line is {"data":"xxx..."}
+	const jsonOverhead = 11
+
+	for _, test := range []struct {
+		desc             string
+		dataLength       int
+		stdoutBufferSize int
+		outputMode       string
+		expectedError    TaskFailureTaskOutputTooLarge
+	}{
+		{
+			desc:             "output line longer than the stdout buffer",
+			dataLength:       200,
+			stdoutBufferSize: 100,
+			outputMode:       outputModeStdout,
+			expectedError:    TaskFailureTaskOutputTooLarge{size: 200 + jsonOverhead, limit: 100},
+		},
+		{
+			desc:             "output longer than Step Functions accepts",
+			dataLength:       maxTaskOutputLength - jsonOverhead,
+			stdoutBufferSize: maxTaskOutputLength,
+			outputMode:       outputModeStdout,
+			// _EXECUTION_NAME is added to the output
+			expectedError: TaskFailureTaskOutputTooLarge{size: maxTaskOutputLength + len(`,"_EXECUTION_NAME":"fake-WFM-uuid"`), limit: maxTaskOutputLength},
+		},
+		{
+			desc:             "output file larger than Step Functions accepts",
+			dataLength:       maxTaskOutputLength,
+			stdoutBufferSize: defaultStdoutBufferSize,
+			outputMode:       outputModeFile,
+			// the file ends with a newline
+			expectedError: TaskFailureTaskOutputTooLarge{size: maxTaskOutputLength + jsonOverhead + 1, limit: maxTaskOutputLength},
+		},
+	} {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+			testCtx, testCtxCancel := context.WithCancel(context.Background())
+			defer testCtxCancel()
+			cmdArgs := []string{fmt.Sprintf("%d", test.dataLength)}
+
+			controller := gomock.NewController(t)
+			defer controller.Finish()
+			mockSFN := mocks.NewMockSFNAPI(controller)
+			mockSFN.EXPECT().SendTaskFailure(gomock.Any(), &sfn.SendTaskFailureInput{
+				Cause:     aws.String(test.expectedError.ErrorCause()),
+				Error:     aws.String(test.expectedError.ErrorName()),
+				TaskToken: aws.String(mockTaskToken),
+			})
+			taskRunner := NewTaskRunner(path.Join(testScriptsDir, cmd), mockSFN, mockTaskToken, "")
+			taskRunner.stdoutBufferSize = test.stdoutBufferSize
+			taskRunner.outputMode = test.outputMode
+			err := taskRunner.Process(testCtx, cmdArgs, emptyTaskInput)
+			require.Equal(t, test.expectedError, err)
+		})
+	}
+
+	t.Run("output line that fits in a larger stdout buffer", func(t *testing.T) {
+		t.Parallel()
+		testCtx, testCtxCancel := context.WithCancel(context.Background())
+		defer testCtxCancel()
+		cmdArgs := []string{"40000"}
+
+		controller := gomock.NewController(t)
+		defer controller.Finish()
+		mockSFN := mocks.NewMockSFNAPI(controller)
+		mockSFN.EXPECT().SendTaskSuccess(gomock.Any(), &sfn.SendTaskSuccessInput{
+			Output:    aws.String(`{"_EXECUTION_NAME":"fake-WFM-uuid","data":"` + strings.Repeat("x", 40000) + `"}`),
+			TaskToken: aws.String(mockTaskToken),
+		})
+		taskRunner := NewTaskRunner(path.Join(testScriptsDir, cmd), mockSFN, mockTaskToken, "")
+		taskRunner.stdoutBufferSize = 65536
+		require.NoError(t, taskRunner.Process(testCtx, cmdArgs, emptyTaskInput))
+	})
+}
+
+func TestLastLineWriter(t *testing.T) {
+	l := &lastLineWriter{}
+	l.Write([]byte("first line\nsec"))
+	l.Write([]byte("ond line\n\n"))
+	require.Equal(t, len("second line"), l.size())
+	require.False(t, l.truncatedIn(int64(len("second line\n\n"))))
+	require.True(t, l.truncatedIn(int64(len("second line\n"))))
+	l.Write([]byte("third"))
+	require.Equal(t, len("third"), l.size())
+	require.False(t, l.truncatedIn(int64(len("third"))))
+}
+
+func TestTaskPayloadOffloading(t *testing.T) {
+	fake := s3fake.NewServer()
+	defer fake.Close()
+
+	t.Run("output too large for Step Functions is uploaded", func(t *testing.T) {
+		testCtx, testCtxCancel := context.WithCancel(context.Background())
+		defer testCtxCancel()
+		cmd := "stdout_long_line.sh"
+		cmdArgs := []string{fmt.Sprintf("%d", maxTaskOutputLength)}
+		expectedOutput := `{"_EXECUTION_NAME":"fake-WFM-uuid","data":"` + strings.Repeat("x", maxTaskOutputLength) + `"}`
+		expectedPointer := payloadPointer{
+			Bucket: "payloads",
+			Key:    "sfncli/fake-WFM-uuid/" + sha256Hex([]byte(expectedOutput)) + ".json",
+			Size:   int64(len(expectedOutput)),
+			SHA256: sha256Hex([]byte(expectedOutput)),
+		}
+		expectedEnvelope, _ := json.Marshal(map[string]interface{}{"_EXECUTION_NAME": "fake-WFM-uuid", "_SFNCLI_PAYLOAD": expectedPointer})
+
+		controller := gomock.NewController(t)
+		defer controller.Finish()
+		mockSFN := mocks.NewMockSFNAPI(controller)
+		mockSFN.EXPECT().SendTaskSuccess(gomock.Any(), &sfn.SendTaskSuccessInput{
+			Output:    aws.String(string(expectedEnvelope)),
+			TaskToken: aws.String(mockTaskToken),
+		})
+		taskRunner := NewTaskRunner(path.Join(testScriptsDir, cmd), mockSFN, mockTaskToken, "")
+		taskRunner.outputMode = outputModeFile
+		taskRunner.payloads = newFakePayloadStore(fake)
+		require.NoError(t, taskRunner.Process(testCtx, cmdArgs, emptyTaskInput))
+
+		stored, ok := fake.Object(expectedPointer.Bucket, expectedPointer.Key)
+		require.True(t, ok)
+		require.Equal(t, expectedOutput, string(stored))
+	})
+
+	t.Run("pointer input is downloaded", func(t *testing.T) {
+		testCtx, testCtxCancel := context.WithCancel(context.Background())
+		defer testCtxCancel()
+		cmd := "echo_input.sh"
+		cmdArgs := []string{inputModeStdin}
+		payload := []byte(`{"_EXECUTION_NAME":"previous-execution","big":"input"}`)
+		fake.PutObject("payloads", "input.json", payload)
+		taskInput := fmt.Sprintf(`{"_EXECUTION_NAME":"fake-WFM-uuid","_SFNCLI_PAYLOAD":{"bucket":"payloads","key":"input.json","size":%d,"sha256":"%s"}}`, len(payload), sha256Hex(payload))
+
+		controller := gomock.NewController(t)
+		defer controller.Finish()
+		mockSFN := mocks.NewMockSFNAPI(controller)
+		mockSFN.EXPECT().SendTaskSuccess(gomock.Any(), &sfn.SendTaskSuccessInput{
+			Output:    aws.String(`{"_EXECUTION_NAME":"fake-WFM-uuid","args":1,"input":{"_EXECUTION_NAME":"fake-WFM-uuid","big":"input"}}`),
+			TaskToken: aws.String(mockTaskToken),
+		})
+		taskRunner := NewTaskRunner(path.Join(testScriptsDir, cmd), mockSFN, mockTaskToken, "")
+		taskRunner.inputMode = inputModeStdin
+		taskRunner.payloads = newFakePayloadStore(fake)
+		require.NoError(t, taskRunner.Process(testCtx, cmdArgs, taskInput))
+	})
+
+	t.Run("pointer input fails without offloading", func(t *testing.T) {
+		testCtx, testCtxCancel := context.WithCancel(context.Background())
+		defer testCtxCancel()
+		taskInput := `{"_EXECUTION_NAME":"fake-WFM-uuid","_SFNCLI_PAYLOAD":{"bucket":"payloads","key":"input.json","size":1,"sha256":"abc"}}`
+		expectedError := TaskFailureTaskInputPayloadUnavailable{errors.New("task input is a payload pointer, but payload offloading is not enabled")}
+
+		controller := gomock.NewController(t)
+		defer controller.Finish()
+		mockSFN := mocks.NewMockSFNAPI(controller)
+		mockSFN.EXPECT().SendTaskFailure(gomock.Any(), &sfn.SendTaskFailureInput{
+			Cause:     aws.String(expectedError.ErrorCause()),
+			Error:     aws.String(expectedError.ErrorName()),
+			TaskToken: aws.String(mockTaskToken),
+		})
+		taskRunner := NewTaskRunner(path.Join(testScriptsDir, "echo"), mockSFN, mockTaskToken, "")
+		err := taskRunner.Process(testCtx, []string{}, taskInput)
+		require.Equal(t, expectedError, err)
+	})
+}
@@ -2,23 +2,24 @@ package main
 
 import (
 	"context"
-	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"net/url"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/Clever/kayvee-go/v7/logger"
+	"github.com/Clever/sfncli/worker"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/sfn"
 	"github.com/aws/aws-sdk-go-v2/service/sfn/types"
-	"github.com/aws/smithy-go"
-	"golang.org/x/time/rate"
 )
 
 var log = logger.New("sfncli")
@@ -27,13 +28,53 @@ var log = logger.New("sfncli")
 var Version string
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "run" {
+		os.Exit(runLocal(os.Args[2:], os.Stdout))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "classify" {
+		os.Exit(classify(os.Args[2:], os.Stdin, os.Stdout))
+	}
+
 	activityName := flag.String("activityname", "", "The activity name to register with AWS Step Functions. $VAR and ${VAR} env variables are expanded.")
 	workerName := flag.String("workername", "", "The worker name to send to AWS Step Functions when processing a task. Environment variables are expanded. The magic string MAGIC_ECS_TASK_ARN will be expanded to the ECS task ARN via the metadata service.")
 	cmd := flag.String("cmd", "", "The command to run to process activity tasks.")
+	httpEndpoint := flag.String("http-endpoint", "", "POST the input of activity tasks to this URL, e.g. a service running next to sfncli, instead of running a command. A 2xx JSON response is the output of the task. Alternative to cmd.")
+	httpTimeout := flag.Duration("http-timeout", defaultHTTPTimeout, "How long to wait for a response from http-endpoint before failing the task with sfncli.HTTPTimedOut, unless task-timeout is shorter. The deadline is sent in the X-Sfncli-Deadline header.")
 	region := flag.String("region", "", "The AWS region to send Step Function API calls. Defaults to AWS_REGION.")
 	cloudWatchRegion := flag.String("cloudwatchregion", "", "The AWS region to report metrics. Defaults to the value of the region flag.")
 	workDirectory := flag.String("workdirectory", "", "Create the specified directory pass the path using the environment variable WORK_DIR to the cmd processing a task. Default is to not create the path.")
+	concurrency := flag.Int("concurrency", 1, "The number of activity tasks to process concurrently. Each task is polled for and run by its own slot.")
+	heartbeatMode := flag.String("heartbeat-mode", heartbeatModeAlways, "How task heartbeats are sent to AWS Step Functions. 'always' sends them while the command runs. 'command' only forwards them while the command checks in on the socket at SFNCLI_CONTROL_SOCKET, and fails the task with sfncli.CommandStalled if it goes quiet for command-heartbeat-timeout.")
+	commandHeartbeatTimeout := flag.Duration("command-heartbeat-timeout", 5*time.Minute, "In the 'command' heartbeat-mode, how long the command may go without checking in before it is stopped.")
+	drainTimeout := flag.Duration("drain-timeout", 0, "On SIGTERM, stop polling for tasks and give the tasks in progress this long to finish before they are terminated. A second SIGTERM terminates them right away. Default is to terminate them right away.")
+	pollGracePeriod := flag.Duration("poll-grace-period", worker.DefaultPollGracePeriod, "When sfncli stops polling, e.g. on SIGTERM, how long a poll already in flight may still receive a task, which is failed with sfncli.WorkerShuttingDown so that a Retry policy can reschedule it. The poll is canceled after that, or right away on a second SIGTERM.")
+	maxTasks := flag.Int("max-tasks", 0, "Stop polling for tasks after this many tasks, and exit once they are done with an exit code for the outcome of the last task. Default is to run until SIGTERM.")
+	runOnce := flag.Bool("run-once", false, "Process a single task and exit. Same as max-tasks 1.")
+	idleTimeout := flag.Duration("idle-timeout", 0, "Exit once no task was in progress for this long, with an exit code for the outcome of the last task. Default is to run until SIGTERM.")
+	taskTimeout := flag.Duration("task-timeout", 0, "Stop the command and fail the task with sfncli.CommandTimedOut if it runs longer than this. A task can override it with a _SFNCLI_TIMEOUT_SECONDS field in its input. Default is no timeout.")
+	forwardSignals := flag.String("forward-signals", "HUP,INT,QUIT,USR1,USR2", "The signals sfncli forwards to the command, as a comma separated list. SIGTERM is always handled: it is forwarded, followed by SIGKILL after sigterm-grace-period.")
+	translateSignals := flag.String("translate-signals", "", "Signals sfncli sends the command as another signal, as a comma separated list like INT=TERM. A signal translated to TERM is handled like SIGTERM.")
+	sigtermGracePeriod := flag.Duration("sigterm-grace-period", defaultSigtermGracePeriod, "How long the command has to exit after sfncli forwards SIGTERM to it before it is sent SIGKILL.")
+	workerMode := flag.String("worker-mode", workerModeExec, "How the command is run. 'exec' runs it once for every task. 'persistent' starts it once per concurrency slot and sends it tasks as JSON lines on stdin, reading a JSON line result back from stdout. input-mode and output-mode do not apply to persistent workers.")
+	inputMode := flag.String("input-mode", inputModeArgv, "How the task input is passed to the command. 'argv' appends it as the last argument. 'stdin' writes it to the command's stdin. 'file' writes it to the file at SFNCLI_INPUT_FILE. Activities in a config file can override it.")
+	causeFormat := flag.String("cause-format", causeFormatText, "How the cause of a task failure is reported. 'text' reports it as is, e.g. the end of the command's stderr. 'json' reports a JSON document with the error name, cause, exit code or signal, duration, worker name, sfncli version, execution name and the end of stderr, which a Catch state can parse with States.StringToJson.")
+	errorEnvelope := flag.Bool("error-envelope", false, "Fail the task when its output has a _sfncli_error field like {\"error\": \"custom.error_name\", \"cause\": \"...\"}, even if the command exited 0. The other fields of the output are added to the cause as a partial result.")
+	outputMode := flag.String("output-mode", outputModeStdout, "Where the task output is read from. 'stdout' uses the last line of the command's stdout. 'file' uses the whole file at SFNCLI_OUTPUT_FILE, so stdout is only used for logs.")
+	stdoutBufferSize := flag.Int("stdout-buffer-size", defaultStdoutBufferSize, "How many bytes of the end of the command's stdout are kept to find the task output, up to the Step Functions limit of 262144, or 8388608 if payload-bucket is set. A task output line longer than this fails with sfncli.TaskOutputTooLarge.")
+	stderrBufferSize := flag.Int("stderr-buffer-size", defaultStderrBufferSize, "How many bytes of the end of the command's stderr are kept to use as the cause of a task failure, up to the Step Functions limit of 32768.")
 	printVersion := flag.Bool("version", false, "Print the version and exit.")
+	sfnEndpoint := flag.String("sfn-endpoint", "", "Send Step Function API calls to this endpoint URL instead of the default AWS endpoint, e.g. Step Functions Local or a VPC endpoint. Defaults to AWS_ENDPOINT_URL_SFN.")
+	cloudWatchEndpoint := flag.String("cloudwatch-endpoint", "", "Send metric data to this endpoint URL instead of the default AWS endpoint, e.g. LocalStack or a VPC endpoint. Defaults to AWS_ENDPOINT_URL_CLOUDWATCH.")
+	payloadBucket := flag.String("payload-bucket", "", "Upload task outputs larger than Step Functions accepts to this S3 bucket and send a pointer to them instead, and download task inputs that are pointers, which requires input-mode stdin or file. Default is to not offload payloads.")
+	payloadPrefix := flag.String("payload-prefix", "", "A prefix for the keys of payloads uploaded to payload-bucket.")
+	s3Endpoint := flag.String("s3-endpoint", "", "Send S3 API calls to this endpoint URL instead of the default AWS endpoint, e.g. MinIO. Path-style addressing is used when it is set. Defaults to AWS_ENDPOINT_URL_S3.")
+	configFile := flag.String("config", "", "A YAML or JSON config file to read options from. Flags passed on the command line override values in the file.")
+	var exitCodeRules exitCodeErrors
+	flag.Var(&exitCodeRules, "exit-code-error", "Fail the task with an error name when the command exits with an exit code, as codes=name[:cause], e.g. 75=MyTool.TempFailure or 64-78=MyTool.Failed. The cause is a Go template with .ExitCode and .Stderr, and defaults to the end of stderr. May be repeated; the first match wins. A custom error in the output of the command takes precedence.")
+	var stderrRules stderrErrors
+	flag.Var(&stderrRules, "stderr-error", "Fail the task with an error name when the stderr of a command that exits nonzero matches a regular expression, as name=regexp, e.g. 'Transient.Network=connection reset by peer|Throttling'. May be repeated; the first match wins. Exit code errors take precedence. Test rules with sfncli classify.")
+	var bindings activityBindings
+	flag.Var(&bindings, "activity", "An activity to register and the command that processes its tasks, as name=cmd [args...]. May be repeated to serve several activities from one process. Environment variables are expanded. Alternative to activityname and cmd.")
 
 	flag.Parse()
 
@@ -42,17 +83,30 @@ func main() {
 		os.Exit(0)
 	}
 
-	if *activityName == "" {
-		fmt.Println("activityname is required")
-		os.Exit(1)
-	}
+	// values from a config file are expanded when it is loaded, so only the command line is expanded here
 	*activityName = os.ExpandEnv(*activityName)
+	*workerName = os.ExpandEnv(*workerName)
+	*cmd = os.ExpandEnv(*cmd) // Allow environment variable substition in the cmd flag.
+	*httpEndpoint = os.ExpandEnv(*httpEndpoint)
+	*cloudWatchRegion = os.ExpandEnv(*cloudWatchRegion)
+
+	fileCfg := fileConfig{}
+	if *configFile != "" {
+		var err error
+		if fileCfg, err = loadConfigFile(*configFile); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if err := fileCfg.apply(flag.CommandLine, &bindings); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
 
 	if *workerName == "" {
 		fmt.Println("workername is required")
 		os.Exit(1)
 	}
-	*workerName = os.ExpandEnv(*workerName)
 	if newWorkerName, err := expandECSMagicStrings(*workerName); err != nil {
 		fmt.Printf("error expanding %s: %s", magicECSTaskARN, err)
 		os.Exit(1)
@@ -60,11 +114,34 @@ func main() {
 		*workerName = newWorkerName
 	}
 
-	if *cmd == "" {
-		fmt.Println("cmd is required")
+	cmdArgs := flag.Args()
+	if len(cmdArgs) == 0 {
+		cmdArgs = fileCfg.Args
+	}
+	if len(bindings) == 0 {
+		if *activityName == "" {
+			fmt.Println("activityname or activity is required")
+			os.Exit(1)
+		}
+		if *cmd == "" && *httpEndpoint == "" {
+			fmt.Println("cmd or http-endpoint is required")
+			os.Exit(1)
+		}
+		if *cmd != "" && *httpEndpoint != "" {
+			fmt.Println("cmd cannot be combined with http-endpoint")
+			os.Exit(1)
+		}
+		bindings = activityBindings{{
+			name: *activityName,
+			cmd:  *cmd,
+			// Treat unprocessed args (flag.Args()) as additional args to
+			// send to the command on every invocation of the command
+			cmdArgs: cmdArgs,
+		}}
+	} else if *activityName != "" || *cmd != "" || *httpEndpoint != "" || len(cmdArgs) > 0 {
+		fmt.Println("activity cannot be combined with activityname, cmd, http-endpoint or additional args")
 		os.Exit(1)
 	}
-	*cmd = os.ExpandEnv(*cmd) // Allow environment variable substition in the cmd flag.
 
 	if *region == "" {
 		*region = os.Getenv("AWS_REGION")
@@ -75,8 +152,150 @@ func main() {
 	}
 	if *cloudWatchRegion == "" {
 		*cloudWatchRegion = *region
-	} else {
-		*cloudWatchRegion = os.ExpandEnv(*cloudWatchRegion)
+	}
+
+	if *sfnEndpoint == "" {
+		*sfnEndpoint = os.Getenv("AWS_ENDPOINT_URL_SFN")
+	}
+	if err := validateEndpoint("sfn-endpoint", *sfnEndpoint); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if *cloudWatchEndpoint == "" {
+		*cloudWatchEndpoint = os.Getenv("AWS_ENDPOINT_URL_CLOUDWATCH")
+	}
+	if err := validateEndpoint("cloudwatch-endpoint", *cloudWatchEndpoint); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if *s3Endpoint == "" {
+		*s3Endpoint = os.Getenv("AWS_ENDPOINT_URL_S3")
+	}
+	if err := validateEndpoint("s3-endpoint", *s3Endpoint); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if *runOnce {
+		if *maxTasks != 0 && *maxTasks != 1 {
+			fmt.Println("run-once cannot be combined with max-tasks")
+			os.Exit(1)
+		}
+		*maxTasks = 1
+	}
+	if *maxTasks < 0 {
+		fmt.Println("max-tasks cannot be negative")
+		os.Exit(1)
+	}
+	if *idleTimeout < 0 {
+		fmt.Println("idle-timeout cannot be negative")
+		os.Exit(1)
+	}
+	signals, err := parseSignalPolicy(*forwardSignals, *translateSignals)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if *sigtermGracePeriod < 0 {
+		fmt.Println("sigterm-grace-period cannot be negative")
+		os.Exit(1)
+	}
+	if *taskTimeout < 0 {
+		fmt.Println("task-timeout cannot be negative")
+		os.Exit(1)
+	}
+	if *drainTimeout < 0 {
+		fmt.Println("drain-timeout cannot be negative")
+		os.Exit(1)
+	}
+	if *pollGracePeriod <= 0 {
+		fmt.Println("poll-grace-period must be positive")
+		os.Exit(1)
+	}
+
+	var httpEndpointHandler *httpHandler
+	if *httpEndpoint != "" {
+		if err := validateEndpoint("http-endpoint", *httpEndpoint); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if *httpTimeout <= 0 {
+			fmt.Println("http-timeout must be positive")
+			os.Exit(1)
+		}
+		if *heartbeatMode == heartbeatModeCommand || *workerMode == workerModePersistent {
+			fmt.Println("http-endpoint cannot be combined with heartbeat-mode command or worker-mode persistent")
+			os.Exit(1)
+		}
+		httpEndpointHandler = newHTTPHandler(*httpEndpoint, *httpTimeout)
+	}
+
+	switch *heartbeatMode {
+	case heartbeatModeAlways:
+		*commandHeartbeatTimeout = 0
+	case heartbeatModeCommand:
+		if *commandHeartbeatTimeout <= 0 {
+			fmt.Println("command-heartbeat-timeout must be positive")
+			os.Exit(1)
+		}
+	default:
+		fmt.Printf("heartbeat-mode must be %s or %s\n", heartbeatModeAlways, heartbeatModeCommand)
+		os.Exit(1)
+	}
+
+	switch *workerMode {
+	case workerModeExec:
+	case workerModePersistent:
+		if *heartbeatMode == heartbeatModeCommand {
+			fmt.Println("heartbeat-mode command is not supported by persistent workers")
+			os.Exit(1)
+		}
+	default:
+		fmt.Printf("worker-mode must be %s or %s\n", workerModeExec, workerModePersistent)
+		os.Exit(1)
+	}
+
+	for i := range bindings {
+		if bindings[i].inputMode == "" {
+			bindings[i].inputMode = *inputMode
+		}
+		if err := validateInputMode(bindings[i].inputMode); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		// a downloaded input is larger than the kernel allows for a single argument
+		if *payloadBucket != "" && *workerMode == workerModeExec && *httpEndpoint == "" && bindings[i].inputMode == inputModeArgv {
+			fmt.Printf("payload-bucket requires input-mode %s or %s for activity %s\n", inputModeStdin, inputModeFile, bindings[i].name)
+			os.Exit(1)
+		}
+	}
+
+	if err := validateOutputMode(*outputMode); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if err := validateCauseFormat(*causeFormat); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	stdoutBufferLimit := maxTaskOutputLength
+	if *payloadBucket != "" {
+		stdoutBufferLimit = maxStdoutBufferSize
+	}
+	if err := validateBufferSize("stdout-buffer-size", *stdoutBufferSize, stdoutBufferLimit); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if err := validateBufferSize("stderr-buffer-size", *stderrBufferSize, maxTaskFailureCauseLength); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if *concurrency < 1 {
+		fmt.Println("concurrency must be at least 1")
+		os.Exit(1)
 	}
 
 	if *workDirectory != "" {
@@ -86,11 +305,29 @@ func main() {
 		}
 	}
 
+	var drain *drainer
+	if *drainTimeout > 0 {
+		drain = newDrainer(*drainTimeout)
+	}
 	mainCtx, mainCtxCancel := context.WithCancel(context.Background())
+	// without a drain, the polls in flight outlive mainCtx by poll-grace-period unless a second signal cancels them
+	cancelPolls := make(chan struct{})
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, os.Signal(syscall.SIGTERM))
 	go func() {
 		for range c {
+			if drain != nil {
+				drain.signal()
+				continue
+			}
+			if mainCtx.Err() != nil {
+				select {
+				case <-cancelPolls:
+				default:
+					close(cancelPolls)
+				}
+				continue
+			}
 			// sig is a ^C, handle it
 			mainCtxCancel()
 		}
@@ -103,131 +340,166 @@ func main() {
 		os.Exit(1)
 	}
 
-	// register the activity with AWS (it might already exist, which is ok)
-	activityTags := tagsFromEnv()
-	sfnapi := sfn.NewFromConfig(cfg)
-	createOutput, err := sfnapi.CreateActivity(mainCtx, &sfn.CreateActivityInput{
-		Name: aws.String(*activityName),
-		Tags: activityTags,
-	})
-	if err != nil {
-		fmt.Printf("error creating activity: %s\n", err)
-		os.Exit(1)
-	}
-
-	// if the activity already exists, tags won't be applied, so explicitly
-	// set tags here
-	if _, err := sfnapi.TagResource(mainCtx, &sfn.TagResourceInput{
-		ResourceArn: createOutput.ActivityArn,
-		Tags:        activityTags,
-	}); err != nil {
-		fmt.Printf("error tagging activity: %s\n", err)
-		os.Exit(1)
-	}
-
-	log.InfoD("startup", logger.M{
-		"activity":       *createOutput.ActivityArn,
-		"worker-name":    *workerName,
-		"work-directory": *workDirectory,
-	})
-
 	// set up cloudwatch metric reporting
 	cwcfg, err := config.LoadDefaultConfig(mainCtx, config.WithRegion(*cloudWatchRegion))
 	if err != nil {
 		fmt.Printf("error loading CloudWatch config: %s\n", err)
 		os.Exit(1)
 	}
-	cwapi := cloudwatch.NewFromConfig(cwcfg)
-	cw := NewCloudWatchReporter(cwapi, *createOutput.ActivityArn)
-	go cw.ReportActivePercent(mainCtx, 60*time.Second)
-	cw.SetActiveState(true)
-
-	// allow one GetActivityTask per second, max 1 at a time
-	limiter := rate.NewLimiter(rate.Every(1*time.Second), 1)
-
-	// run getactivitytask and get some work
-	// getactivitytask claims to initiate a polling loop, but it seems to return every few minutes with
-	// a nil error and empty output. So wrap it in a polling loop of our own
-	for mainCtx.Err() == nil {
-		select {
-		case <-mainCtx.Done():
-			log.Info("getactivitytask-stop")
-		default:
-			cw.SetActiveState(false)
-			// setting paused here so the time spent waiting for the limiter is not counted as time
-			// the task is inactive in the activePercent calculation
-			cw.SetPausedState(true)
-			if err := limiter.Wait(mainCtx); err != nil {
-				// must unpause here because no longer waiting for limiter
-				cw.SetPausedState(false)
-				continue
+	cwapi := cloudwatch.NewFromConfig(cwcfg, func(o *cloudwatch.Options) {
+		if *cloudWatchEndpoint != "" {
+			o.BaseEndpoint = aws.String(*cloudWatchEndpoint)
+		}
+	})
+
+	activityTags := fileCfg.mergeTags(tagsFromEnv())
+	sfnapi := sfn.NewFromConfig(cfg, func(o *sfn.Options) {
+		if *sfnEndpoint != "" {
+			o.BaseEndpoint = aws.String(*sfnEndpoint)
+		}
+	})
+	var payloads *payloadStore
+	if *payloadBucket != "" {
+		s3api := s3.NewFromConfig(cfg, func(o *s3.Options) {
+			if *s3Endpoint != "" {
+				o.BaseEndpoint = aws.String(*s3Endpoint)
+				o.UsePathStyle = true
 			}
-			// must unpaused here because no longer waiting for limiter
-			cw.SetPausedState(false)
-
-			log.TraceD("getactivitytask-start", logger.M{
-				"activity-arn": *createOutput.ActivityArn, "worker-name": *workerName,
-			})
-			getATOutput, err := sfnapi.GetActivityTask(mainCtx, &sfn.GetActivityTaskInput{
-				ActivityArn: createOutput.ActivityArn,
-				WorkerName:  aws.String(*workerName),
-			})
-			if err != nil {
-				// if the context is canceled or request is canceled, we can continue
-				if err == context.Canceled {
-					log.Warn("getactivitytask-cancel")
-					continue
-				}
-				var opErr *smithy.OperationError
-				if errors.As(err, &opErr) && opErr.Err.Error() == "request canceled" {
-					log.Warn("getactivitytask-cancel")
-					continue
-				}
-				log.ErrorD("getactivitytask-error", logger.M{"error": err.Error()})
-				continue
+		})
+		payloads = &payloadStore{s3api: s3api, bucket: *payloadBucket, prefix: *payloadPrefix}
+	}
+
+	// register every activity before polling for any of them, so that a bad
+	// binding fails startup instead of leaving some activities unserved
+	workers := []*worker.Worker{}
+	handlers := []*execHandler{}
+	var limits *runLimits
+	if *maxTasks > 0 || *idleTimeout > 0 {
+		limits = newRunLimits(*maxTasks, *idleTimeout, func() {
+			for _, w := range workers {
+				w.Drain()
 			}
-			if getATOutput.TaskToken == nil { // No jobs to do
-				log.Debug("getactivitytask-skip")
-				continue
+		})
+	}
+	for _, binding := range bindings {
+		handler := &execHandler{
+			cmd:           binding.cmd,
+			cmdArgs:       binding.cmdArgs,
+			workDirectory: *workDirectory,
+
+			commandHeartbeatTimeout: *commandHeartbeatTimeout,
+			taskTimeout:             *taskTimeout,
+			causeFormat:             *causeFormat,
+			workerName:              *workerName,
+			errorEnvelope:           *errorEnvelope,
+			exitCodeErrors:          exitCodeRules,
+			stderrErrors:            stderrRules,
+			sigtermGracePeriod:      *sigtermGracePeriod,
+			signals:                 signals,
+			inputMode:               binding.inputMode,
+			outputMode:              *outputMode,
+			stdoutBufferSize:        *stdoutBufferSize,
+			stderrBufferSize:        *stderrBufferSize,
+			payloads:                payloads,
+			httpHandler:             httpEndpointHandler,
+		}
+		if *workerMode == workerModePersistent {
+			for slot := 0; slot < *concurrency; slot++ {
+				handler.persistentWorkers = append(handler.persistentWorkers, newPersistentWorker(binding.cmd, binding.cmdArgs, *stderrBufferSize))
 			}
+		}
 
-			cw.SetActiveState(true)
-			input := *getATOutput.Input
-			token := *getATOutput.TaskToken
-			log.TraceD("getactivitytask", logger.M{"input": input, "token": token})
-
-			// Create a context for this task. We'll cancel this context on errors.
-			taskCtx, taskCtxCancel := context.WithCancel(mainCtx)
-
-			// Begin sending heartbeats
-			go func() {
-				if err := taskHeartbeatLoop(taskCtx, sfnapi, token); err != nil {
-					log.ErrorD("heartbeat-error", logger.M{"error": err.Error()})
-					// taskHeartBeatLoop only returns errors when they should be treated as critical
-					// e.g., if the task timed out
-					// shut down the command in these cases
-					taskCtxCancel()
-					return
-				}
-				log.TraceD("heartbeat-end", logger.M{"token": token})
-			}()
+		var workerHandler worker.Handler = handler
+		if limits != nil {
+			workerHandler = limits.handler(handler)
+		}
+		w, err := worker.New(worker.Config{
+			ActivityName:    binding.name,
+			WorkerName:      *workerName,
+			Tags:            activityTags,
+			Concurrency:     *concurrency,
+			PollGracePeriod: *pollGracePeriod,
+			SFN:             sfnapi,
+			CloudWatch:      cwapi,
+			Handler:         workerHandler,
+		})
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if drain != nil {
+			handler.terminate = drain.terminate
+			drain.add(w)
+		} else {
+			go func(w *worker.Worker) {
+				<-cancelPolls
+				w.CancelPolls()
+			}(w)
+		}
+		activityArn, err := w.Register(mainCtx)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
 
-			// Run the command. Treat unprocessed args (flag.Args()) as additional args to
-			// send to the command on every invocation of the command
-			taskRunner := NewTaskRunner(*cmd, sfnapi, token, *workDirectory)
-			err = taskRunner.Process(taskCtx, flag.Args(), input)
-			if err != nil {
-				log.ErrorD("task-process-error", logger.M{"error": err.Error()})
-				taskCtxCancel()
-				continue
-			}
+		log.InfoD("startup", logger.M{
+			"activity":             activityArn,
+			"cmd":                  binding.cmd,
+			"http-endpoint":        *httpEndpoint,
+			"worker-name":          *workerName,
+			"work-directory":       *workDirectory,
+			"concurrency":          *concurrency,
+			"heartbeat-mode":       *heartbeatMode,
+			"worker-mode":          *workerMode,
+			"input-mode":           binding.inputMode,
+			"output-mode":          *outputMode,
+			"cause-format":         *causeFormat,
+			"error-envelope":       *errorEnvelope,
+			"payload-bucket":       *payloadBucket,
+			"drain-timeout":        drainTimeout.String(),
+			"poll-grace-period":    pollGracePeriod.String(),
+			"task-timeout":         taskTimeout.String(),
+			"exit-code-errors":     exitCodeRules.String(),
+			"stderr-errors":        stderrRules.String(),
+			"forward-signals":      *forwardSignals,
+			"translate-signals":    *translateSignals,
+			"sigterm-grace-period": sigtermGracePeriod.String(),
+			"max-tasks":            *maxTasks,
+			"idle-timeout":         idleTimeout.String(),
+		})
+		workers = append(workers, w)
+		handlers = append(handlers, handler)
+	}
 
-			// success!
-			taskCtxCancel()
-		}
+	if limits != nil {
+		limits.start()
+	}
+	// every activity is polled independently, with its own slots and metrics
+	var wg sync.WaitGroup
+	for _, w := range workers {
+		wg.Add(1)
+		go func(w *worker.Worker) {
+			defer wg.Done()
+			if err := w.Run(mainCtx); err != nil {
+				log.ErrorD("worker-run-error", logger.M{"activity": w.ActivityArn(), "error": err.Error()})
+			}
+		}(w)
+	}
+	wg.Wait()
+	for _, handler := range handlers {
+		handler.stop()
+	}
+	if limits != nil {
+		os.Exit(limits.exitCode())
 	}
 }
 
+// heartbeat modes
+const (
+	heartbeatModeAlways  = "always"
+	heartbeatModeCommand = "command"
+)
+
 func tagsFromEnv() []types.Tag {
 	tags := []types.Tag{}
 	if env := os.Getenv("_DEPLOY_ENV"); env != "" {
@@ -255,6 +527,47 @@ func tagsFromEnv() []types.Tag {
 	return tags
 }
 
+// validateEndpoint ensures an endpoint override, if set, is an absolute URL
+func validateEndpoint(name, endpoint string) error {
+	if endpoint == "" {
+		return nil
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("%s must be a URL like https://host:port, got '%s'", name, endpoint)
+	}
+	return nil
+}
+
+// validateBufferSize ensures a capture buffer holds at least a byte and no more than Step Functions accepts.
+func validateBufferSize(name string, size int, limit int) error {
+	if size < 1 || size > limit {
+		return fmt.Errorf("%s must be between 1 and %d", name, limit)
+	}
+	return nil
+}
+
+func validateInputMode(inputMode string) error {
+	if inputMode != inputModeArgv && inputMode != inputModeStdin && inputMode != inputModeFile {
+		return fmt.Errorf("input-mode must be %s, %s or %s", inputModeArgv, inputModeStdin, inputModeFile)
+	}
+	return nil
+}
+
+func validateOutputMode(outputMode string) error {
+	if outputMode != outputModeStdout && outputMode != outputModeFile {
+		return fmt.Errorf("output-mode must be %s or %s", outputModeStdout, outputModeFile)
+	}
+	return nil
+}
+
+func validateCauseFormat(causeFormat string) error {
+	if causeFormat != causeFormatText && causeFormat != causeFormatJSON {
+		return fmt.Errorf("cause-format must be %s or %s", causeFormatText, causeFormatJSON)
+	}
+	return nil
+}
+
 // validateWorkDirectory ensures the directory exists and is writable
 func validateWorkDirectory(dirname string) error {
 	dirInfo, err := os.Stat(dirname)
@@ -279,41 +592,3 @@ func validateWorkDirectory(dirname string) error {
 
 	return nil
 }
-
-func taskHeartbeatLoop(ctx context.Context, sfnapi SFNAPI, token string) error {
-	if err := sendTaskHeartbeat(ctx, sfnapi, token); err != nil {
-		return err
-	}
-	heartbeat := time.NewTicker(20 * time.Second)
-	defer heartbeat.Stop()
-	for {
-		select {
-		case <-ctx.Done():
-			return nil
-		case <-heartbeat.C:
-			if err := sendTaskHeartbeat(ctx, sfnapi, token); err != nil {
-				return err
-			}
-		}
-	}
-}
-
-func sendTaskHeartbeat(ctx context.Context, sfnapi SFNAPI, token string) error {
-	if _, err := sfnapi.SendTaskHeartbeat(ctx, &sfn.SendTaskHeartbeatInput{
-		TaskToken: aws.String(token),
-	}); err != nil {
-		var taskDoesNotExist *types.TaskDoesNotExist
-		var taskTimedOut *types.TaskTimedOut
-		var invalidToken *types.InvalidToken
-		if err != nil && (errors.As(err, &taskDoesNotExist) || errors.As(err, &taskTimedOut) || errors.As(err, &invalidToken)) {
-			return err
-		}
-		if err == context.Canceled {
-			// context was canceled while sending heartbeat
-			return nil
-		}
-		log.ErrorD("heartbeat-error-unknown", logger.M{"error": err.Error()}) // should investigate unknown/unclassified errors
-	}
-	log.Trace("heartbeat-sent")
-	return nil
-}
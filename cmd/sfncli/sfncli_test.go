@@ -30,3 +30,11 @@ func TestValidateWorkDirectory(t *testing.T) {
 		assert.Error(t, err)
 	})
 }
+
+func TestValidateEndpoint(t *testing.T) {
+	assert.NoError(t, validateEndpoint("sfn-endpoint", ""))
+	assert.NoError(t, validateEndpoint("sfn-endpoint", "http://localhost:8083"))
+	assert.NoError(t, validateEndpoint("cloudwatch-endpoint", "https://vpce-1234.monitoring.us-west-2.vpce.amazonaws.com"))
+	assert.Error(t, validateEndpoint("sfn-endpoint", "localhost:8083"))
+	assert.Error(t, validateEndpoint("sfn-endpoint", "not a url"))
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// defaultSigtermGracePeriod is how long the command has to exit after it is sent SIGTERM before it is
+// sent SIGKILL. It is slightly lower than the default docker stop grace period in ECS (30s).
+const defaultSigtermGracePeriod = 25 * time.Second
+
+// signalPolicy is which signals sfncli forwards to the command, and which it translates to another
+// signal first. SIGTERM is not forwarded as is: it starts the terminate-then-kill sequence of the command,
+// and so does any signal translated to SIGTERM.
+type signalPolicy struct {
+	forward   []syscall.Signal
+	translate map[syscall.Signal]syscall.Signal
+}
+
+// defaultSignalPolicy forwards the signals meant for the process rather than the Go runtime or the
+// terminal, e.g. not SIGURG, SIGCHLD or SIGWINCH.
+var defaultSignalPolicy = signalPolicy{
+	forward: []syscall.Signal{syscall.SIGHUP, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGUSR1, syscall.SIGUSR2},
+}
+
+// notify is the signals sfncli listens to while the command runs.
+func (p signalPolicy) notify() []os.Signal {
+	signals := []os.Signal{syscall.SIGTERM}
+	for _, sig := range p.forward {
+		signals = append(signals, sig)
+	}
+	for sig := range p.translate {
+		signals = append(signals, sig)
+	}
+	return signals
+}
+
+// signalFor returns the signal to send the command when sfncli receives sig, if any.
+func (p signalPolicy) signalFor(sig os.Signal) (syscall.Signal, bool) {
+	s, ok := sig.(syscall.Signal)
+	if !ok {
+		return 0, false
+	}
+	if translated, ok := p.translate[s]; ok {
+		return translated, true
+	}
+	if s == syscall.SIGTERM {
+		return s, true
+	}
+	for _, forwarded := range p.forward {
+		if s == forwarded {
+			return s, true
+		}
+	}
+	return 0, false
+}
+
+// signalNames are the signals that can be forwarded or translated, without their SIG prefix.
+var signalNames = map[string]syscall.Signal{
+	"ABRT":  syscall.SIGABRT,
+	"ALRM":  syscall.SIGALRM,
+	"CONT":  syscall.SIGCONT,
+	"HUP":   syscall.SIGHUP,
+	"INT":   syscall.SIGINT,
+	"KILL":  syscall.SIGKILL,
+	"PIPE":  syscall.SIGPIPE,
+	"QUIT":  syscall.SIGQUIT,
+	"STOP":  syscall.SIGSTOP,
+	"TERM":  syscall.SIGTERM,
+	"TSTP":  syscall.SIGTSTP,
+	"TTIN":  syscall.SIGTTIN,
+	"TTOU":  syscall.SIGTTOU,
+	"USR1":  syscall.SIGUSR1,
+	"USR2":  syscall.SIGUSR2,
+	"WINCH": syscall.SIGWINCH,
+}
+
+// uncatchableSignals cannot be caught by sfncli, so they can only be what another signal is translated to.
+var uncatchableSignals = map[syscall.Signal]bool{syscall.SIGKILL: true, syscall.SIGSTOP: true}
+
+// parseCatchableSignal is parseSignal for a signal sfncli receives.
+func parseCatchableSignal(name string) (syscall.Signal, error) {
+	sig, err := parseSignal(name)
+	if err != nil {
+		return 0, err
+	}
+	if uncatchableSignals[sig] {
+		return 0, fmt.Errorf("signal %q cannot be caught, so it cannot be forwarded or translated", name)
+	}
+	return sig, nil
+}
+
+// parseSignal parses a signal name like TERM or SIGTERM.
+func parseSignal(name string) (syscall.Signal, error) {
+	sig, ok := signalNames[strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(name)), "SIG")]
+	if !ok {
+		names := []string{}
+		for name := range signalNames {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return 0, fmt.Errorf("unknown signal %q, must be one of %s", name, strings.Join(names, ", "))
+	}
+	return sig, nil
+}
+
+// parseSignalPolicy parses a comma separated list of signals to forward, e.g. "HUP,USR1", and a comma
+// separated list of translations, e.g. "INT=TERM".
+func parseSignalPolicy(forward, translate string) (signalPolicy, error) {
+	policy := signalPolicy{translate: map[syscall.Signal]syscall.Signal{}}
+	for _, name := range strings.Split(forward, ",") {
+		if strings.TrimSpace(name) == "" {
+			continue
+		}
+		sig, err := parseCatchableSignal(name)
+		if err != nil {
+			return signalPolicy{}, err
+		}
+		policy.forward = append(policy.forward, sig)
+	}
+	for _, translation := range strings.Split(translate, ",") {
+		if strings.TrimSpace(translation) == "" {
+			continue
+		}
+		from, to, ok := strings.Cut(translation, "=")
+		if !ok {
+			return signalPolicy{}, fmt.Errorf("invalid signal translation %q, must be like INT=TERM", translation)
+		}
+		fromSig, err := parseCatchableSignal(from)
+		if err != nil {
+			return signalPolicy{}, err
+		}
+		toSig, err := parseSignal(to)
+		if err != nil {
+			return signalPolicy{}, err
+		}
+		policy.translate[fromSig] = toSig
+	}
+	return policy, nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSignalPolicy(t *testing.T) {
+	t.Run("forwarded and translated signals", func(t *testing.T) {
+		policy, err := parseSignalPolicy("HUP, sigusr1", "INT=TERM")
+		require.NoError(t, err)
+		assert.Equal(t, []syscall.Signal{syscall.SIGHUP, syscall.SIGUSR1}, policy.forward)
+
+		sig, ok := policy.signalFor(syscall.SIGUSR1)
+		assert.True(t, ok)
+		assert.Equal(t, syscall.SIGUSR1, sig)
+		sig, ok = policy.signalFor(syscall.SIGINT)
+		assert.True(t, ok)
+		assert.Equal(t, syscall.SIGTERM, sig)
+		sig, ok = policy.signalFor(syscall.SIGTERM)
+		assert.True(t, ok)
+		assert.Equal(t, syscall.SIGTERM, sig)
+		_, ok = policy.signalFor(syscall.SIGUSR2)
+		assert.False(t, ok)
+		assert.ElementsMatch(t, policy.notify(), []interface{}{syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGINT})
+	})
+
+	t.Run("nothing to forward", func(t *testing.T) {
+		policy, err := parseSignalPolicy("", "")
+		require.NoError(t, err)
+		_, ok := policy.signalFor(syscall.SIGHUP)
+		assert.False(t, ok)
+	})
+
+	t.Run("invalid signals", func(t *testing.T) {
+		_, err := parseSignalPolicy("HUP,NOPE", "")
+		assert.Error(t, err)
+		_, err = parseSignalPolicy("", "INT")
+		assert.Error(t, err)
+		_, err = parseSignalPolicy("", "INT=NOPE")
+		assert.Error(t, err)
+	})
+
+	t.Run("signals that cannot be caught", func(t *testing.T) {
+		_, err := parseSignalPolicy("HUP,KILL", "")
+		assert.EqualError(t, err, `signal "KILL" cannot be caught, so it cannot be forwarded or translated`)
+		_, err = parseSignalPolicy("SIGSTOP", "")
+		assert.Error(t, err)
+		_, err = parseSignalPolicy("", "STOP=TERM")
+		assert.Error(t, err)
+		policy, err := parseSignalPolicy("", "INT=KILL")
+		require.NoError(t, err)
+		sig, ok := policy.signalFor(syscall.SIGINT)
+		assert.True(t, ok)
+		assert.Equal(t, syscall.SIGKILL, sig)
+	})
+
+	t.Run("runtime signals are not forwarded by default", func(t *testing.T) {
+		for _, sig := range []syscall.Signal{syscall.SIGURG, syscall.SIGCHLD, syscall.SIGWINCH, syscall.SIGPIPE} {
+			_, ok := defaultSignalPolicy.signalFor(sig)
+			assert.False(t, ok, sig.String())
+		}
+	})
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// stderrError names the failure of a command whose stderr matches a regular expression, for failures
+// that are only recognizable from their message, e.g. "connection reset by peer".
+type stderrError struct {
+	pattern *regexp.Regexp
+	name    string
+	// value is the rule as it was given, `name=regexp`
+	value string
+}
+
+// stderrErrors is a flag.Value that collects repeated `-stderr-error name=regexp` flags.
+// The first rule that matches the stderr of a command names its failure.
+type stderrErrors []stderrError
+
+func (e *stderrErrors) String() string {
+	if e == nil {
+		return ""
+	}
+	rules := []string{}
+	for _, rule := range *e {
+		rules = append(rules, rule.value)
+	}
+	return strings.Join(rules, ", ")
+}
+
+// Set parses a rule of the form `name=regexp`. The regexp can contain `=`, the error name can't.
+func (e *stderrErrors) Set(value string) error {
+	rule, err := parseStderrError(value)
+	if err != nil {
+		return err
+	}
+	*e = append(*e, rule)
+	return nil
+}
+
+// failure returns the failure of a command with the given stderr, if a rule matches it.
+// The cause is stderr, like for sfncli.CommandExitedNonzero.
+func (e stderrErrors) failure(stderr string) (TaskFailureCustom, bool) {
+	for _, rule := range e {
+		if rule.pattern.MatchString(stderr) {
+			return TaskFailureCustom{Err: rule.name, Cause: stderr}, true
+		}
+	}
+	return TaskFailureCustom{}, false
+}
+
+func parseStderrError(value string) (stderrError, error) {
+	name, pattern, ok := strings.Cut(value, "=")
+	if !ok {
+		return stderrError{}, fmt.Errorf("stderr error '%s' must be of the form name=regexp", value)
+	}
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return stderrError{}, fmt.Errorf("stderr error '%s' is missing an error name", value)
+	}
+	if pattern == "" {
+		return stderrError{}, fmt.Errorf("stderr error '%s' is missing a regexp", value)
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return stderrError{}, fmt.Errorf("stderr error '%s' has an invalid regexp: %s", value, err)
+	}
+	return stderrError{pattern: re, name: name, value: value}, nil
+}
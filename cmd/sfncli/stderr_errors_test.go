@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStderrErrors(t *testing.T) {
+	t.Run("the first matching rule names the error", func(t *testing.T) {
+		var rules stderrErrors
+		require.NoError(t, rules.Set("Transient.Network=connection reset by peer|Throttling"))
+		require.NoError(t, rules.Set("Resource.Disk=(?i)no space left on device"))
+		require.NoError(t, rules.Set("Catch.All=."))
+		assert.Equal(t, "Transient.Network=connection reset by peer|Throttling, Resource.Disk=(?i)no space left on device, Catch.All=.", rules.String())
+
+		failure, ok := rules.failure("upload failed\nThrottlingException: Rate exceeded")
+		assert.True(t, ok)
+		assert.Equal(t, TaskFailureCustom{Err: "Transient.Network", Cause: "upload failed\nThrottlingException: Rate exceeded"}, failure)
+		failure, ok = rules.failure("write /tmp/out: No space left on device")
+		assert.True(t, ok)
+		assert.Equal(t, "Resource.Disk", failure.ErrorName())
+		failure, ok = rules.failure("anything else")
+		assert.True(t, ok)
+		assert.Equal(t, "Catch.All", failure.ErrorName())
+		_, ok = rules.failure("")
+		assert.False(t, ok)
+	})
+
+	t.Run("the regexp can contain =", func(t *testing.T) {
+		var rules stderrErrors
+		require.NoError(t, rules.Set("Bad.Status=status=5[0-9]{2}"))
+		failure, ok := rules.failure("request failed: status=503")
+		assert.True(t, ok)
+		assert.Equal(t, "Bad.Status", failure.ErrorName())
+	})
+
+	t.Run("rejects invalid rules", func(t *testing.T) {
+		var rules stderrErrors
+		for _, value := range []string{"Transient.Network", "=reset", "Transient.Network=", "Transient.Network=(unclosed"} {
+			assert.Error(t, rules.Set(value), value)
+		}
+		assert.Empty(t, rules)
+	})
+}
+
+func TestClassifyExit(t *testing.T) {
+	var exitCodes exitCodeErrors
+	require.NoError(t, exitCodes.Set("75=MyTool.TempFailure"))
+	var stderrRules stderrErrors
+	require.NoError(t, stderrRules.Set("Transient.Network=connection reset by peer"))
+
+	assert.Equal(t, "MyTool.TempFailure", classifyExit(exitCodes, stderrRules, 75, "connection reset by peer").ErrorName())
+	assert.Equal(t, "Transient.Network", classifyExit(exitCodes, stderrRules, 1, "connection reset by peer").ErrorName())
+	assert.Equal(t, TaskFailureCommandExitedNonzero{stderr: "oops"}, classifyExit(exitCodes, stderrRules, 1, "oops"))
+}
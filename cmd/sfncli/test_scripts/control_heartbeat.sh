@@ -0,0 +1,20 @@
+#!/usr/bin/env bash
+
+# send a heartbeat on the control socket every $1 seconds, $2 times
+interval=$1
+count=$2
+
+send() {
+    perl -MIO::Socket::UNIX -e '
+        my $s = IO::Socket::UNIX->new(Peer => $ENV{SFNCLI_CONTROL_SOCKET}) or die "connect: $!";
+        print $s "$ARGV[0]\n";
+    ' "$1"
+}
+
+for i in $(seq 1 $count); do
+    send '{"type": "heartbeat"}'
+    sleep $interval
+done
+send '{"type": "progress", "message": "done"}'
+
+echo "{\"heartbeats\": \"$count\"}"
@@ -0,0 +1,9 @@
+#!/usr/bin/env bash
+# reads the task input the way $1 says it is passed, and outputs it along with the number of args
+
+case "$1" in
+  argv) input="$2" ;;
+  stdin) input=$(cat) ;;
+  file) input=$(cat "$SFNCLI_INPUT_FILE") ;;
+esac
+echo "{\"input\": $input, \"args\": $#}"
@@ -0,0 +1,7 @@
+#!/usr/bin/env bash
+# Pretends to be OOM killed: bumps the oom_kill counter of the fake cgroup v2 memory.events file in $1,
+# then SIGKILLs itself like the kernel would.
+
+echo "allocating too much" >&2
+printf 'low 0\nhigh 0\nmax 1\noom 1\noom_kill 1\n' > "$1"
+kill -9 $$
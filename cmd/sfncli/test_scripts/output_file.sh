@@ -0,0 +1,8 @@
+#!/usr/bin/env bash
+# writes $1 to the output file, then logs to stdout and exits with code $2
+
+if [ -n "$1" ]; then
+  echo "$1" > "$SFNCLI_OUTPUT_FILE"
+fi
+echo "log line after the output was written"
+exit $2
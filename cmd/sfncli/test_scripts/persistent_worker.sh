@@ -0,0 +1,15 @@
+#!/usr/bin/env bash
+# a persistent worker: reads tasks as JSON lines on stdin and responds based on the "action" in their input
+
+count=0
+while read -r line; do
+  count=$((count + 1))
+  echo "log line for task $count"
+  echo '{"level": "error", "error": "a structured log line"}'
+  case "$line" in
+    *'"action":"crash"'*) echo "crashing on task $count" >&2; exit 3 ;;
+    *'"action":"fail"'*) echo '{"_sfncli_response": {"error": "custom.error_name", "cause": "task failed"}}' ;;
+    *'"action":"hang"'*) exec sleep 100 ;;
+    *) echo "{\"_sfncli_response\": {\"output\": {\"pid\": $$, \"count\": $count}}}" ;;
+  esac
+done
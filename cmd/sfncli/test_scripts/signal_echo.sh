@@ -17,8 +17,15 @@ func_trap() {
     exit $exitCode
 }
 
+# wait with the read builtin on a pipe nothing writes to: a command like sleep would send bash a SIGCHLD
+# every time it exits, and SIGCHLD is trapped too
+pipe=$(mktemp -u)
+mkfifo "$pipe"
+exec 3<>"$pipe"
+rm "$pipe"
+
 trap_with_arg func_trap 1 2 3 4 5 6 7 8 9 10 11 12 13 14 15 16 17 18 19 20 21 22 23 24 25 26 27 28 29 30 31 32 33 34 35 36 37 38 39 40 41 42 43 44 45 46 47 48 49 50 51 52 53 54 55 56 57 58 59 60 61 62 63 64
 
 while true; do
-    sleep 1
-done    
+    read -r -u 3
+done
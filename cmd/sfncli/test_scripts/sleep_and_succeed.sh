@@ -0,0 +1,4 @@
+#!/usr/bin/env bash
+
+sleep $1
+echo "{\"slept\": \"$1\"}"
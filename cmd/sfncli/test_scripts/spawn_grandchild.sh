@@ -0,0 +1,8 @@
+#!/usr/bin/env bash
+
+# starts a process that outlives the script unless its process group is stopped
+sleep 100 &
+if [ "$1" == "wait" ]; then
+    wait
+fi
+echo "{\"grandchild\": $!}"
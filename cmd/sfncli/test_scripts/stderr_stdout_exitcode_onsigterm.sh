@@ -16,6 +16,8 @@ function on_sigterm {
 
 trap on_sigterm SIGTERM
 
+# sleep in the background: the SIGTERM reaches it too, and bash would report it dying in the foreground on stderr
 while true; do
-    sleep 1
+    sleep 1 &
+    wait $!
 done
@@ -0,0 +1,10 @@
+#!/usr/bin/env bash
+# prints a log line and then a JSON object with a $1 character string, to stdout or to $SFNCLI_OUTPUT_FILE if it is set
+
+data=$(head -c "$1" /dev/zero | tr '\0' 'x')
+echo "some log line"
+if [ -n "$SFNCLI_OUTPUT_FILE" ]; then
+  echo "{\"data\":\"$data\"}" > "$SFNCLI_OUTPUT_FILE"
+else
+  echo "{\"data\":\"$data\"}"
+fi
@@ -0,0 +1,138 @@
+// Package s3fake is an in-process fake of the subset of the S3 API sfncli uses to offload payloads.
+//
+// It serves path-style PutObject and GetObject requests over an httptest server, so real
+// clients (including the sfncli binary) can be pointed at it by overriding their endpoint
+// and enabling path-style addressing. Every bucket exists and starts out empty.
+package s3fake
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Server is a fake S3 endpoint.
+type Server struct {
+	httpServer *httptest.Server
+
+	mu      sync.Mutex
+	objects map[string][]byte // by bucket/key
+}
+
+// NewServer starts a fake S3 server. Call Close when done.
+func NewServer() *Server {
+	s := &Server{objects: map[string][]byte{}}
+	s.httpServer = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// URL is the endpoint to point S3 clients at.
+func (s *Server) URL() string { return s.httpServer.URL }
+
+// Close shuts down the server.
+func (s *Server) Close() { s.httpServer.Close() }
+
+// PutObject stores an object, as if it was uploaded by a client.
+func (s *Server) PutObject(bucket, key string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[bucket+"/"+key] = append([]byte{}, data...)
+}
+
+// Object returns the contents of an object, if it exists.
+func (s *Server) Object(bucket, key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.objects[bucket+"/"+key]
+	return data, ok
+}
+
+// Keys returns the keys of every object in a bucket.
+func (s *Server) Keys(bucket string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := []string{}
+	for name := range s.objects {
+		if strings.HasPrefix(name, bucket+"/") {
+			keys = append(keys, strings.TrimPrefix(name, bucket+"/"))
+		}
+	}
+	return keys
+}
+
+type apiError struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string   `xml:"Code"`
+	Message string   `xml:"Message"`
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	xml.NewEncoder(w).Encode(apiError{Code: code, Message: message})
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		writeError(w, http.StatusBadRequest, "InvalidRequest", fmt.Sprintf("expected a path-style object request, got %s", r.URL.Path))
+		return
+	}
+	bucket, key := parts[0], parts[1]
+
+	switch r.Method {
+	case http.MethodPut:
+		data, err := readBody(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "InvalidRequest", err.Error())
+			return
+		}
+		s.PutObject(bucket, key, data)
+		w.WriteHeader(http.StatusOK)
+	case http.MethodGet:
+		data, ok := s.Object(bucket, key)
+		if !ok {
+			writeError(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.WriteHeader(http.StatusOK)
+		w.Write(data)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", fmt.Sprintf("%s is not supported", r.Method))
+	}
+}
+
+// readBody reads an upload, decoding the aws-chunked encoding SDKs use to send trailing checksums.
+func readBody(r *http.Request) ([]byte, error) {
+	if !strings.Contains(r.Header.Get("Content-Encoding"), "aws-chunked") {
+		return io.ReadAll(r.Body)
+	}
+	data := []byte{}
+	body := bufio.NewReader(r.Body)
+	for {
+		header, err := body.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("error reading aws-chunked body: %s", err)
+		}
+		sizeField := strings.SplitN(strings.TrimSpace(header), ";", 2)[0]
+		size, err := strconv.ParseInt(sizeField, 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid aws-chunked chunk size '%s'", sizeField)
+		}
+		if size == 0 {
+			return data, nil // the trailers that follow are not checked
+		}
+		chunk := make([]byte, size+2) // the chunk is followed by \r\n
+		if _, err := io.ReadFull(body, chunk); err != nil {
+			return nil, fmt.Errorf("error reading aws-chunked body: %s", err)
+		}
+		data = append(data, chunk[:size]...)
+	}
+}
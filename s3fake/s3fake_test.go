@@ -0,0 +1,64 @@
+package s3fake
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newClient(s *Server) *s3.Client {
+	return s3.New(s3.Options{
+		Region:       "us-west-2",
+		BaseEndpoint: aws.String(s.URL()),
+		UsePathStyle: true,
+		Credentials:  aws.AnonymousCredentials{},
+	})
+}
+
+func TestPutAndGetObject(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	client := newClient(s)
+
+	_, err := client.PutObject(context.Background(), &s3.PutObjectInput{
+		Bucket: aws.String("bucket"),
+		Key:    aws.String("path/to/object.json"),
+		Body:   bytes.NewReader([]byte(`{"hello":"world"}`)),
+	})
+	require.NoError(t, err)
+	data, ok := s.Object("bucket", "path/to/object.json")
+	require.True(t, ok)
+	assert.Equal(t, `{"hello":"world"}`, string(data))
+	assert.Equal(t, []string{"path/to/object.json"}, s.Keys("bucket"))
+
+	s.PutObject("bucket", "other.json", []byte("{}"))
+	out, err := client.GetObject(context.Background(), &s3.GetObjectInput{
+		Bucket: aws.String("bucket"),
+		Key:    aws.String("other.json"),
+	})
+	require.NoError(t, err)
+	defer out.Body.Close()
+	body, err := io.ReadAll(out.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "{}", string(body))
+}
+
+func TestGetMissingObject(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	_, err := newClient(s).GetObject(context.Background(), &s3.GetObjectInput{
+		Bucket: aws.String("bucket"),
+		Key:    aws.String("missing.json"),
+	})
+	var noSuchKey *types.NoSuchKey
+	assert.True(t, errors.As(err, &noSuchKey), "expected NoSuchKey, got %v", err)
+}
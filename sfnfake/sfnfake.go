@@ -0,0 +1,354 @@
+// Package sfnfake is an in-process fake of the AWS Step Functions activity API.
+//
+// It speaks the JSON-1.0 wire protocol used by the AWS SDKs over an httptest server,
+// so real clients (including the sfncli binary) can be pointed at it by overriding
+// their endpoint. Tests queue tasks with AddTask and inspect what workers reported
+// with WaitForResult.
+package sfnfake
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	targetPrefix = "AWSStepFunctions."
+
+	// DefaultPollTimeout is how long GetActivityTask waits for a task before returning an
+	// empty response. It matches the documented behavior of Step Functions.
+	DefaultPollTimeout = 60 * time.Second
+
+	// Region and Account are used to build ARNs of activities.
+	Region  = "us-west-2"
+	Account = "123456789012"
+)
+
+// Result is what a worker reported for a task.
+type Result struct {
+	// Succeeded is true if the worker called SendTaskSuccess, and false if it called SendTaskFailure.
+	Succeeded bool
+	Output    string
+	Error     string
+	Cause     string
+}
+
+// Activity is an activity created with CreateActivity.
+type Activity struct {
+	Name string
+	Arn  string
+	Tags map[string]string
+}
+
+type task struct {
+	activityArn string
+	token       string
+	input       string
+	workerName  string
+	heartbeats  int
+	timedOut    bool
+	result      *Result
+	done        chan struct{}
+}
+
+// Server is a fake Step Functions endpoint.
+type Server struct {
+	// PollTimeout is how long GetActivityTask waits for a task. It can be lowered to speed up tests.
+	PollTimeout time.Duration
+
+	httpServer *httptest.Server
+
+	mu         sync.Mutex
+	activities map[string]*Activity // by ARN
+	queued     map[string][]*task   // by activity ARN
+	tasks      map[string]*task     // by token
+	polls      map[string][]time.Time
+	nextToken  int
+	taskQueued chan struct{} // closed and replaced whenever a task is queued
+}
+
+// NewServer starts a fake Step Functions server. Call Close when done.
+func NewServer() *Server {
+	s := &Server{
+		PollTimeout: DefaultPollTimeout,
+		activities:  map[string]*Activity{},
+		queued:      map[string][]*task{},
+		tasks:       map[string]*task{},
+		polls:       map[string][]time.Time{},
+		taskQueued:  make(chan struct{}),
+	}
+	s.httpServer = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// URL is the endpoint to point Step Functions clients at.
+func (s *Server) URL() string { return s.httpServer.URL }
+
+// Close shuts down the server.
+func (s *Server) Close() { s.httpServer.Close() }
+
+// ActivityArn returns the ARN an activity with the given name has (or will have once created).
+func ActivityArn(name string) string {
+	return fmt.Sprintf("arn:aws:states:%s:%s:activity:%s", Region, Account, name)
+}
+
+// Activity returns the activity with the given name, if it was created.
+func (s *Server) Activity(name string) (Activity, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	activity, ok := s.activities[ActivityArn(name)]
+	if !ok {
+		return Activity{}, false
+	}
+	return *activity, true
+}
+
+// Polls returns the times GetActivityTask was called for an activity.
+func (s *Server) Polls(activityName string) []time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]time.Time{}, s.polls[ActivityArn(activityName)]...)
+}
+
+// AddTask queues a task with the given input for an activity and returns its task token.
+// The activity does not need to exist yet.
+func (s *Server) AddTask(activityName string, input string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextToken++
+	t := &task{
+		activityArn: ActivityArn(activityName),
+		token:       fmt.Sprintf("token-%d", s.nextToken),
+		input:       input,
+		done:        make(chan struct{}),
+	}
+	s.tasks[t.token] = t
+	s.queued[t.activityArn] = append(s.queued[t.activityArn], t)
+	close(s.taskQueued)
+	s.taskQueued = make(chan struct{})
+	return t.token
+}
+
+// TimeOutTask simulates the task timing out in the state machine: any later heartbeat,
+// success or failure for it is rejected with TaskTimedOut.
+func (s *Server) TimeOutTask(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t, ok := s.tasks[token]; ok {
+		t.timedOut = true
+	}
+}
+
+// Heartbeats returns the number of heartbeats sent for a task.
+func (s *Server) Heartbeats(token string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t, ok := s.tasks[token]; ok {
+		return t.heartbeats
+	}
+	return 0
+}
+
+// WorkerName returns the name of the worker that picked up a task.
+func (s *Server) WorkerName(token string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t, ok := s.tasks[token]; ok {
+		return t.workerName
+	}
+	return ""
+}
+
+// WaitForResult waits until a worker reports the result of a task, or the timeout passes.
+func (s *Server) WaitForResult(token string, timeout time.Duration) (Result, bool) {
+	s.mu.Lock()
+	t, ok := s.tasks[token]
+	s.mu.Unlock()
+	if !ok {
+		return Result{}, false
+	}
+	select {
+	case <-t.done:
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return *t.result, true
+	case <-time.After(timeout):
+		return Result{}, false
+	}
+}
+
+// apiError is an error in the format of the JSON-1.0 protocol.
+type apiError struct {
+	status  int
+	code    string
+	message string
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	target := r.Header.Get("X-Amz-Target")
+	if r.Method != http.MethodPost || !strings.HasPrefix(target, targetPrefix) {
+		writeError(w, apiError{http.StatusBadRequest, "UnknownOperationException", fmt.Sprintf("unknown operation %s", target)})
+		return
+	}
+
+	var body map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, apiError{http.StatusBadRequest, "SerializationException", err.Error()})
+		return
+	}
+
+	var resp interface{}
+	var apiErr *apiError
+	switch strings.TrimPrefix(target, targetPrefix) {
+	case "CreateActivity":
+		resp, apiErr = s.createActivity(body)
+	case "TagResource":
+		resp, apiErr = s.tagResource(body)
+	case "GetActivityTask":
+		resp, apiErr = s.getActivityTask(r, body)
+	case "SendTaskHeartbeat":
+		resp, apiErr = s.sendTaskHeartbeat(body)
+	case "SendTaskSuccess":
+		resp, apiErr = s.completeTask(body, Result{Succeeded: true, Output: stringField(body, "output")})
+	case "SendTaskFailure":
+		resp, apiErr = s.completeTask(body, Result{Error: stringField(body, "error"), Cause: stringField(body, "cause")})
+	default:
+		apiErr = &apiError{http.StatusBadRequest, "UnknownOperationException", fmt.Sprintf("unknown operation %s", target)}
+	}
+	if apiErr != nil {
+		writeError(w, *apiErr)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func writeError(w http.ResponseWriter, err apiError) {
+	w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+	w.Header().Set("X-Amzn-ErrorType", err.code)
+	w.WriteHeader(err.status)
+	json.NewEncoder(w).Encode(map[string]string{"__type": err.code, "message": err.message})
+}
+
+func stringField(body map[string]interface{}, name string) string {
+	s, _ := body[name].(string)
+	return s
+}
+
+func (s *Server) createActivity(body map[string]interface{}) (interface{}, *apiError) {
+	name := stringField(body, "name")
+	if name == "" {
+		return nil, &apiError{http.StatusBadRequest, "InvalidName", "name is required"}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	arn := ActivityArn(name)
+	if _, ok := s.activities[arn]; !ok {
+		s.activities[arn] = &Activity{Name: name, Arn: arn, Tags: tagsFromBody(body)}
+	}
+	return map[string]interface{}{
+		"activityArn":  arn,
+		"creationDate": float64(time.Now().Unix()),
+	}, nil
+}
+
+func (s *Server) tagResource(body map[string]interface{}) (interface{}, *apiError) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	activity, ok := s.activities[stringField(body, "resourceArn")]
+	if !ok {
+		return nil, &apiError{http.StatusBadRequest, "ResourceNotFound", "resource not found"}
+	}
+	for key, value := range tagsFromBody(body) {
+		activity.Tags[key] = value
+	}
+	return map[string]interface{}{}, nil
+}
+
+func tagsFromBody(body map[string]interface{}) map[string]string {
+	tags := map[string]string{}
+	list, _ := body["tags"].([]interface{})
+	for _, item := range list {
+		tag, _ := item.(map[string]interface{})
+		tags[stringField(tag, "key")] = stringField(tag, "value")
+	}
+	return tags
+}
+
+// getActivityTask long-polls for a task, like the real service does.
+func (s *Server) getActivityTask(r *http.Request, body map[string]interface{}) (interface{}, *apiError) {
+	arn := stringField(body, "activityArn")
+	s.mu.Lock()
+	if _, ok := s.activities[arn]; !ok {
+		s.mu.Unlock()
+		return nil, &apiError{http.StatusBadRequest, "ActivityDoesNotExist", fmt.Sprintf("activity does not exist: %s", arn)}
+	}
+	s.polls[arn] = append(s.polls[arn], time.Now())
+	s.mu.Unlock()
+
+	timeout := time.NewTimer(s.PollTimeout)
+	defer timeout.Stop()
+	for {
+		s.mu.Lock()
+		if queued := s.queued[arn]; len(queued) > 0 {
+			t := queued[0]
+			s.queued[arn] = queued[1:]
+			t.workerName = stringField(body, "workerName")
+			s.mu.Unlock()
+			return map[string]interface{}{"taskToken": t.token, "input": t.input}, nil
+		}
+		taskQueued := s.taskQueued
+		s.mu.Unlock()
+
+		select {
+		case <-taskQueued:
+		case <-timeout.C:
+			return map[string]interface{}{}, nil
+		case <-r.Context().Done():
+			return map[string]interface{}{}, nil
+		}
+	}
+}
+
+// taskForToken returns the task for a token, or the error the service returns for it.
+// It must be called with the lock held.
+func (s *Server) taskForToken(token string) (*task, *apiError) {
+	t, ok := s.tasks[token]
+	if !ok {
+		return nil, &apiError{http.StatusBadRequest, "InvalidToken", fmt.Sprintf("invalid token: %s", token)}
+	}
+	if t.timedOut {
+		return nil, &apiError{http.StatusBadRequest, "TaskTimedOut", "task timed out"}
+	}
+	if t.result != nil {
+		return nil, &apiError{http.StatusBadRequest, "TaskDoesNotExist", "task already completed"}
+	}
+	return t, nil
+}
+
+func (s *Server) sendTaskHeartbeat(body map[string]interface{}) (interface{}, *apiError) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, apiErr := s.taskForToken(stringField(body, "taskToken"))
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	t.heartbeats++
+	return map[string]interface{}{}, nil
+}
+
+func (s *Server) completeTask(body map[string]interface{}, result Result) (interface{}, *apiError) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, apiErr := s.taskForToken(stringField(body, "taskToken"))
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	t.result = &result
+	close(t.done)
+	return map[string]interface{}{}, nil
+}
@@ -0,0 +1,133 @@
+package sfnfake
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// call makes a JSON-1.0 request the way the AWS SDK does.
+func call(t *testing.T, s *Server, operation string, body interface{}) (int, map[string]interface{}) {
+	b, err := json.Marshal(body)
+	require.NoError(t, err)
+	req, err := http.NewRequest(http.MethodPost, s.URL(), bytes.NewReader(b))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/x-amz-json-1.0")
+	req.Header.Set("X-Amz-Target", targetPrefix+operation)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	var out map[string]interface{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&out))
+	return resp.StatusCode, out
+}
+
+func TestCreateAndTagActivity(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	status, out := call(t, s, "CreateActivity", map[string]interface{}{
+		"name": "echo",
+		"tags": []map[string]string{{"key": "environment", "value": "test"}},
+	})
+	require.Equal(t, http.StatusOK, status)
+	assert.Equal(t, ActivityArn("echo"), out["activityArn"])
+
+	status, _ = call(t, s, "TagResource", map[string]interface{}{
+		"resourceArn": ActivityArn("echo"),
+		"tags":        []map[string]string{{"key": "team", "value": "eng"}},
+	})
+	require.Equal(t, http.StatusOK, status)
+
+	activity, ok := s.Activity("echo")
+	require.True(t, ok)
+	assert.Equal(t, map[string]string{"environment": "test", "team": "eng"}, activity.Tags)
+}
+
+func TestGetActivityTask(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.PollTimeout = 200 * time.Millisecond
+	call(t, s, "CreateActivity", map[string]interface{}{"name": "echo"})
+
+	t.Run("returns an empty response when no task arrives", func(t *testing.T) {
+		start := time.Now()
+		status, out := call(t, s, "GetActivityTask", map[string]interface{}{"activityArn": ActivityArn("echo")})
+		require.Equal(t, http.StatusOK, status)
+		assert.Empty(t, out)
+		assert.True(t, time.Since(start) >= s.PollTimeout)
+	})
+
+	t.Run("returns a task queued while polling", func(t *testing.T) {
+		s.PollTimeout = 5 * time.Second
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			s.AddTask("echo", `{"hello":"world"}`)
+		}()
+		status, out := call(t, s, "GetActivityTask", map[string]interface{}{
+			"activityArn": ActivityArn("echo"),
+			"workerName":  "worker",
+		})
+		require.Equal(t, http.StatusOK, status)
+		assert.Equal(t, `{"hello":"world"}`, out["input"])
+		assert.Equal(t, "worker", s.WorkerName(out["taskToken"].(string)))
+		assert.Len(t, s.Polls("echo"), 2)
+	})
+
+	t.Run("fails for activities that do not exist", func(t *testing.T) {
+		status, out := call(t, s, "GetActivityTask", map[string]interface{}{"activityArn": ActivityArn("missing")})
+		assert.Equal(t, http.StatusBadRequest, status)
+		assert.Equal(t, "ActivityDoesNotExist", out["__type"])
+	})
+}
+
+func TestTaskResults(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	t.Run("records heartbeats and success", func(t *testing.T) {
+		token := s.AddTask("echo", "{}")
+		status, _ := call(t, s, "SendTaskHeartbeat", map[string]interface{}{"taskToken": token})
+		require.Equal(t, http.StatusOK, status)
+		status, _ = call(t, s, "SendTaskSuccess", map[string]interface{}{"taskToken": token, "output": `{"done":true}`})
+		require.Equal(t, http.StatusOK, status)
+
+		result, ok := s.WaitForResult(token, time.Second)
+		require.True(t, ok)
+		assert.Equal(t, Result{Succeeded: true, Output: `{"done":true}`}, result)
+		assert.Equal(t, 1, s.Heartbeats(token))
+
+		status, out := call(t, s, "SendTaskHeartbeat", map[string]interface{}{"taskToken": token})
+		assert.Equal(t, http.StatusBadRequest, status)
+		assert.Equal(t, "TaskDoesNotExist", out["__type"])
+	})
+
+	t.Run("records failure", func(t *testing.T) {
+		token := s.AddTask("echo", "{}")
+		call(t, s, "SendTaskFailure", map[string]interface{}{"taskToken": token, "error": "sfncli.Unknown", "cause": "oops"})
+		result, ok := s.WaitForResult(token, time.Second)
+		require.True(t, ok)
+		assert.Equal(t, Result{Error: "sfncli.Unknown", Cause: "oops"}, result)
+	})
+
+	t.Run("rejects calls for timed out tasks", func(t *testing.T) {
+		token := s.AddTask("echo", "{}")
+		s.TimeOutTask(token)
+		status, out := call(t, s, "SendTaskHeartbeat", map[string]interface{}{"taskToken": token})
+		assert.Equal(t, http.StatusBadRequest, status)
+		assert.Equal(t, "TaskTimedOut", out["__type"])
+		_, ok := s.WaitForResult(token, 100*time.Millisecond)
+		assert.False(t, ok)
+	})
+
+	t.Run("rejects unknown tokens", func(t *testing.T) {
+		status, out := call(t, s, "SendTaskSuccess", map[string]interface{}{"taskToken": "nope", "output": "{}"})
+		assert.Equal(t, http.StatusBadRequest, status)
+		assert.Equal(t, "InvalidToken", out["__type"])
+	})
+}
@@ -1,4 +1,4 @@
-package main
+package worker
 
 import (
 	"context"
@@ -25,29 +25,39 @@ type CloudWatchReporter struct {
 	activityArn string
 
 	// state to keep track of active percent
-	// the mutex is here to control access by two goroutines, e.g.
+	// the mutex is here to control access by several goroutines, e.g.
 	// 1. the goroutine for `ReportActivePercent`
-	// 2. the goroutine that calls ActiveUntilContextDone
+	// 2. the goroutines polling for and processing tasks, one per slot
+	// active and paused state is tracked per slot, and the time spent in those
+	// states is summed across all slots.
 	mu                    sync.Mutex
-	activeState           bool
+	slots                 int
+	activeState           []bool
 	activeTime            time.Duration
 	lastReportingTime     time.Time
-	lastActiveStateChange time.Time
-	pausedState           bool
+	lastActiveStateChange []time.Time
+	pausedState           []bool
 	pausedTime            time.Duration
-	lastPausedStateChange time.Time
+	lastPausedStateChange []time.Time
 }
 
-func NewCloudWatchReporter(cwapi CloudWatchAPI, activityArn string) *CloudWatchReporter {
+// NewCloudWatchReporter creates a reporter for an activity that processes up to `slots` tasks concurrently.
+func NewCloudWatchReporter(cwapi CloudWatchAPI, activityArn string, slots int) *CloudWatchReporter {
 	now := time.Now()
 	c := &CloudWatchReporter{
 		cwapi:       cwapi,
 		activityArn: activityArn,
 
-		activeState:           false,
+		slots:                 slots,
+		activeState:           make([]bool, slots),
 		activeTime:            time.Duration(0),
 		lastReportingTime:     now,
-		lastActiveStateChange: now,
+		lastActiveStateChange: make([]time.Time, slots),
+		pausedState:           make([]bool, slots),
+		lastPausedStateChange: make([]time.Time, slots),
+	}
+	for slot := 0; slot < slots; slot++ {
+		c.lastActiveStateChange[slot] = now
 	}
 	return c
 }
@@ -67,42 +77,42 @@ func (c *CloudWatchReporter) ReportActivePercent(ctx context.Context, interval t
 	}
 }
 
-// ActiveUntilContextDone sets active state to true, and sets it false when the context is done.
-func (c *CloudWatchReporter) ActiveUntilContextDone(ctx context.Context) {
-	c.SetActiveState(true)
+// ActiveUntilContextDone sets active state of a slot to true, and sets it false when the context is done.
+func (c *CloudWatchReporter) ActiveUntilContextDone(ctx context.Context, slot int) {
+	c.SetActiveState(slot, true)
 	<-ctx.Done()
-	c.SetActiveState(false)
+	c.SetActiveState(slot, false)
 }
 
-// SetPausedState records amount of time activity is paused from working on a task
-func (c *CloudWatchReporter) SetPausedState(paused bool) {
+// SetPausedState records amount of time a slot is paused from working on a task
+func (c *CloudWatchReporter) SetPausedState(slot int, paused bool) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	if paused == c.pausedState {
+	if paused == c.pausedState[slot] {
 		return
 	}
 	now := time.Now()
-	if c.pausedState {
-		c.pausedTime += now.Sub(maxTime(c.lastReportingTime, c.lastPausedStateChange))
+	if c.pausedState[slot] {
+		c.pausedTime += now.Sub(maxTime(c.lastReportingTime, c.lastPausedStateChange[slot]))
 	}
-	c.pausedState = paused
-	c.lastPausedStateChange = now
+	c.pausedState[slot] = paused
+	c.lastPausedStateChange[slot] = now
 }
 
-// SetActiveState sets whether the activity is currently working on a task or not.
-func (c *CloudWatchReporter) SetActiveState(active bool) {
+// SetActiveState sets whether a slot is currently working on a task or not.
+func (c *CloudWatchReporter) SetActiveState(slot int, active bool) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	if active == c.activeState {
+	if active == c.activeState[slot] {
 		return
 	}
 	now := time.Now()
 	// going from active to inactive, so record incremental active time
-	if c.activeState {
-		c.activeTime += now.Sub(maxTime(c.lastReportingTime, c.lastActiveStateChange))
+	if c.activeState[slot] {
+		c.activeTime += now.Sub(maxTime(c.lastReportingTime, c.lastActiveStateChange[slot]))
 	}
-	c.activeState = active
-	c.lastActiveStateChange = now
+	c.activeState[slot] = active
+	c.lastActiveStateChange[slot] = now
 }
 
 // maxTime returns the maximum between two times
@@ -118,16 +128,19 @@ func (c *CloudWatchReporter) report(ctx context.Context) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	now := time.Now()
-	// going from active to inactive, so record incremental active time
-	if c.activeState {
-		c.activeTime += now.Sub(maxTime(c.lastReportingTime, c.lastActiveStateChange))
-	}
-	// record incremental paused time
-	if c.pausedState {
-		c.pausedTime += now.Sub(maxTime(c.lastReportingTime, c.lastPausedStateChange))
+	for slot := 0; slot < c.slots; slot++ {
+		// record incremental active time
+		if c.activeState[slot] {
+			c.activeTime += now.Sub(maxTime(c.lastReportingTime, c.lastActiveStateChange[slot]))
+		}
+		// record incremental paused time
+		if c.pausedState[slot] {
+			c.pausedTime += now.Sub(maxTime(c.lastReportingTime, c.lastPausedStateChange[slot]))
+		}
 	}
 	var activePercent float64
-	totalTime := now.Sub(c.lastReportingTime)
+	// the time available for work is the elapsed time across every slot
+	totalTime := now.Sub(c.lastReportingTime) * time.Duration(c.slots)
 	// don't divide by 0
 	if c.pausedTime == totalTime {
 		activePercent = 100.0
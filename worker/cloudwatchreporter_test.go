@@ -1,4 +1,4 @@
-package main
+package worker
 
 import (
 	"context"
@@ -23,7 +23,7 @@ func TestCloudWatchReporterReportsActiveZero(t *testing.T) {
 	controller := gomock.NewController(t)
 	defer controller.Finish()
 	mockCW := mocks.NewMockCloudWatchAPI(controller)
-	cwr := NewCloudWatchReporter(mockCW, mockActivityArn)
+	cwr := NewCloudWatchReporter(mockCW, mockActivityArn, 1)
 	go cwr.ReportActivePercent(testCtx, 100*time.Millisecond)
 	mockCW.EXPECT().PutMetricData(gomock.Any(), &cloudwatch.PutMetricDataInput{
 		MetricData: []types.MetricDatum{{
@@ -58,14 +58,14 @@ func TestCloudWatchReporterReportsActiveFiftyPercent(t *testing.T) {
 		}},
 		Namespace: aws.String(namespaceStatesCustom),
 	})).Times(2)
-	cwr := NewCloudWatchReporter(mockCW, mockActivityArn)
+	cwr := NewCloudWatchReporter(mockCW, mockActivityArn, 1)
 	go cwr.ReportActivePercent(testCtx, 1*time.Second)
 	go func() {
 		// active for 500 ms in first second and second second
 		time.Sleep(500 * time.Millisecond)
-		cwr.SetActiveState(true)
+		cwr.SetActiveState(0, true)
 		time.Sleep(1 * time.Second)
-		cwr.SetActiveState(false)
+		cwr.SetActiveState(0, false)
 	}()
 	// check after 2 seconds, should be 50% active on both intervals
 	time.Sleep(2*time.Second + 100*time.Millisecond)
@@ -89,9 +89,9 @@ func TestCloudWatchReporterReportsActiveHundredPercent(t *testing.T) {
 		}},
 		Namespace: aws.String(namespaceStatesCustom),
 	})).Times(2)
-	cwr := NewCloudWatchReporter(mockCW, mockActivityArn)
+	cwr := NewCloudWatchReporter(mockCW, mockActivityArn, 1)
 	go cwr.ReportActivePercent(testCtx, 1*time.Second)
-	go cwr.ActiveUntilContextDone(testCtx)
+	go cwr.ActiveUntilContextDone(testCtx, 0)
 	time.Sleep(2*time.Second + 100*time.Millisecond)
 }
 
@@ -113,21 +113,21 @@ func TestCloudWatchReporterReportsActiveOneHundredPercentWhenPausedForever(t *te
 		}},
 		Namespace: aws.String(namespaceStatesCustom),
 	})).Times(2)
-	cwr := NewCloudWatchReporter(mockCW, mockActivityArn)
+	cwr := NewCloudWatchReporter(mockCW, mockActivityArn, 1)
 	go cwr.ReportActivePercent(testCtx, 1*time.Second)
 	go func() {
 		// active for 500 ms in first second and second second
 		time.Sleep(500 * time.Millisecond)
-		cwr.SetActiveState(true)
+		cwr.SetActiveState(0, true)
 		time.Sleep(1 * time.Second)
-		cwr.SetActiveState(false)
+		cwr.SetActiveState(0, false)
 	}()
 	go func() {
 		// pause for 500 ms in first second and second second
 		time.Sleep(500 * time.Millisecond)
-		cwr.SetPausedState(true)
+		cwr.SetPausedState(0, true)
 		time.Sleep(1 * time.Second)
-		cwr.SetPausedState(false)
+		cwr.SetPausedState(0, false)
 	}()
 	// check after 2 seconds, should be 50% active on both intervals
 	time.Sleep(2*time.Second + 100*time.Millisecond)
@@ -151,19 +151,19 @@ func TestCloudWatchReporterReportsActiveOnehundredPercentWhenPaused(t *testing.T
 		}},
 		Namespace: aws.String(namespaceStatesCustom),
 	})).Times(2)
-	cwr := NewCloudWatchReporter(mockCW, mockActivityArn)
+	cwr := NewCloudWatchReporter(mockCW, mockActivityArn, 1)
 	go cwr.ReportActivePercent(testCtx, 1*time.Second)
 	go func() {
 		// active for 500 ms in first second and second second
 		time.Sleep(500 * time.Millisecond)
-		cwr.SetActiveState(true)
+		cwr.SetActiveState(0, true)
 		time.Sleep(1 * time.Second)
-		cwr.SetActiveState(false)
+		cwr.SetActiveState(0, false)
 	}()
 	go func() {
 		// pause after 500 ms indefinitely
 		time.Sleep(500 * time.Millisecond)
-		cwr.SetPausedState(true)
+		cwr.SetPausedState(0, true)
 	}()
 	// check after 2 seconds, should be 50% active on both intervals
 	time.Sleep(2*time.Second + 100*time.Millisecond)
@@ -187,26 +187,51 @@ func TestCloudWatchReporterReportsActiveFiftyPercentWhenPaused(t *testing.T) {
 		}},
 		Namespace: aws.String(namespaceStatesCustom),
 	})).Times(2)
-	cwr := NewCloudWatchReporter(mockCW, mockActivityArn)
+	cwr := NewCloudWatchReporter(mockCW, mockActivityArn, 1)
 	go cwr.ReportActivePercent(testCtx, 1*time.Second)
 	go func() {
 		// active for 250 ms in first second and second second
 		time.Sleep(750 * time.Millisecond)
-		cwr.SetActiveState(true)
+		cwr.SetActiveState(0, true)
 		time.Sleep(500 * time.Millisecond)
-		cwr.SetActiveState(false)
+		cwr.SetActiveState(0, false)
 	}()
 	go func() {
 		// paused for 500 ms in first second and second second
 		time.Sleep(500 * time.Millisecond)
-		cwr.SetPausedState(true)
+		cwr.SetPausedState(0, true)
 		time.Sleep(1 * time.Second)
-		cwr.SetPausedState(false)
+		cwr.SetPausedState(0, false)
 	}()
 	// check after 2 seconds, should be 50% active on both intervals
 	time.Sleep(2*time.Second + 100*time.Millisecond)
 }
 
+func TestCloudWatchReporterReportsFractionOfBusySlots(t *testing.T) {
+	testCtx, testCtxCancel := context.WithCancel(context.Background())
+	defer testCtxCancel()
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+	mockCW := mocks.NewMockCloudWatchAPI(controller)
+	mockCW.EXPECT().PutMetricData(gomock.Any(), fuzzy(&cloudwatch.PutMetricDataInput{
+		MetricData: []types.MetricDatum{{
+			Dimensions: []types.Dimension{{
+				Name:  aws.String("ActivityArn"),
+				Value: aws.String(mockActivityArn),
+			}},
+			MetricName: aws.String(metricNameActivityActivePercent),
+			Unit:       types.StandardUnitPercent,
+			Value:      aws.Float64(25.0),
+		}},
+		Namespace: aws.String(namespaceStatesCustom),
+	})).Times(2)
+	cwr := NewCloudWatchReporter(mockCW, mockActivityArn, 4)
+	go cwr.ReportActivePercent(testCtx, 1*time.Second)
+	// one of four slots is busy the entire time
+	go cwr.ActiveUntilContextDone(testCtx, 2)
+	time.Sleep(2*time.Second + 100*time.Millisecond)
+}
+
 // fuzzyMatcher is a gomock.Matcher that does a fuzzy match on cloudwatch putmetricdata values
 type fuzzyMatcher struct {
 	expected *cloudwatch.PutMetricDataInput
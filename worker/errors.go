@@ -0,0 +1,96 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/Clever/kayvee-go/v7/logger"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sfn"
+)
+
+// States language has the concept of "Error Names"--unique strings that correspond
+// to specific error conditions under which a state can fail:
+// https://states-language.net/spec.html#error-names
+// A Handler fails a task with an error name by returning a TaskFailureError.
+
+// TaskFailureError is the error reported when failing an activity task.
+type TaskFailureError interface {
+	ErrorName() string
+	ErrorCause() string
+
+	error
+}
+
+// TaskFailureCustom is a TaskFailureError with any name and cause. It is also the format of the
+// errors commands write to their output: {"error": "custom.error_name", "cause": "..."}
+type TaskFailureCustom struct {
+	Err   string `json:"error"`
+	Cause string `json:"cause"`
+}
+
+func (t TaskFailureCustom) ErrorName() string  { return t.Err }
+func (t TaskFailureCustom) ErrorCause() string { return t.Cause }
+func (t TaskFailureCustom) Error() string {
+	return fmt.Sprintf("%s: %s", t.ErrorName(), t.ErrorCause())
+}
+
+// taskFailureUnknown is reported for errors returned by a Handler that aren't a TaskFailureError.
+type taskFailureUnknown struct {
+	error
+}
+
+func (t taskFailureUnknown) ErrorName() string  { return "sfncli.Unknown" }
+func (t taskFailureUnknown) ErrorCause() string { return t.Error() }
+
+// TaskFailureWorkerShuttingDown is reported for tasks received after the Worker began shutting down, so
+// that a Retry policy can reschedule them on another worker right away. A Handler can return it for a
+// task it refuses to process because it is stopping.
+type TaskFailureWorkerShuttingDown struct{}
+
+func (t TaskFailureWorkerShuttingDown) ErrorName() string { return "sfncli.WorkerShuttingDown" }
+func (t TaskFailureWorkerShuttingDown) ErrorCause() string {
+	return "the worker received the task after it began shutting down"
+}
+func (t TaskFailureWorkerShuttingDown) Error() string {
+	return fmt.Sprintf("%s: %s", t.ErrorName(), t.ErrorCause())
+}
+
+// sendTaskFailure handles sending AWS `SendTaskFailure`.
+func (w *Worker) sendTaskFailure(token string, err error) {
+	var failure TaskFailureError
+	if !errors.As(err, &failure) {
+		failure = taskFailureUnknown{err}
+	}
+
+	// Limits from https://docs.aws.amazon.com/step-functions/latest/apireference/API_SendTaskFailure.html
+	const maxErrorLength = 256
+	const maxCauseLength = 32768
+
+	if _, sendErr := w.config.SFN.SendTaskFailure(
+		context.Background(),
+		&sfn.SendTaskFailureInput{
+			Error:     aws.String(truncateString(failure.ErrorName(), maxErrorLength, "[truncated]")),
+			Cause:     aws.String(truncateString(failure.ErrorCause(), maxCauseLength, "[truncated]")),
+			TaskToken: aws.String(token),
+		},
+	); sendErr != nil {
+		log.ErrorD("send-task-failure-error", logger.M{"error": sendErr.Error()})
+	}
+}
+
+// Returns its input truncated to maxLength, with the ability to replace the end to indicate truncation.
+//
+// For example, truncateString(s, l, "") just truncates to length l. But truncateString(s, l, "xy") will
+// first truncate to length l, then replace the last two characters with "xy"
+func truncateString(s string, maxLength int, truncationIndicatorSuffix string) string {
+	if len(s) <= maxLength {
+		return s
+	}
+	// when we cut out some number of bytes from the end, we may be cutting in the middle of a multi-byte unicode char
+	// if so, we can use ToValidUTF8 to trim it a teeny bit further to eliminate the whole char.
+	// (Note, this does mean invalid UTF8 inputs will see more changes than expected, but we won't worry about that)
+	return strings.ToValidUTF8(s[:maxLength-len(truncationIndicatorSuffix)], "") + truncationIndicatorSuffix
+}
@@ -0,0 +1,61 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/Clever/kayvee-go/v7/logger"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sfn"
+	"github.com/aws/aws-sdk-go-v2/service/sfn/types"
+)
+
+// defaultHeartbeatInterval is how often heartbeats are sent for a task.
+const defaultHeartbeatInterval = 20 * time.Second
+
+// taskHeartbeatLoop sends heartbeats for a task until the context is canceled. A heartbeat is only
+// sent if the heartbeat check of the task, if any, passes for the time of the previous heartbeat.
+func taskHeartbeatLoop(ctx context.Context, sfnapi SFNAPI, task *Task, interval time.Duration) error {
+	if err := sendTaskHeartbeat(ctx, sfnapi, task.Token); err != nil {
+		return err
+	}
+	lastHeartbeat := time.Now()
+	heartbeat := time.NewTicker(interval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-heartbeat.C:
+			if !task.shouldHeartbeat(lastHeartbeat) {
+				log.Trace("heartbeat-skip")
+				continue
+			}
+			if err := sendTaskHeartbeat(ctx, sfnapi, task.Token); err != nil {
+				return err
+			}
+			lastHeartbeat = time.Now()
+		}
+	}
+}
+
+func sendTaskHeartbeat(ctx context.Context, sfnapi SFNAPI, token string) error {
+	if _, err := sfnapi.SendTaskHeartbeat(ctx, &sfn.SendTaskHeartbeatInput{
+		TaskToken: aws.String(token),
+	}); err != nil {
+		var taskDoesNotExist *types.TaskDoesNotExist
+		var taskTimedOut *types.TaskTimedOut
+		var invalidToken *types.InvalidToken
+		if err != nil && (errors.As(err, &taskDoesNotExist) || errors.As(err, &taskTimedOut) || errors.As(err, &invalidToken)) {
+			return err
+		}
+		if err == context.Canceled {
+			// context was canceled while sending heartbeat
+			return nil
+		}
+		log.ErrorD("heartbeat-error-unknown", logger.M{"error": err.Error()}) // should investigate unknown/unclassified errors
+	}
+	log.Trace("heartbeat-sent")
+	return nil
+}
@@ -0,0 +1,367 @@
+// Package worker processes the tasks of an AWS Step Functions activity with a Handler.
+//
+// A Worker registers the activity, polls for its tasks, sends task heartbeats while its Handler
+// processes them and reports the result of every task to Step Functions. It also reports how busy
+// it is as the ActivityActivePercent CloudWatch metric. The sfncli binary is a Worker whose Handler
+// runs a command for every task.
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Clever/kayvee-go/v7/logger"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sfn"
+	"github.com/aws/aws-sdk-go-v2/service/sfn/types"
+	"github.com/aws/smithy-go"
+	"golang.org/x/time/rate"
+)
+
+var log = logger.New("sfncli")
+
+// SFNAPI defines the Step Functions API operations used by a Worker
+type SFNAPI interface {
+	CreateActivity(ctx context.Context, params *sfn.CreateActivityInput, optFns ...func(*sfn.Options)) (*sfn.CreateActivityOutput, error)
+	TagResource(ctx context.Context, params *sfn.TagResourceInput, optFns ...func(*sfn.Options)) (*sfn.TagResourceOutput, error)
+	GetActivityTask(ctx context.Context, params *sfn.GetActivityTaskInput, optFns ...func(*sfn.Options)) (*sfn.GetActivityTaskOutput, error)
+	SendTaskFailure(ctx context.Context, params *sfn.SendTaskFailureInput, optFns ...func(*sfn.Options)) (*sfn.SendTaskFailureOutput, error)
+	SendTaskSuccess(ctx context.Context, params *sfn.SendTaskSuccessInput, optFns ...func(*sfn.Options)) (*sfn.SendTaskSuccessOutput, error)
+	SendTaskHeartbeat(ctx context.Context, params *sfn.SendTaskHeartbeatInput, optFns ...func(*sfn.Options)) (*sfn.SendTaskHeartbeatOutput, error)
+}
+
+// Handler processes activity tasks.
+//
+// Handle is called with the JSON input of a task and returns its JSON output. An error fails the task:
+// if it is a TaskFailureError its name and cause are reported, otherwise it is reported as sfncli.Unknown.
+// The context is canceled if the task times out in Step Functions or the Worker is stopped.
+// Handle is called concurrently when the Worker has a concurrency above 1.
+type Handler interface {
+	Handle(ctx context.Context, input json.RawMessage) (json.RawMessage, error)
+}
+
+// HandlerFunc is a function that can be used as a Handler.
+type HandlerFunc func(ctx context.Context, input json.RawMessage) (json.RawMessage, error)
+
+// Handle calls f(ctx, input).
+func (f HandlerFunc) Handle(ctx context.Context, input json.RawMessage) (json.RawMessage, error) {
+	return f(ctx, input)
+}
+
+// Config configures a Worker.
+type Config struct {
+	// ActivityName is the name of the activity to register and process tasks of.
+	ActivityName string
+	// WorkerName is sent to Step Functions when polling for tasks.
+	WorkerName string
+	// Tags are applied to the activity when it is registered.
+	Tags []types.Tag
+	// Concurrency is the number of tasks processed concurrently. Defaults to 1.
+	Concurrency int
+	// PollGracePeriod is how long a poll in flight when Drain is called or the context of Run is canceled may
+	// still return a task, which is then failed with sfncli.WorkerShuttingDown. Defaults to 5 seconds.
+	PollGracePeriod time.Duration
+
+	SFN SFNAPI
+	// CloudWatch is where the ActivityActivePercent metric is reported. nil disables metrics.
+	CloudWatch CloudWatchAPI
+
+	Handler Handler
+}
+
+// Worker polls for the tasks of an activity and processes them with a Handler.
+type Worker struct {
+	config            Config
+	activityArn       string
+	cw                *CloudWatchReporter
+	heartbeatInterval time.Duration
+
+	// draining is closed by Drain to stop polling for tasks.
+	draining  chan struct{}
+	drainOnce sync.Once
+	// cancelingPolls is closed by CancelPolls to cancel the polls in flight.
+	cancelingPolls  chan struct{}
+	cancelPollsOnce sync.Once
+}
+
+// DefaultPollGracePeriod is the PollGracePeriod of a Worker unless configured otherwise.
+const DefaultPollGracePeriod = 5 * time.Second
+
+// New creates a Worker. It does not call Step Functions until Register or Run.
+func New(config Config) (*Worker, error) {
+	if config.ActivityName == "" {
+		return nil, errors.New("activity name is required")
+	}
+	if config.WorkerName == "" {
+		return nil, errors.New("worker name is required")
+	}
+	if config.SFN == nil {
+		return nil, errors.New("SFN is required")
+	}
+	if config.Handler == nil {
+		return nil, errors.New("handler is required")
+	}
+	if config.Concurrency == 0 {
+		config.Concurrency = 1
+	}
+	if config.Concurrency < 1 {
+		return nil, errors.New("concurrency must be at least 1")
+	}
+	if config.PollGracePeriod == 0 {
+		config.PollGracePeriod = DefaultPollGracePeriod
+	}
+	if config.PollGracePeriod < 0 {
+		return nil, errors.New("poll grace period cannot be negative")
+	}
+	return &Worker{
+		config:            config,
+		heartbeatInterval: defaultHeartbeatInterval,
+		draining:          make(chan struct{}),
+		cancelingPolls:    make(chan struct{}),
+	}, nil
+}
+
+// Register creates the activity with AWS (it might already exist, which is ok) and returns its ARN.
+// Run registers the activity if Register wasn't called.
+func (w *Worker) Register(ctx context.Context) (string, error) {
+	createOutput, err := w.config.SFN.CreateActivity(ctx, &sfn.CreateActivityInput{
+		Name: aws.String(w.config.ActivityName),
+		Tags: w.config.Tags,
+	})
+	if err != nil {
+		return "", fmt.Errorf("error creating activity %s: %s", w.config.ActivityName, err)
+	}
+
+	// if the activity already exists, tags won't be applied, so explicitly
+	// set tags here
+	if _, err := w.config.SFN.TagResource(ctx, &sfn.TagResourceInput{
+		ResourceArn: createOutput.ActivityArn,
+		Tags:        w.config.Tags,
+	}); err != nil {
+		return "", fmt.Errorf("error tagging activity %s: %s", w.config.ActivityName, err)
+	}
+
+	w.activityArn = *createOutput.ActivityArn
+	w.cw = NewCloudWatchReporter(w.config.CloudWatch, w.activityArn, w.config.Concurrency)
+	return w.activityArn, nil
+}
+
+// ActivityArn is the ARN of the activity, once it is registered.
+func (w *Worker) ActivityArn() string {
+	return w.activityArn
+}
+
+// Run polls for tasks and processes them until the context is canceled. Every slot (see
+// Config.Concurrency) runs its own polling loop, so that up to one task per slot is processed concurrently.
+// It returns once every slot stopped, which is also the case once the tasks in progress are done after Drain.
+// Once the context is canceled or Drain is called, the polls already sent to Step Functions have
+// Config.PollGracePeriod to return before they are canceled, or until CancelPolls is called, and a task
+// they receive is failed with sfncli.WorkerShuttingDown instead of being processed.
+func (w *Worker) Run(ctx context.Context) error {
+	if w.activityArn == "" {
+		if _, err := w.Register(ctx); err != nil {
+			return err
+		}
+	}
+	if w.config.CloudWatch != nil {
+		go w.cw.ReportActivePercent(ctx, 60*time.Second)
+	}
+
+	// polling stops on Drain, but the tasks in progress keep the context of Run
+	pollCtx, pollCtxCancel := context.WithCancel(ctx)
+	defer pollCtxCancel()
+	// the polls in flight are canceled PollGracePeriod later, so that a task Step Functions already handed
+	// them is not lost until it times out. They outlive ctx for that, and are canceled once Run returns.
+	requestCtx, requestCtxCancel := context.WithCancel(context.Background())
+	defer requestCtxCancel()
+	go func() {
+		select {
+		case <-w.draining:
+			pollCtxCancel()
+		case <-pollCtx.Done():
+		}
+		grace := time.NewTimer(w.config.PollGracePeriod)
+		defer grace.Stop()
+		select {
+		case <-grace.C:
+			log.Info("getactivitytask-grace-period-over")
+		case <-w.cancelingPolls:
+		case <-requestCtx.Done():
+		}
+		requestCtxCancel()
+	}()
+
+	var wg sync.WaitGroup
+	for slot := 0; slot < w.config.Concurrency; slot++ {
+		wg.Add(1)
+		go func(slot int) {
+			defer wg.Done()
+			w.pollForTasks(ctx, pollCtx, requestCtx, slot)
+		}(slot)
+	}
+	wg.Wait()
+	return nil
+}
+
+// Drain stops polling for tasks without interrupting the tasks in progress. Run returns once they are done.
+func (w *Worker) Drain() {
+	w.drainOnce.Do(func() { close(w.draining) })
+}
+
+// CancelPolls drains the worker and cancels the polls in flight right away instead of after PollGracePeriod.
+func (w *Worker) CancelPolls() {
+	w.Drain()
+	w.cancelPollsOnce.Do(func() { close(w.cancelingPolls) })
+}
+
+// pollForTasks polls for tasks and processes them one at a time until pollCtx is canceled. Polls are sent
+// with requestCtx, which outlives pollCtx by the grace period, and tasks are processed with ctx.
+func (w *Worker) pollForTasks(ctx, pollCtx, requestCtx context.Context, slot int) {
+	w.cw.SetActiveState(slot, true)
+
+	// allow one GetActivityTask per second, max 1 at a time
+	limiter := rate.NewLimiter(rate.Every(1*time.Second), 1)
+
+	// run getactivitytask and get some work
+	// getactivitytask claims to initiate a polling loop, but it seems to return every few minutes with
+	// a nil error and empty output. So wrap it in a polling loop of our own
+	for pollCtx.Err() == nil {
+		select {
+		case <-pollCtx.Done():
+			log.InfoD("getactivitytask-stop", logger.M{"slot": slot})
+		default:
+			w.cw.SetActiveState(slot, false)
+			// setting paused here so the time spent waiting for the limiter is not counted as time
+			// the task is inactive in the activePercent calculation
+			w.cw.SetPausedState(slot, true)
+			if err := limiter.Wait(pollCtx); err != nil {
+				// must unpause here because no longer waiting for limiter
+				w.cw.SetPausedState(slot, false)
+				continue
+			}
+			// must unpaused here because no longer waiting for limiter
+			w.cw.SetPausedState(slot, false)
+
+			log.TraceD("getactivitytask-start", logger.M{
+				"activity-arn": w.activityArn, "worker-name": w.config.WorkerName, "slot": slot,
+			})
+			getATOutput, err := w.config.SFN.GetActivityTask(requestCtx, &sfn.GetActivityTaskInput{
+				ActivityArn: aws.String(w.activityArn),
+				WorkerName:  aws.String(w.config.WorkerName),
+			})
+			if err != nil {
+				// if the context is canceled or request is canceled, we can continue
+				if errors.Is(err, context.Canceled) {
+					log.Warn("getactivitytask-cancel")
+					continue
+				}
+				var opErr *smithy.OperationError
+				if errors.As(err, &opErr) && opErr.Err.Error() == "request canceled" {
+					log.Warn("getactivitytask-cancel")
+					continue
+				}
+				log.ErrorD("getactivitytask-error", logger.M{"error": err.Error()})
+				continue
+			}
+			if getATOutput.TaskToken == nil { // No jobs to do
+				log.Debug("getactivitytask-skip")
+				continue
+			}
+
+			input := aws.ToString(getATOutput.Input)
+			token := *getATOutput.TaskToken
+			if pollCtx.Err() != nil {
+				log.WarnD("getactivitytask-shutting-down", logger.M{"token": token, "slot": slot})
+				w.sendTaskFailure(token, TaskFailureWorkerShuttingDown{})
+				continue
+			}
+
+			w.cw.SetActiveState(slot, true)
+			log.TraceD("getactivitytask", logger.M{"input": input, "token": token, "slot": slot})
+			w.processTask(ctx, &Task{Token: token, Slot: slot}, input)
+		}
+	}
+}
+
+// processTask sends heartbeats for a task while the handler processes it, and reports its result.
+func (w *Worker) processTask(ctx context.Context, task *Task, input string) {
+	// Create a context for this task. We'll cancel this context on errors.
+	taskCtx, taskCtxCancel := context.WithCancel(ctx)
+	defer taskCtxCancel()
+
+	// Begin sending heartbeats
+	go func() {
+		if err := taskHeartbeatLoop(taskCtx, w.config.SFN, task, w.heartbeatInterval); err != nil {
+			log.ErrorD("heartbeat-error", logger.M{"error": err.Error()})
+			// taskHeartBeatLoop only returns errors when they should be treated as critical
+			// e.g., if the task timed out
+			// shut down the handler in these cases
+			taskCtxCancel()
+			return
+		}
+		log.TraceD("heartbeat-end", logger.M{"token": task.Token})
+	}()
+
+	output, err := w.config.Handler.Handle(withTask(taskCtx, task), json.RawMessage(input))
+	if err != nil {
+		log.ErrorD("task-process-error", logger.M{"error": err.Error(), "slot": task.Slot})
+		w.sendTaskFailure(task.Token, err)
+		return
+	}
+	w.sendTaskSuccess(taskCtx, task.Token, output)
+}
+
+func (w *Worker) sendTaskSuccess(ctx context.Context, token string, output json.RawMessage) {
+	if len(output) == 0 {
+		output = json.RawMessage("{}")
+	}
+	if _, err := w.config.SFN.SendTaskSuccess(ctx, &sfn.SendTaskSuccessInput{
+		Output:    aws.String(string(output)),
+		TaskToken: aws.String(token),
+	}); err != nil {
+		log.ErrorD("send-task-success-error", logger.M{"error": err.Error()})
+	}
+}
+
+// Task is the activity task a Handler is processing. It is in the context passed to Handle.
+type Task struct {
+	// Token is the task token Step Functions assigned to the task.
+	Token string
+	// Slot is the slot (see Config.Concurrency) processing the task, from 0 to Concurrency-1.
+	Slot int
+
+	mu             sync.Mutex
+	heartbeatCheck func(lastHeartbeat time.Time) bool
+}
+
+// SetHeartbeatCheck makes the Worker only send a heartbeat for the task if check returns true
+// for the time the previous heartbeat was sent, e.g. if the handler made progress since then.
+// By default heartbeats are sent for as long as the handler runs.
+func (t *Task) SetHeartbeatCheck(check func(lastHeartbeat time.Time) bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.heartbeatCheck = check
+}
+
+func (t *Task) shouldHeartbeat(lastHeartbeat time.Time) bool {
+	t.mu.Lock()
+	check := t.heartbeatCheck
+	t.mu.Unlock()
+	return check == nil || check(lastHeartbeat)
+}
+
+type taskContextKey struct{}
+
+func withTask(ctx context.Context, task *Task) context.Context {
+	return context.WithValue(ctx, taskContextKey{}, task)
+}
+
+// TaskFromContext returns the task a Handler is processing.
+func TaskFromContext(ctx context.Context) (*Task, bool) {
+	task, ok := ctx.Value(taskContextKey{}).(*Task)
+	return task, ok
+}
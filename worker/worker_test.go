@@ -0,0 +1,325 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Clever/sfncli/mocks"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sfn"
+	"github.com/aws/aws-sdk-go-v2/service/sfn/types"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	mockActivityName = "mockActivity"
+	mockTaskToken    = "taskToken"
+)
+
+// newTestWorker returns a worker whose activity is registered with mockSFN.
+func newTestWorker(t *testing.T, mockSFN *mocks.MockWorkerSFNAPI, handler Handler) *Worker {
+	mockSFN.EXPECT().CreateActivity(gomock.Any(), &sfn.CreateActivityInput{Name: aws.String(mockActivityName)}).
+		Return(&sfn.CreateActivityOutput{ActivityArn: aws.String(mockActivityArn)}, nil)
+	mockSFN.EXPECT().TagResource(gomock.Any(), &sfn.TagResourceInput{ResourceArn: aws.String(mockActivityArn)}).
+		Return(&sfn.TagResourceOutput{}, nil)
+	w, err := New(Config{ActivityName: mockActivityName, WorkerName: "worker", SFN: mockSFN, Handler: handler})
+	require.NoError(t, err)
+	arn, err := w.Register(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, mockActivityArn, arn)
+	return w
+}
+
+// expectTask makes the first GetActivityTask return a task, and later ones return no task.
+func expectTask(mockSFN *mocks.MockWorkerSFNAPI, input string) {
+	mockSFN.EXPECT().GetActivityTask(gomock.Any(), &sfn.GetActivityTaskInput{
+		ActivityArn: aws.String(mockActivityArn),
+		WorkerName:  aws.String("worker"),
+	}).Return(&sfn.GetActivityTaskOutput{Input: aws.String(input), TaskToken: aws.String(mockTaskToken)}, nil)
+	mockSFN.EXPECT().GetActivityTask(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(ctx context.Context, params *sfn.GetActivityTaskInput, optFns ...func(*sfn.Options)) (*sfn.GetActivityTaskOutput, error) {
+			time.Sleep(10 * time.Millisecond)
+			return &sfn.GetActivityTaskOutput{}, nil
+		},
+	).AnyTimes()
+}
+
+func TestWorkerReportsTaskSuccess(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+	mockSFN := mocks.NewMockWorkerSFNAPI(controller)
+	w := newTestWorker(t, mockSFN, HandlerFunc(func(ctx context.Context, input json.RawMessage) (json.RawMessage, error) {
+		task, ok := TaskFromContext(ctx)
+		require.True(t, ok)
+		assert.Equal(t, mockTaskToken, task.Token)
+		assert.Equal(t, 0, task.Slot)
+		assert.JSONEq(t, `{"hello": "world"}`, string(input))
+		return json.RawMessage(`{"goodbye": "world"}`), nil
+	}))
+	expectTask(mockSFN, `{"hello": "world"}`)
+	mockSFN.EXPECT().SendTaskHeartbeat(gomock.Any(), &sfn.SendTaskHeartbeatInput{TaskToken: aws.String(mockTaskToken)}).AnyTimes()
+	mockSFN.EXPECT().SendTaskSuccess(gomock.Any(), &sfn.SendTaskSuccessInput{
+		Output:    aws.String(`{"goodbye": "world"}`),
+		TaskToken: aws.String(mockTaskToken),
+	}).Do(func(ctx context.Context, params *sfn.SendTaskSuccessInput, optFns ...func(*sfn.Options)) { cancel() })
+
+	require.NoError(t, w.Run(ctx))
+}
+
+func TestWorkerReportsTaskFailure(t *testing.T) {
+	for _, test := range []struct {
+		name          string
+		err           error
+		expectedName  string
+		expectedCause string
+	}{
+		{
+			name:          "task failure error",
+			err:           TaskFailureCustom{Err: "custom.error_name", Cause: "bar"},
+			expectedName:  "custom.error_name",
+			expectedCause: "bar",
+		},
+		{
+			name:          "other error",
+			err:           errors.New("something broke"),
+			expectedName:  "sfncli.Unknown",
+			expectedCause: "something broke",
+		},
+		{
+			name:          "cause over the limit of step functions",
+			err:           TaskFailureCustom{Err: "custom.error_name", Cause: strings.Repeat("a", 40000)},
+			expectedName:  "custom.error_name",
+			expectedCause: strings.Repeat("a", 32768-len("[truncated]")) + "[truncated]",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			controller := gomock.NewController(t)
+			defer controller.Finish()
+			mockSFN := mocks.NewMockWorkerSFNAPI(controller)
+			w := newTestWorker(t, mockSFN, HandlerFunc(func(ctx context.Context, input json.RawMessage) (json.RawMessage, error) {
+				return nil, test.err
+			}))
+			expectTask(mockSFN, `{}`)
+			mockSFN.EXPECT().SendTaskHeartbeat(gomock.Any(), gomock.Any()).AnyTimes()
+			mockSFN.EXPECT().SendTaskFailure(gomock.Any(), &sfn.SendTaskFailureInput{
+				Error:     aws.String(test.expectedName),
+				Cause:     aws.String(test.expectedCause),
+				TaskToken: aws.String(mockTaskToken),
+			}).Do(func(ctx context.Context, params *sfn.SendTaskFailureInput, optFns ...func(*sfn.Options)) { cancel() })
+
+			require.NoError(t, w.Run(ctx))
+		})
+	}
+}
+
+func TestWorkerHeartbeats(t *testing.T) {
+	const heartbeatInterval = 50 * time.Millisecond
+
+	t.Run("skips heartbeats the handler's check does not pass", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		controller := gomock.NewController(t)
+		defer controller.Finish()
+		mockSFN := mocks.NewMockWorkerSFNAPI(controller)
+		var checks int32
+		w := newTestWorker(t, mockSFN, HandlerFunc(func(ctx context.Context, input json.RawMessage) (json.RawMessage, error) {
+			task, _ := TaskFromContext(ctx)
+			task.SetHeartbeatCheck(func(lastHeartbeat time.Time) bool {
+				atomic.AddInt32(&checks, 1)
+				return false
+			})
+			time.Sleep(5 * heartbeatInterval)
+			return nil, nil
+		}))
+		w.heartbeatInterval = heartbeatInterval
+		expectTask(mockSFN, `{}`)
+		// only the heartbeat sent when the task starts
+		mockSFN.EXPECT().SendTaskHeartbeat(gomock.Any(), gomock.Any()).Times(1)
+		mockSFN.EXPECT().SendTaskSuccess(gomock.Any(), &sfn.SendTaskSuccessInput{
+			Output:    aws.String(`{}`),
+			TaskToken: aws.String(mockTaskToken),
+		}).Do(func(ctx context.Context, params *sfn.SendTaskSuccessInput, optFns ...func(*sfn.Options)) { cancel() })
+
+		require.NoError(t, w.Run(ctx))
+		assert.True(t, atomic.LoadInt32(&checks) > 0)
+	})
+
+	t.Run("cancels the handler when the task timed out", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		controller := gomock.NewController(t)
+		defer controller.Finish()
+		mockSFN := mocks.NewMockWorkerSFNAPI(controller)
+		w := newTestWorker(t, mockSFN, HandlerFunc(func(ctx context.Context, input json.RawMessage) (json.RawMessage, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}))
+		expectTask(mockSFN, `{}`)
+		mockSFN.EXPECT().SendTaskHeartbeat(gomock.Any(), gomock.Any()).Return(nil, &types.TaskTimedOut{})
+		mockSFN.EXPECT().SendTaskFailure(gomock.Any(), &sfn.SendTaskFailureInput{
+			Error:     aws.String("sfncli.Unknown"),
+			Cause:     aws.String(context.Canceled.Error()),
+			TaskToken: aws.String(mockTaskToken),
+		}).Do(func(ctx context.Context, params *sfn.SendTaskFailureInput, optFns ...func(*sfn.Options)) { cancel() })
+
+		require.NoError(t, w.Run(ctx))
+	})
+}
+
+func TestWorkerFailsTasksReceivedWhileShuttingDown(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		stop func(w *Worker, cancel context.CancelFunc)
+	}{
+		{name: "on Drain", stop: func(w *Worker, cancel context.CancelFunc) { w.Drain() }},
+		{name: "when the context of Run is canceled", stop: func(w *Worker, cancel context.CancelFunc) { cancel() }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			controller := gomock.NewController(t)
+			defer controller.Finish()
+			mockSFN := mocks.NewMockWorkerSFNAPI(controller)
+			w := newTestWorker(t, mockSFN, HandlerFunc(func(ctx context.Context, input json.RawMessage) (json.RawMessage, error) {
+				t.Error("the task should not be processed")
+				return nil, nil
+			}))
+			// the poll outlives the shutdown and Step Functions hands it a task within the grace period
+			mockSFN.EXPECT().GetActivityTask(gomock.Any(), gomock.Any()).DoAndReturn(
+				func(ctx context.Context, params *sfn.GetActivityTaskInput, optFns ...func(*sfn.Options)) (*sfn.GetActivityTaskOutput, error) {
+					tc.stop(w, cancel)
+					time.Sleep(50 * time.Millisecond)
+					assert.NoError(t, ctx.Err())
+					return &sfn.GetActivityTaskOutput{Input: aws.String(`{}`), TaskToken: aws.String(mockTaskToken)}, nil
+				},
+			)
+			mockSFN.EXPECT().SendTaskFailure(gomock.Any(), &sfn.SendTaskFailureInput{
+				Error:     aws.String("sfncli.WorkerShuttingDown"),
+				Cause:     aws.String("the worker received the task after it began shutting down"),
+				TaskToken: aws.String(mockTaskToken),
+			})
+
+			require.NoError(t, w.Run(ctx))
+		})
+	}
+}
+
+func TestNewValidatesConfig(t *testing.T) {
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+	mockSFN := mocks.NewMockWorkerSFNAPI(controller)
+	handler := HandlerFunc(func(ctx context.Context, input json.RawMessage) (json.RawMessage, error) { return nil, nil })
+
+	_, err := New(Config{WorkerName: "worker", SFN: mockSFN, Handler: handler})
+	assert.Error(t, err)
+	_, err = New(Config{ActivityName: mockActivityName, SFN: mockSFN, Handler: handler})
+	assert.Error(t, err)
+	_, err = New(Config{ActivityName: mockActivityName, WorkerName: "worker", Handler: handler})
+	assert.Error(t, err)
+	_, err = New(Config{ActivityName: mockActivityName, WorkerName: "worker", SFN: mockSFN})
+	assert.Error(t, err)
+	_, err = New(Config{ActivityName: mockActivityName, WorkerName: "worker", SFN: mockSFN, Handler: handler, Concurrency: -1})
+	assert.Error(t, err)
+	_, err = New(Config{ActivityName: mockActivityName, WorkerName: "worker", SFN: mockSFN, Handler: handler, PollGracePeriod: -time.Second})
+	assert.Error(t, err)
+
+	w, err := New(Config{ActivityName: mockActivityName, WorkerName: "worker", SFN: mockSFN, Handler: handler})
+	require.NoError(t, err)
+	assert.Equal(t, 1, w.config.Concurrency)
+	assert.Equal(t, DefaultPollGracePeriod, w.config.PollGracePeriod)
+}
+
+func TestWorkerCancelsPollsInFlight(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		stop func(w *Worker, cancel context.CancelFunc)
+		// wait is the least time the poll should outlive stop
+		wait time.Duration
+	}{
+		{name: "after the grace period of a drain", stop: func(w *Worker, cancel context.CancelFunc) { w.Drain() }, wait: 200 * time.Millisecond},
+		{name: "right away on CancelPolls", stop: func(w *Worker, cancel context.CancelFunc) { w.CancelPolls() }},
+		{name: "after the grace period when the context of Run is canceled", stop: func(w *Worker, cancel context.CancelFunc) { cancel() }, wait: 200 * time.Millisecond},
+		{name: "right away on CancelPolls after the context of Run is canceled", stop: func(w *Worker, cancel context.CancelFunc) {
+			cancel()
+			w.CancelPolls()
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			controller := gomock.NewController(t)
+			defer controller.Finish()
+			mockSFN := mocks.NewMockWorkerSFNAPI(controller)
+			w := newTestWorker(t, mockSFN, HandlerFunc(func(ctx context.Context, input json.RawMessage) (json.RawMessage, error) {
+				t.Error("no task should be processed")
+				return nil, nil
+			}))
+			w.config.PollGracePeriod = 200 * time.Millisecond
+			// the poll would last a minute, like a real one that gets no task
+			mockSFN.EXPECT().GetActivityTask(gomock.Any(), gomock.Any()).DoAndReturn(
+				func(ctx context.Context, params *sfn.GetActivityTaskInput, optFns ...func(*sfn.Options)) (*sfn.GetActivityTaskOutput, error) {
+					start := time.Now()
+					tc.stop(w, cancel)
+					select {
+					case <-ctx.Done():
+					case <-time.After(time.Minute):
+						t.Error("the poll was not canceled")
+					}
+					assert.GreaterOrEqual(t, time.Since(start), tc.wait)
+					return nil, ctx.Err()
+				},
+			)
+
+			done := make(chan error)
+			go func() { done <- w.Run(ctx) }()
+			select {
+			case err := <-done:
+				assert.NoError(t, err)
+			case <-time.After(5 * time.Second):
+				t.Fatal("Run did not return")
+			}
+		})
+	}
+}
+
+func TestWorkerDrain(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+	mockSFN := mocks.NewMockWorkerSFNAPI(controller)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	w := newTestWorker(t, mockSFN, HandlerFunc(func(ctx context.Context, input json.RawMessage) (json.RawMessage, error) {
+		close(started)
+		<-release
+		// the task is not canceled by the drain
+		return json.RawMessage(`{}`), ctx.Err()
+	}))
+	expectTask(mockSFN, `{}`)
+	mockSFN.EXPECT().SendTaskHeartbeat(gomock.Any(), gomock.Any()).AnyTimes()
+	mockSFN.EXPECT().SendTaskSuccess(gomock.Any(), &sfn.SendTaskSuccessInput{
+		Output:    aws.String(`{}`),
+		TaskToken: aws.String(mockTaskToken),
+	})
+	go func() {
+		<-started
+		w.Drain()
+		close(release)
+	}()
+
+	require.NoError(t, w.Run(ctx))
+	// Run returned because the worker drained, not because the context ended
+	assert.NoError(t, ctx.Err())
+}